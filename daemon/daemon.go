@@ -1,7 +1,11 @@
 package daemon
 
 import (
+	"crypto"
 	"database/sql"
+	"errors"
+	"fmt"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/tonyyanga/gdp-replicate/gdp"
@@ -12,17 +16,72 @@ import (
 	"go.uber.org/zap"
 )
 
+// Daemon replicates a set of logs with its peers. All logs share one
+// ReplicationServer and one schedule of heartbeats; each has its own
+// LogGraph and Policy.
 type Daemon struct {
 	httpAddr string
 	myAddr   gdp.Hash
 	network  peers.ReplicationServer
-	policy   policy.Policy
+
+	// Logs replicated, by name
+	logs     map[gdp.Hash]*replicatedLog
+	logNames []gdp.Hash
+
+	// Logs each peer does not replicate
+	unshared *unsharedLogs
 
 	// Controls the randomness of sending heart beats to peers
 	heartBeatState int
 	peerList       []gdp.Hash
+
+	// How long to wait for the reply of a peer
+	timeout time.Duration
+
+	retention logserver.Retention
 }
 
+// Options tunes the replication of a Daemon. The zero value gives the
+// default behaviour.
+type Options struct {
+	// Mode restricts the direction of replication with all peers
+	Mode policy.Mode
+
+	// PeerModes overrides Mode for specific peers
+	PeerModes map[gdp.Hash]policy.Mode
+
+	// MaxPayloadBytes bounds the size of the records in one message,
+	// 0 meaning unbounded
+	MaxPayloadBytes int
+
+	// ConversationTimeout is how long to wait for the reply of a peer,
+	// 0 meaning policy.DefaultConversationTimeout
+	ConversationTimeout time.Duration
+
+	// Hooks build, for each log, a hook called with the records newly
+	// persisted by the log
+	Hooks []func(log gdp.Hash) loggraph.Hook
+
+	// Retention bounds the records kept by each log; records pruned
+	// are deleted from peers as well
+	Retention logserver.Retention
+
+	// WriterKeys are the public keys of the writers of logs, by log
+	// name. Records of these logs from peers must be signed with them
+	WriterKeys map[gdp.Hash]crypto.PublicKey
+
+	// AdoptLogMetadata lets a daemon started on a single file without a
+	// metadata record take the one of the first peer sending it. The
+	// peer then picks the writer key of the log
+	AdoptLogMetadata bool
+}
+
+var (
+	errModesUnsupported   = errors.New("policy does not support replication modes")
+	errPayloadUnsupported = errors.New("policy does not support bounded payloads")
+	errTimeoutUnsupported = errors.New("policy does not support conversation timeouts")
+)
+
 // NewDaemon initializes Daemon for a log
 func NewDaemon(
 	httpAddr,
@@ -30,75 +89,352 @@ func NewDaemon(
 	myHashAddr gdp.Hash,
 	peerAddrMap map[gdp.Hash]string,
 	policyType string,
+) (*Daemon, error) {
+	return NewDaemonWithOptions(
+		httpAddr,
+		sqlFile,
+		myHashAddr,
+		peerAddrMap,
+		policyType,
+		Options{},
+	)
+}
+
+// NewDaemonWithOptions initializes Daemon for a log with non-default
+// options. The log is named DefaultLogName, so that peers replicate
+// it whatever the names of their files.
+func NewDaemonWithOptions(
+	httpAddr,
+	sqlFile string,
+	myHashAddr gdp.Hash,
+	peerAddrMap map[gdp.Hash]string,
+	policyType string,
+	opts Options,
+) (*Daemon, error) {
+	return newDaemon(
+		httpAddr,
+		map[gdp.Hash]string{DefaultLogName: sqlFile},
+		myHashAddr,
+		peerAddrMap,
+		policyType,
+		opts,
+	)
+}
+
+// NewLogDirDaemon initializes Daemon for every log in logDir. Each log
+// is a SQLite file named after the hex encoding of its name, with the
+// extension LogFileExt. The PEM encoded public key of its writer, if
+// any, is stored next to it with the extension WriterKeyExt; keys in
+// opts take precedence.
+func NewLogDirDaemon(
+	httpAddr,
+	logDir string,
+	myHashAddr gdp.Hash,
+	peerAddrMap map[gdp.Hash]string,
+	policyType string,
+	opts Options,
+) (*Daemon, error) {
+	logFiles, err := readLogDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	writerKeys, err := readWriterKeys(logDir, logFiles)
+	if err != nil {
+		return nil, err
+	}
+	for name, key := range opts.WriterKeys {
+		writerKeys[name] = key
+	}
+	opts.WriterKeys = writerKeys
+	return newDaemon(
+		httpAddr,
+		logFiles,
+		myHashAddr,
+		peerAddrMap,
+		policyType,
+		opts,
+	)
+}
+
+// newDaemon initializes Daemon for the logs in logFiles, a map from
+// log names to SQLite files.
+func newDaemon(
+	httpAddr string,
+	logFiles map[gdp.Hash]string,
+	myHashAddr gdp.Hash,
+	peerAddrMap map[gdp.Hash]string,
+	policyType string,
+	opts Options,
 ) (*Daemon, error) {
 	zap.S().Infow(
-		"Initializing new naive daemon",
+		"Initializing new daemon",
 		"httpAddr", httpAddr,
-		"sqlFile", sqlFile,
+		"numLogs", len(logFiles),
 		"gdpAddr", myHashAddr.Readable(),
 		"numPeers", len(peerAddrMap),
 	)
+
+	timeout := opts.ConversationTimeout
+	if timeout <= 0 {
+		timeout = policy.DefaultConversationTimeout
+	}
+
+	logs := make(map[gdp.Hash]*replicatedLog)
+	logNames := make([]gdp.Hash, 0, len(logFiles))
+	for name, sqlFile := range logFiles {
+		log, err := openLog(name, sqlFile, myHashAddr, policyType, timeout, opts)
+		if err != nil {
+			return nil, err
+		}
+		logs[name] = log
+		logNames = append(logNames, name)
+	}
+
+	// Create list of peers
+	peerList := make([]gdp.Hash, 0)
+	for peer := range peerAddrMap {
+		peerList = append(peerList, peer)
+	}
+
+	return &Daemon{
+		httpAddr:       httpAddr,
+		myAddr:         myHashAddr,
+		network:        peers.NewGobServer(myHashAddr, peerAddrMap),
+		logs:           logs,
+		logNames:       logNames,
+		unshared:       newUnsharedLogs(),
+		heartBeatState: 0,
+		peerList:       peerList,
+		timeout:        timeout,
+		retention:      opts.Retention,
+	}, nil
+}
+
+// openLog opens the log name stored in sqlFile and the policy
+// replicating it, which waits up to timeout for replies.
+func openLog(
+	name gdp.Hash,
+	sqlFile string,
+	myHashAddr gdp.Hash,
+	policyType string,
+	timeout time.Duration,
+	opts Options,
+) (*replicatedLog, error) {
+	zap.S().Infow(
+		"Opening log",
+		"log", name.Readable(),
+		"sqlFile", sqlFile,
+	)
 	db, err := sql.Open("sqlite3", sqlFile)
 	if err != nil {
 		return nil, err
 	}
 
 	logServer := logserver.NewSqliteServer(db)
+	err = logServer.Migrate()
+	if err != nil {
+		return nil, err
+	}
+
 	logGraph, err := loggraph.NewSimpleGraph(logServer)
 	if err != nil {
 		return nil, err
 	}
+
+	// Logs not named after their metadata record are only those of
+	// daemons started on a single file
+	logName := logGraph.GetLogName()
+	if name != DefaultLogName && logName != gdp.NullHash && logName != name {
+		return nil, fmt.Errorf(
+			"%s holds log %X rather than %X",
+			sqlFile,
+			logName,
+			name,
+		)
+	}
+	for _, hook := range opts.Hooks {
+		logGraph.AddHook(hook(name))
+	}
+	if key, present := opts.WriterKeys[name]; present {
+		zap.S().Infow(
+			"Verifying writer signatures",
+			"log", name.Readable(),
+		)
+		logGraph.SetWriterKey(key)
+	}
+
 	var chosenPolicy policy.Policy
 	switch policyType {
 	case "naive":
 		chosenPolicy = policy.NewNaivePolicy(logGraph)
+	case "merkle":
+		chosenPolicy = policy.NewMerklePolicy(logGraph)
+	case "bloom":
+		chosenPolicy = policy.NewBloomPolicy(
+			logGraph,
+			policy.DefaultBloomFalsePositiveRate,
+		)
+	case "iblt":
+		chosenPolicy = policy.NewIBLTPolicy(logGraph)
+	case "adaptive":
+		chosenPolicy = policy.NewAdaptivePolicy(logGraph)
 	default:
 		chosenPolicy = policy.NewGraphDiffPolicy(logGraph)
 	}
 
-	// Create list of peers
-	peerList := make([]gdp.Hash, 0)
-	for peer := range peerAddrMap {
-		peerList = append(peerList, peer)
+	err = applyModes(chosenPolicy, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Daemon{
-		httpAddr:       httpAddr,
-		myAddr:         myHashAddr,
-		network:        peers.NewGobServer(myHashAddr, peerAddrMap),
-		policy:         chosenPolicy,
-		heartBeatState: 0,
-		peerList:       peerList,
+	if opts.MaxPayloadBytes > 0 {
+		boundedPolicy, ok := chosenPolicy.(policy.BoundedPolicy)
+		if !ok {
+			return nil, errPayloadUnsupported
+		}
+		boundedPolicy.SetMaxPayload(opts.MaxPayloadBytes)
+	}
+
+	if timeoutPolicy, ok := chosenPolicy.(policy.TimeoutPolicy); ok {
+		timeoutPolicy.SetConversationTimeout(timeout)
+	} else if opts.ConversationTimeout > 0 {
+		return nil, errTimeoutUnsupported
+	}
+
+	if tieBreakPolicy, ok := chosenPolicy.(policy.TieBreakPolicy); ok {
+		tieBreakPolicy.SetAddress(myHashAddr)
+	}
+
+	// Tombstones are replicated whether or not this log prunes records
+	tombstonePolicy := policy.NewTombstonePolicy(logGraph, chosenPolicy)
+	tombstonePolicy.SetRetention(opts.Retention)
+	tombstonePolicy.SetMaxPayload(opts.MaxPayloadBytes)
+	err = applyModes(tombstonePolicy, opts)
+	if err != nil {
+		return nil, err
+	}
+	chosenPolicy = tombstonePolicy
+
+	// The metadata record of the log is replicated ahead of anything
+	// else. Daemons started on a single file replicate the log
+	// their file holds, if it has a metadata record yet
+	expectedName := name
+	if name == DefaultLogName {
+		expectedName = logName
+	}
+	metadataPolicy := policy.NewLogMetadataPolicy(logGraph, expectedName, chosenPolicy)
+	metadataPolicy.SetAdoptMetadata(name == DefaultLogName && opts.AdoptLogMetadata)
+	chosenPolicy = metadataPolicy
+
+	return &replicatedLog{
+		name:      name,
+		graph:     logGraph,
+		policy:    chosenPolicy,
+		logServer: logServer,
+		db:        db,
 	}, nil
 }
 
+// Close closes the logs of the daemon, which must not be used after.
+func (daemon Daemon) Close() error {
+	var firstErr error
+	for _, log := range daemon.logs {
+		err := log.close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Start begins listening for and sending heartbeats.
 func (daemon Daemon) Start(fanoutDegree int) error {
 	zap.S().Info("starting daemon")
 	go daemon.scheduleHeartBeat(500, daemon.fanOutHeartBeat(fanoutDegree))
+	go daemon.scheduleExpiry()
+	if !daemon.retention.IsZero() {
+		go daemon.schedulePrune()
+	}
 
-	handler := func(src gdp.Hash, msg interface{}) {
-		returnMsg, err := daemon.policy.ProcessMessage(src, msg)
-		if err == policy.ErrConversationFinished {
-			zap.S().Infow(
-				"heartbeat finished",
-			)
-			return
-		}
-		if err != nil {
-			zap.S().Errorw(
-				"failed to process msg",
-				"msg", msg,
-				"error", err,
-			)
-			return
-		}
+	err := daemon.network.ListenAndServe(daemon.httpAddr, daemon.handleMessage)
+	return err
+}
 
-		// Daemon will always send content over the network,
-		// even if returnMsg is nil
-		daemon.network.Send(src, returnMsg)
+// handleMessage hands a message from src to the policy of its log and
+// replies to it.
+func (daemon Daemon) handleMessage(src gdp.Hash, logName gdp.Hash, msg interface{}) {
+	if _, ok := msg.(*peers.UnknownLog); ok {
+		zap.S().Infow(
+			"peer does not replicate log",
+			"src", src.Readable(),
+			"log", logName.Readable(),
+		)
+		daemon.unshared.add(src, logName)
+		return
 	}
 
-	err := daemon.network.ListenAndServe(daemon.httpAddr, handler)
-	return err
+	log, present := daemon.logs[logName]
+	if !present {
+		zap.S().Infow(
+			"heartbeat for unknown log",
+			"src", src.Readable(),
+			"log", logName.Readable(),
+		)
+		daemon.network.Send(src, logName, &peers.UnknownLog{})
+		return
+	}
+	daemon.unshared.remove(src, logName)
+
+	returnMsg, err := log.policy.ProcessMessage(src, msg)
+	if err == policy.ErrConversationFinished {
+		zap.S().Infow(
+			"heartbeat finished",
+			"log", logName.Readable(),
+		)
+		return
+	}
+	if err == policy.ErrMessageIgnored {
+		zap.S().Infow(
+			"heartbeat ignored",
+			"src", src.Readable(),
+			"log", logName.Readable(),
+		)
+		return
+	}
+	if err != nil {
+		zap.S().Errorw(
+			"failed to process msg",
+			"log", logName.Readable(),
+			"msg", msg,
+			"error", err,
+		)
+		return
+	}
+
+	// Daemon will always send content over the network,
+	// even if returnMsg is nil
+	daemon.network.Send(src, logName, returnMsg)
+}
+
+// applyModes configures the replication modes of opts on chosenPolicy.
+func applyModes(chosenPolicy policy.Policy, opts Options) error {
+	modalPolicy, ok := chosenPolicy.(policy.ModalPolicy)
+	if !ok {
+		if opts.Mode != policy.Bidirectional || len(opts.PeerModes) > 0 {
+			return errModesUnsupported
+		}
+		return nil
+	}
+
+	modalPolicy.SetMode(opts.Mode)
+	for peer, mode := range opts.PeerModes {
+		zap.S().Infow(
+			"Setting peer replication mode",
+			"peer", peer.Readable(),
+			"mode", mode.String(),
+		)
+		modalPolicy.SetPeerMode(peer, mode)
+	}
+	return nil
 }
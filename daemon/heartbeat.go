@@ -5,11 +5,15 @@ import (
 	"time"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/policy"
 	"go.uber.org/zap"
 )
 
 type heartBeatSender func() error
 
+// pruneInterval is how often a log with a retention is pruned
+const pruneInterval = time.Minute
+
 // Send a heart beat every INTERVAL seconds
 func (daemon Daemon) scheduleHeartBeat(interval int, heartBeat heartBeatSender) error {
 	zap.S().Infow(
@@ -29,9 +33,94 @@ func (daemon Daemon) scheduleHeartBeat(interval int, heartBeat heartBeatSender)
 	return nil
 }
 
-// Sends a heartbeat message to PEER if necessary
+// scheduleExpiry checks for expired conversations twice per timeout
+// and restarts each one with a new heartbeat instead of waiting for the
+// next scheduled heartbeat.
+func (daemon Daemon) scheduleExpiry() {
+	ticker := time.NewTicker(daemon.timeout / 2)
+	for _ = range ticker.C {
+		for _, log := range daemon.logs {
+			timeoutPolicy, ok := log.policy.(policy.TimeoutPolicy)
+			if !ok {
+				continue
+			}
+			for _, peer := range timeoutPolicy.ExpireConversations() {
+				zap.S().Infow(
+					"restarting expired conversation",
+					"peer", peer.Readable(),
+					"log", log.name.Readable(),
+				)
+				err := daemon.sendLogHeartBeat(log, peer)
+				if err != nil {
+					zap.S().Errorw(
+						"Failed to send heartbeat",
+						"error", err,
+					)
+				}
+			}
+		}
+	}
+}
+
+// schedulePrune deletes the records the retention of each log does
+// not keep every pruneInterval.
+func (daemon Daemon) schedulePrune() {
+	ticker := time.NewTicker(pruneInterval)
+	for _ = range ticker.C {
+		for _, log := range daemon.logs {
+			tombstones, err := log.graph.Prune(daemon.retention)
+			if err != nil {
+				zap.S().Errorw(
+					"Failed to prune log",
+					"log", log.name.Readable(),
+					"error", err,
+				)
+				continue
+			}
+			zap.S().Infow(
+				"pruned log",
+				"log", log.name.Readable(),
+				"numPruned", len(tombstones),
+			)
+		}
+	}
+}
+
+// Sends a heartbeat message to PEER for every log it may replicate
 func (daemon Daemon) sendHeartBeat(peer gdp.Hash) error {
-	msg, err := daemon.policy.GenerateMessage(peer)
+	var firstErr error
+	for _, logName := range daemon.logNames {
+		if daemon.unshared.contains(peer, logName) {
+			continue
+		}
+		err := daemon.sendLogHeartBeat(daemon.logs[logName], peer)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Sends a heartbeat message about LOG to PEER if necessary. Records
+// written to the log by its local writer since the last heartbeat are
+// picked up first, so that the heartbeat advertises them.
+func (daemon Daemon) sendLogHeartBeat(log *replicatedLog, peer gdp.Hash) error {
+	numAdded, err := log.graph.Refresh()
+	if err != nil {
+		zap.S().Errorw(
+			"Failed to refresh log",
+			"log", log.name.Readable(),
+			"error", err,
+		)
+	} else if numAdded > 0 {
+		zap.S().Infow(
+			"picked up local records",
+			"log", log.name.Readable(),
+			"numRecords", numAdded,
+		)
+	}
+
+	msg, err := log.policy.GenerateMessage(peer)
 	if err != nil {
 		return err
 	}
@@ -41,6 +130,7 @@ func (daemon Daemon) sendHeartBeat(peer gdp.Hash) error {
 		zap.S().Infow(
 			"no heartbeat sent",
 			"dst", peer.Readable(),
+			"log", log.name.Readable(),
 		)
 		return nil
 	}
@@ -48,9 +138,10 @@ func (daemon Daemon) sendHeartBeat(peer gdp.Hash) error {
 	zap.S().Infow(
 		"heart beat sent",
 		"dst", peer.Readable(),
+		"log", log.name.Readable(),
 		"msg", msg,
 	)
-	return daemon.network.Send(peer, msg)
+	return daemon.network.Send(peer, log.name, msg)
 }
 
 // Send a heartbeat message to one of daemon peers.
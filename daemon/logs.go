@@ -0,0 +1,162 @@
+package daemon
+
+import (
+	"crypto"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/policy"
+	"go.uber.org/zap"
+)
+
+// DefaultLogName names the log of a daemon started on a single file.
+var DefaultLogName = gdp.NullHash
+
+// LogFileExt is the extension of the log files in a log directory.
+const LogFileExt = ".glob"
+
+// WriterKeyExt is the extension of the files holding the public keys
+// of log writers in a log directory.
+const WriterKeyExt = ".pub"
+
+// replicatedLog is one log replicated by a Daemon.
+type replicatedLog struct {
+	name   gdp.Hash
+	graph  loggraph.LogGraph
+	policy policy.Policy
+
+	// the log server and database of graph, closed with the daemon
+	logServer *logserver.SqliteServer
+	db        *sql.DB
+}
+
+// close releases the log server and database of log.
+func (log *replicatedLog) close() error {
+	err := log.logServer.Close()
+	dbErr := log.db.Close()
+	if err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+// readLogDir returns the log files in logDir, by log name. Files whose
+// name is not the hex encoding of a log name are skipped.
+func readLogDir(logDir string) (map[gdp.Hash]string, error) {
+	files, err := ioutil.ReadDir(logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	logFiles := make(map[gdp.Hash]string)
+	for _, file := range files {
+		name, ok := parseLogFileName(file.Name())
+		if file.IsDir() || !ok {
+			zap.S().Debugw(
+				"Skipping file in log directory",
+				"file", file.Name(),
+			)
+			continue
+		}
+		logFiles[name] = filepath.Join(logDir, file.Name())
+	}
+	return logFiles, nil
+}
+
+// readWriterKeys returns the writer keys stored in logDir for the logs
+// in logFiles, by log name. Logs without a key file are skipped.
+func readWriterKeys(logDir string, logFiles map[gdp.Hash]string) (map[gdp.Hash]crypto.PublicKey, error) {
+	keys := make(map[gdp.Hash]crypto.PublicKey)
+	for name := range logFiles {
+		keyFile := filepath.Join(logDir, WriterKeyFileName(name))
+		pemBytes, err := ioutil.ReadFile(keyFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := gdp.ParseWriterKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// parseLogFileName returns the name of the log stored in fileName.
+func parseLogFileName(fileName string) (gdp.Hash, bool) {
+	var name gdp.Hash
+	if !strings.HasSuffix(fileName, LogFileExt) {
+		return name, false
+	}
+
+	encoded := strings.TrimSuffix(fileName, LogFileExt)
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil || len(decoded) != len(name) {
+		return name, false
+	}
+	copy(name[:], decoded)
+	return name, true
+}
+
+// LogFileName returns the name of the file storing log in a log
+// directory.
+func LogFileName(log gdp.Hash) string {
+	return hex.EncodeToString(log[:]) + LogFileExt
+}
+
+// WriterKeyFileName returns the name of the file storing the writer
+// key of log in a log directory.
+func WriterKeyFileName(log gdp.Hash) string {
+	return hex.EncodeToString(log[:]) + WriterKeyExt
+}
+
+// unsharedLogs keeps the logs each peer answered it does not
+// replicate, so that no heartbeat is sent to it for them.
+type unsharedLogs struct {
+	logs  map[gdp.Hash]map[gdp.Hash]bool
+	mutex sync.Mutex
+}
+
+func newUnsharedLogs() *unsharedLogs {
+	return &unsharedLogs{logs: make(map[gdp.Hash]map[gdp.Hash]bool)}
+}
+
+// add records that peer does not replicate log.
+func (unshared *unsharedLogs) add(peer gdp.Hash, log gdp.Hash) {
+	unshared.mutex.Lock()
+	defer unshared.mutex.Unlock()
+
+	if unshared.logs[peer] == nil {
+		unshared.logs[peer] = make(map[gdp.Hash]bool)
+	}
+	unshared.logs[peer][log] = true
+}
+
+// remove records that peer replicates log, e.g. after it started to.
+func (unshared *unsharedLogs) remove(peer gdp.Hash, log gdp.Hash) {
+	unshared.mutex.Lock()
+	defer unshared.mutex.Unlock()
+
+	delete(unshared.logs[peer], log)
+}
+
+// contains reports whether peer does not replicate log.
+func (unshared *unsharedLogs) contains(peer gdp.Hash, log gdp.Hash) bool {
+	unshared.mutex.Lock()
+	defer unshared.mutex.Unlock()
+
+	return unshared.logs[peer][log]
+}
@@ -0,0 +1,267 @@
+package daemon
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+// directNetwork delivers messages by calling the handlers of other
+// daemons directly.
+type directNetwork struct {
+	self    gdp.Hash
+	daemons map[gdp.Hash]*Daemon
+
+	// messages sent, by log
+	numSent map[gdp.Hash]int
+}
+
+func (network *directNetwork) ListenAndServe(
+	address string,
+	handler func(src gdp.Hash, log gdp.Hash, msg interface{}),
+) error {
+	return nil
+}
+
+func (network *directNetwork) Send(peer gdp.Hash, log gdp.Hash, msg interface{}) error {
+	network.numSent[log]++
+	network.daemons[peer].handleMessage(network.self, log, msg)
+	return nil
+}
+
+// writeLog creates the file of log in dir, holding records.
+func writeLog(t *testing.T, dir string, log gdp.Hash, records []gdp.Record) {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, LogFileName(log)))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	logServer := logserver.NewSqliteServer(db)
+	assert.Nil(t, logServer.Migrate())
+	assert.Nil(t, logServer.WriteRecords(records))
+}
+
+func testRecord(value string) gdp.Record {
+	record := gdp.Record{
+		Metadatum: gdp.Metadatum{Sig: []byte{}},
+		Value:     []byte(value),
+	}
+	record.Hash = gdp.RecordHash(record)
+	return record
+}
+
+func TestLogDirDaemon(t *testing.T) {
+	shared := gdp.GenerateHash("shared log")
+	onlyA := gdp.GenerateHash("log of A")
+	onlyB := gdp.GenerateHash("log of B")
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	dirA, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirA)
+	dirB, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirB)
+
+	writeLog(t, dirA, shared, []gdp.Record{testRecord("a")})
+	writeLog(t, dirA, onlyA, []gdp.Record{testRecord("c")})
+	writeLog(t, dirB, shared, []gdp.Record{testRecord("b")})
+	writeLog(t, dirB, onlyB, []gdp.Record{testRecord("d")})
+
+	// Other files are not logs
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dirA, "notes.txt"), nil, 0644))
+
+	daemonA, err := NewLogDirDaemon("", dirA, addrA, map[gdp.Hash]string{addrB: ""}, "naive", Options{})
+	assert.Nil(t, err)
+	daemonB, err := NewLogDirDaemon("", dirB, addrB, map[gdp.Hash]string{addrA: ""}, "naive", Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(daemonA.logs))
+
+	daemons := map[gdp.Hash]*Daemon{addrA: daemonA, addrB: daemonB}
+	networkA := &directNetwork{addrA, daemons, make(map[gdp.Hash]int)}
+	networkB := &directNetwork{addrB, daemons, make(map[gdp.Hash]int)}
+	daemonA.network = networkA
+	daemonB.network = networkB
+
+	for round := 0; round < 2; round++ {
+		assert.Nil(t, daemonA.sendHeartBeat(addrB))
+		assert.Nil(t, daemonB.sendHeartBeat(addrA))
+	}
+
+	// The shared log is replicated, the others are left alone
+	assert.Equal(t, 2, len(daemonA.logs[shared].graph.GetNodeMap()))
+	assert.Equal(t, 2, len(daemonB.logs[shared].graph.GetNodeMap()))
+	assert.Equal(t, 1, len(daemonA.logs[onlyA].graph.GetNodeMap()))
+	assert.Equal(t, 1, len(daemonB.logs[onlyB].graph.GetNodeMap()))
+
+	// Logs a peer does not replicate are offered once
+	assert.True(t, daemonA.unshared.contains(addrB, onlyA))
+	assert.True(t, daemonB.unshared.contains(addrA, onlyB))
+	assert.Equal(t, 1, networkA.numSent[onlyA])
+	assert.Equal(t, 1, networkB.numSent[onlyB])
+
+	assert.Nil(t, daemonA.Close())
+	assert.Nil(t, daemonB.Close())
+	_, err = daemonA.logs[shared].logServer.ReadAllRecords()
+	assert.NotNil(t, err)
+}
+
+func TestLogDirWriterKeys(t *testing.T) {
+	log := gdp.GenerateHash("signed log")
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	dirA, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirA)
+	dirB, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirB)
+
+	writerKey, writer, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signed := gdp.Record{
+		Metadatum: gdp.Metadatum{Sig: []byte{}},
+		Value:     []byte("signed"),
+	}
+	assert.Nil(t, gdp.SignRecord(writer, &signed))
+	unsigned := testRecord("unsigned")
+
+	// Only B checks the signatures of the log
+	der, err := x509.MarshalPKIXPublicKey(writerKey)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(
+		filepath.Join(dirB, WriterKeyFileName(log)),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		0644,
+	))
+	writeLog(t, dirA, log, []gdp.Record{signed, unsigned})
+	writeLog(t, dirB, log, nil)
+
+	daemonA, err := NewLogDirDaemon("", dirA, addrA, map[gdp.Hash]string{addrB: ""}, "naive", Options{})
+	assert.Nil(t, err)
+	daemonB, err := NewLogDirDaemon("", dirB, addrB, map[gdp.Hash]string{addrA: ""}, "naive", Options{})
+	assert.Nil(t, err)
+
+	daemons := map[gdp.Hash]*Daemon{addrA: daemonA, addrB: daemonB}
+	daemonA.network = &directNetwork{addrA, daemons, make(map[gdp.Hash]int)}
+	daemonB.network = &directNetwork{addrB, daemons, make(map[gdp.Hash]int)}
+	assert.Nil(t, daemonA.sendHeartBeat(addrB))
+
+	assert.Equal(
+		t,
+		map[gdp.Hash]bool{signed.Hash: true},
+		daemonB.logs[log].graph.GetNodeMap(),
+	)
+
+	db, err := sql.Open("sqlite3", filepath.Join(dirB, LogFileName(log)))
+	assert.Nil(t, err)
+	defer db.Close()
+	quarantined, err := logserver.NewSqliteServer(db).ReadQuarantine()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(quarantined))
+	assert.Equal(t, unsigned.Hash, quarantined[0].Hash)
+	assert.Equal(t, addrA, quarantined[0].Source)
+}
+
+func TestLogDirMetadata(t *testing.T) {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	metadata := gdp.LogMetadata{Created: 1}
+	log := metadata.Name()
+	first := gdp.Record{
+		Metadatum: gdp.Metadatum{RecNo: 1, PrevHash: log, Sig: []byte{}},
+		Value:     []byte("first"),
+	}
+	first.Hash = gdp.RecordHash(first)
+
+	dirA, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirA)
+	dirB, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirB)
+
+	writeLog(t, dirA, log, []gdp.Record{first})
+	writeLog(t, dirB, log, nil)
+	db, err := sql.Open("sqlite3", filepath.Join(dirA, LogFileName(log)))
+	assert.Nil(t, err)
+	assert.Nil(t, logserver.NewSqliteServer(db).WriteLogMetadata(metadata))
+	db.Close()
+
+	daemonA, err := NewLogDirDaemon("", dirA, addrA, map[gdp.Hash]string{addrB: ""}, "naive", Options{})
+	assert.Nil(t, err)
+	daemonB, err := NewLogDirDaemon("", dirB, addrB, map[gdp.Hash]string{addrA: ""}, "naive", Options{})
+	assert.Nil(t, err)
+
+	daemons := map[gdp.Hash]*Daemon{addrA: daemonA, addrB: daemonB}
+	daemonA.network = &directNetwork{addrA, daemons, make(map[gdp.Hash]int)}
+	daemonB.network = &directNetwork{addrB, daemons, make(map[gdp.Hash]int)}
+	assert.Nil(t, daemonB.sendHeartBeat(addrA))
+
+	graphB := daemonB.logs[log].graph
+	assert.Equal(t, log, graphB.GetLogName())
+	assert.True(t, graphB.IsRooted(first.Hash))
+
+	// A log file must be named after its metadata record
+	assert.Nil(t, os.Rename(
+		filepath.Join(dirA, LogFileName(log)),
+		filepath.Join(dirA, LogFileName(gdp.GenerateHash("other"))),
+	))
+	_, err = NewLogDirDaemon("", dirA, addrA, map[gdp.Hash]string{addrB: ""}, "naive", Options{})
+	assert.NotNil(t, err)
+}
+
+func TestLogDirExternalWrites(t *testing.T) {
+	log := gdp.GenerateHash("log")
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	dirA, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirA)
+	dirB, err := ioutil.TempDir("", "daemon")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dirB)
+
+	writeLog(t, dirA, log, nil)
+	writeLog(t, dirB, log, nil)
+	daemonA, err := NewLogDirDaemon("", dirA, addrA, map[gdp.Hash]string{addrB: ""}, "naive", Options{})
+	assert.Nil(t, err)
+	daemonB, err := NewLogDirDaemon("", dirB, addrB, map[gdp.Hash]string{addrA: ""}, "naive", Options{})
+	assert.Nil(t, err)
+
+	daemons := map[gdp.Hash]*Daemon{addrA: daemonA, addrB: daemonB}
+	daemonA.network = &directNetwork{addrA, daemons, make(map[gdp.Hash]int)}
+	daemonB.network = &directNetwork{addrB, daemons, make(map[gdp.Hash]int)}
+
+	// The local writer of A appends to the log file while A runs
+	record := testRecord("written by gdplogd")
+	writeLog(t, dirA, log, []gdp.Record{record})
+	assert.Nil(t, daemonA.sendHeartBeat(addrB))
+
+	assert.True(t, daemonA.logs[log].graph.GetNodeMap()[record.Hash])
+	assert.True(t, daemonB.logs[log].graph.GetNodeMap()[record.Hash])
+}
+
+func TestParseLogFileName(t *testing.T) {
+	log := gdp.GenerateHash("log")
+	name, ok := parseLogFileName(LogFileName(log))
+	assert.True(t, ok)
+	assert.Equal(t, log, name)
+
+	for _, fileName := range []string{
+		"simple_long.glob",
+		"abcd.glob",
+		LogFileName(log) + ".bak",
+	} {
+		_, ok = parseLogFileName(fileName)
+		assert.False(t, ok, fileName)
+	}
+}
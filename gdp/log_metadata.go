@@ -0,0 +1,62 @@
+package gdp
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// LogMetadata is the metadata record of a log, written by its writer
+// before any record. The name of a log is the hash of its metadata
+// record, and the first record of the log has that name for PrevHash.
+type LogMetadata struct {
+	// WriterKey is the PKIX DER encoding of the public key of the
+	// writer, if its records are signed
+	WriterKey []byte
+
+	// Created is when the log was created, in Unix nanoseconds
+	Created int64
+
+	// Params holds the other parameters the log was created with
+	Params map[string]string
+}
+
+// Name returns the name of the log: the SHA-256 of its WriterKey,
+// Created and Params, sorted by key. Byte strings are preceded by
+// their length, as in RecordHash.
+func (metadata LogMetadata) Name() Hash {
+	hasher := sha256.New()
+	var buf [8]byte
+
+	writeBytes(hasher, metadata.WriterKey)
+
+	binary.BigEndian.PutUint64(buf[:], uint64(metadata.Created))
+	hasher.Write(buf[:])
+
+	keys := make([]string, 0, len(metadata.Params))
+	for key := range metadata.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	binary.BigEndian.PutUint64(buf[:], uint64(len(keys)))
+	hasher.Write(buf[:])
+	for _, key := range keys {
+		writeBytes(hasher, []byte(key))
+		writeBytes(hasher, []byte(metadata.Params[key]))
+	}
+
+	var name Hash
+	copy(name[:], hasher.Sum(nil))
+	return name
+}
+
+// PublicKey parses the writer key of the log. It returns nil if the
+// log has no writer key.
+func (metadata LogMetadata) PublicKey() (crypto.PublicKey, error) {
+	if len(metadata.WriterKey) == 0 {
+		return nil, nil
+	}
+	return parseWriterKeyDER(metadata.WriterKey)
+}
@@ -17,3 +17,11 @@ type Metadatum struct {
 	Value     []byte
 	Sig       []byte
 }
+
+// Tombstone marks a record deleted on purpose. It keeps the place of
+// the record in its chain so that the records after it are not taken
+// for the far side of a hole.
+type Tombstone struct {
+	Hash     Hash
+	PrevHash Hash
+}
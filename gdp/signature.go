@@ -0,0 +1,103 @@
+package gdp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+var (
+	ErrUnsigned       = errors.New("record is not signed")
+	ErrBadSignature   = errors.New("record signature does not verify")
+	ErrUnsupportedKey = errors.New("writer key is neither ed25519 nor ECDSA P-256")
+	ErrNoPublicKey    = errors.New("no PEM encoded public key found")
+)
+
+// ParseWriterKey parses the PEM encoded PKIX public key of a log
+// writer, which GDP keeps as ed25519 or ECDSA P-256.
+func ParseWriterKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, ErrNoPublicKey
+	}
+	return parseWriterKeyDER(block.Bytes)
+}
+
+// parseWriterKeyDER parses the PKIX DER encoded public key of a log
+// writer.
+func parseWriterKeyDER(der []byte) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if !supportedKey(key) {
+		return nil, ErrUnsupportedKey
+	}
+	return key, nil
+}
+
+// supportedKey reports whether key is an ed25519 or ECDSA P-256
+// public key.
+func supportedKey(key crypto.PublicKey) bool {
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return len(key) == ed25519.PublicKeySize
+	case *ecdsa.PublicKey:
+		return key.Curve == elliptic.P256()
+	}
+	return false
+}
+
+// SignRecord signs the SignedDigest of record with the key of its
+// writer, then sets its Sig and its Hash.
+func SignRecord(signer crypto.Signer, record *Record) error {
+	if !supportedKey(signer.Public()) {
+		return ErrUnsupportedKey
+	}
+
+	// ed25519 signs the digest itself rather than a hash of it
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+
+	digest := SignedDigest(*record)
+	sig, err := signer.Sign(rand.Reader, digest[:], opts)
+	if err != nil {
+		return err
+	}
+	record.Sig = sig
+	record.Hash = RecordHash(*record)
+	return nil
+}
+
+// VerifyRecord checks that the Sig of record is the signature of its
+// SignedDigest by the writer key. ECDSA signatures are ASN.1 encoded.
+func VerifyRecord(key crypto.PublicKey, record Record) error {
+	if len(record.Sig) == 0 {
+		return ErrUnsigned
+	}
+
+	if !supportedKey(key) {
+		return ErrUnsupportedKey
+	}
+
+	digest := SignedDigest(record)
+	var valid bool
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, digest[:], record.Sig)
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest[:], record.Sig)
+	}
+
+	if !valid {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package gdp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writerKeys returns an ed25519 and an ECDSA P-256 writer key.
+func writerKeys(t *testing.T) map[string]crypto.Signer {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	return map[string]crypto.Signer{"ed25519": edKey, "ecdsa": ecKey}
+}
+
+func TestSignAndVerifyRecord(t *testing.T) {
+	keys := writerKeys(t)
+	for name, key := range keys {
+		record := Record{
+			Metadatum: Metadatum{RecNo: 1, PrevHash: GenerateHash("prev")},
+			Value:     []byte("value"),
+		}
+		assert.Equal(t, ErrUnsigned, VerifyRecord(key.Public(), record), name)
+
+		assert.Nil(t, SignRecord(key, &record), name)
+		assert.Nil(t, VerifyRecord(key.Public(), record), name)
+		assert.Equal(t, RecordHash(record), record.Hash, name)
+
+		// Any change to the signed contents breaks the signature
+		tampered := record
+		tampered.Value = []byte("other")
+		assert.Equal(t, ErrBadSignature, VerifyRecord(key.Public(), tampered), name)
+
+		// So does a signature by another writer
+		for otherName, other := range keys {
+			if otherName == name {
+				continue
+			}
+			assert.NotNil(t, VerifyRecord(other.Public(), record), name)
+		}
+	}
+}
+
+func TestUnsupportedWriterKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.Nil(t, err)
+
+	record := Record{Value: []byte("value")}
+	assert.Equal(t, ErrUnsupportedKey, SignRecord(key, &record))
+
+	record.Sig = []byte("sig")
+	assert.Equal(t, ErrUnsupportedKey, VerifyRecord(key.Public(), record))
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	assert.Nil(t, err)
+	_, err = ParseWriterKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.Equal(t, ErrUnsupportedKey, err)
+}
+
+func TestParseWriterKey(t *testing.T) {
+	for name, key := range writerKeys(t) {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		assert.Nil(t, err, name)
+
+		parsed, err := ParseWriterKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		assert.Nil(t, err, name)
+		assert.Equal(t, key.Public(), parsed, name)
+	}
+
+	_, err := ParseWriterKey([]byte("not a key"))
+	assert.Equal(t, ErrNoPublicKey, err)
+}
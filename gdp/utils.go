@@ -2,8 +2,11 @@ package gdp
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 )
 
 func (record *Record) MarshalBinary() (data []byte, err error) {
@@ -21,3 +24,56 @@ func (hash Hash) Readable() string {
 func GenerateHash(seed string) Hash {
 	return sha256.Sum256([]byte(seed))
 }
+
+// RecordHash computes the canonical hash of a record: the SHA-256 of
+// its PrevHash, RecNo, Timestamp, Accuracy, Value and Sig. Integers
+// and floats are encoded as 8 big-endian bytes, and Value and Sig are
+// each preceded by their length, so that distinct records never share
+// an encoding.
+func RecordHash(record Record) Hash {
+	hasher := sha256.New()
+	writeContents(hasher, record)
+	writeBytes(hasher, record.Sig)
+
+	var hash Hash
+	copy(hash[:], hasher.Sum(nil))
+	return hash
+}
+
+// SignedDigest computes the digest a writer signs: the SHA-256 of the
+// contents of a record hashed by RecordHash, except its Sig.
+func SignedDigest(record Record) Hash {
+	hasher := sha256.New()
+	writeContents(hasher, record)
+
+	var digest Hash
+	copy(digest[:], hasher.Sum(nil))
+	return digest
+}
+
+// writeContents writes the PrevHash, RecNo, Timestamp, Accuracy and
+// Value of record to w.
+func writeContents(w io.Writer, record Record) {
+	var buf [8]byte
+
+	w.Write(record.PrevHash[:])
+
+	binary.BigEndian.PutUint64(buf[:], uint64(record.RecNo))
+	w.Write(buf[:])
+
+	binary.BigEndian.PutUint64(buf[:], uint64(record.Timestamp))
+	w.Write(buf[:])
+
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(record.Accuracy))
+	w.Write(buf[:])
+
+	writeBytes(w, record.Value)
+}
+
+// writeBytes writes the length of data, then data, to w.
+func writeBytes(w io.Writer, data []byte) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(data)))
+	w.Write(buf[:])
+	w.Write(data)
+}
@@ -27,3 +27,73 @@ func TestRecordSerialization(t *testing.T) {
 	assert.Equal(t, record.RecNo, newRecord.RecNo)
 	assert.Equal(t, record.Timestamp, newRecord.Timestamp)
 }
+
+func TestRecordHash(t *testing.T) {
+	record := Record{
+		Metadatum: Metadatum{
+			RecNo:     1,
+			Timestamp: 2,
+			Accuracy:  3.4,
+			PrevHash:  GenerateHash("prev"),
+			Sig:       []byte("sig"),
+		},
+		Value: []byte("value"),
+	}
+	hash := RecordHash(record)
+	assert.Equal(t, hash, RecordHash(record))
+
+	// The stored hash is not part of the contents
+	record.Hash = hash
+	assert.Equal(t, hash, RecordHash(record))
+
+	changes := []func(record *Record){
+		func(record *Record) { record.PrevHash = NullHash },
+		func(record *Record) { record.RecNo++ },
+		func(record *Record) { record.Timestamp++ },
+		func(record *Record) { record.Accuracy = 3.5 },
+		func(record *Record) { record.Value = []byte("other") },
+		func(record *Record) { record.Sig = nil },
+
+		// Bytes moved between Value and Sig
+		func(record *Record) {
+			record.Value = []byte("values")
+			record.Sig = []byte("ig")
+		},
+	}
+	for i, change := range changes {
+		changed := record
+		change(&changed)
+		assert.NotEqual(t, hash, RecordHash(changed), "change %d", i)
+	}
+}
+
+func TestLogMetadataName(t *testing.T) {
+	metadata := LogMetadata{
+		WriterKey: []byte("key"),
+		Created:   1,
+		Params:    map[string]string{"a": "1", "b": "2"},
+	}
+	name := metadata.Name()
+
+	// Params are hashed in key order
+	same := LogMetadata{
+		WriterKey: []byte("key"),
+		Created:   1,
+		Params:    map[string]string{"b": "2", "a": "1"},
+	}
+	assert.Equal(t, name, same.Name())
+
+	changes := []LogMetadata{
+		{WriterKey: []byte("other"), Created: 1, Params: metadata.Params},
+		{WriterKey: []byte("key"), Created: 2, Params: metadata.Params},
+		{WriterKey: []byte("key"), Created: 1, Params: map[string]string{"a": "12"}},
+		{WriterKey: []byte("key"), Created: 1, Params: map[string]string{"a1": "", "b": "2"}},
+	}
+	for i, changed := range changes {
+		assert.NotEqual(t, name, changed.Name(), "change %d", i)
+	}
+
+	key, err := LogMetadata{}.PublicKey()
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+}
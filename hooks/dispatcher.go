@@ -0,0 +1,122 @@
+package hooks
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
+
+// queueSize is the number of events a Dispatcher holds for a slow
+// sink before dropping new ones.
+const queueSize = 256
+
+// Sink delivers events to an application.
+type Sink interface {
+	// Send delivers one event
+	Send(event *Event) error
+
+	// Close releases the resources of the sink
+	Close() error
+}
+
+// Dispatcher adapts a Sink to a loggraph.Hook. Events are delivered in
+// order by a single goroutine so that a slow sink never blocks
+// replication; events arriving while the queue is full are dropped,
+// which the sequence numbers of the events delivered reveal.
+type Dispatcher struct {
+	name   string
+	sink   Sink
+	events chan *Event
+
+	// seq is the sequence number of the last event, and dropped the
+	// number of events dropped since the last one queued
+	seq     uint64
+	dropped uint64
+	mutex   sync.Mutex
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewDispatcher starts delivering events to sink. name identifies the
+// sink in logs.
+func NewDispatcher(name string, sink Sink) *Dispatcher {
+	dispatcher := &Dispatcher{
+		name:   name,
+		sink:   sink,
+		events: make(chan *Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	go dispatcher.deliver()
+	return dispatcher
+}
+
+// Hook queues the event for records persisted from src. Its method
+// value is a loggraph.Hook.
+func (dispatcher *Dispatcher) Hook(src gdp.Hash, records []gdp.Record) {
+	dispatcher.queue(NewEvent(src, records))
+}
+
+// queue numbers event and queues it unless the queue is full.
+func (dispatcher *Dispatcher) queue(event *Event) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+
+	dispatcher.seq++
+	event.Seq = dispatcher.seq
+	event.Dropped = dispatcher.dropped
+	select {
+	case dispatcher.events <- event:
+		dispatcher.dropped = 0
+	default:
+		dispatcher.dropped++
+		zap.S().Warnw(
+			"Dropping hook event, sink is behind",
+			"sink", dispatcher.name,
+			"log", event.Log,
+			"source", event.Source,
+			"numRecords", len(event.Records),
+			"seq", event.Seq,
+		)
+	}
+}
+
+// HookFor returns the loggraph.Hook queueing events for records of
+// log.
+func (dispatcher *Dispatcher) HookFor(log gdp.Hash) loggraph.Hook {
+	return func(src gdp.Hash, records []gdp.Record) {
+		event := NewEvent(src, records)
+		event.Log = hex.EncodeToString(log[:])
+		dispatcher.queue(event)
+	}
+}
+
+// Close delivers the queued events and closes the sink. Hook must not
+// be called after Close.
+func (dispatcher *Dispatcher) Close() error {
+	var err error
+	dispatcher.closeOnce.Do(func() {
+		close(dispatcher.events)
+		<-dispatcher.done
+		err = dispatcher.sink.Close()
+	})
+	return err
+}
+
+func (dispatcher *Dispatcher) deliver() {
+	defer close(dispatcher.done)
+	for event := range dispatcher.events {
+		err := dispatcher.sink.Send(event)
+		if err != nil {
+			zap.S().Errorw(
+				"Failed to deliver hook event",
+				"sink", dispatcher.name,
+				"numRecords", len(event.Records),
+				"error", err,
+			)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package hooks
+
+import (
+	"encoding/hex"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Event reports the records a replica newly persisted. Sinks deliver
+// it as JSON, with hashes in hex and byte strings in base64.
+type Event struct {
+	// Log is the name of the log the records belong to, empty for a
+	// daemon replicating a single log
+	Log string `json:"log,omitempty"`
+
+	// Source is the address of the peer the records came from, empty
+	// for records written locally
+	Source  string   `json:"source,omitempty"`
+	Records []Record `json:"records"`
+
+	// Seq numbers the events of a Dispatcher from 1, dropped events
+	// included, and Dropped counts the events dropped since the last
+	// one queued. A consumer seeing a gap can resync from the log
+	Seq     uint64 `json:"seq,omitempty"`
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Record is the JSON form of a gdp.Record.
+type Record struct {
+	Hash      string  `json:"hash"`
+	RecNo     int     `json:"recno"`
+	Timestamp int64   `json:"timestamp"`
+	Accuracy  float64 `json:"accuracy"`
+	PrevHash  string  `json:"prevhash"`
+	Value     []byte  `json:"value"`
+	Sig       []byte  `json:"sig"`
+}
+
+// NewEvent builds the event for records persisted from src.
+func NewEvent(src gdp.Hash, records []gdp.Record) *Event {
+	event := &Event{Records: make([]Record, 0, len(records))}
+	if src != gdp.NullHash {
+		event.Source = hex.EncodeToString(src[:])
+	}
+
+	for _, record := range records {
+		event.Records = append(event.Records, Record{
+			Hash:      hex.EncodeToString(record.Hash[:]),
+			RecNo:     record.RecNo,
+			Timestamp: record.Timestamp,
+			Accuracy:  record.Accuracy,
+			PrevHash:  hex.EncodeToString(record.PrevHash[:]),
+			Value:     record.Value,
+			Sig:       record.Sig,
+		})
+	}
+	return event
+}
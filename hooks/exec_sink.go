@@ -0,0 +1,60 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// execTimeout bounds each run of the command, which is killed past it.
+const execTimeout = 30 * time.Second
+
+// ExecSink runs a command for every event, with the event as JSON on
+// its standard input. The source and number of records are also set
+// in the GDP_SOURCE and GDP_NUM_RECORDS environment variables.
+type ExecSink struct {
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+// NewExecSink constructs an ExecSink running command with args.
+func NewExecSink(command string, args ...string) *ExecSink {
+	return &ExecSink{command: command, args: args, timeout: execTimeout}
+}
+
+// Send runs the command for event and waits for it to exit, killing it
+// if it runs for too long.
+func (sink *ExecSink) Send(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sink.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, sink.command, sink.args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(
+		os.Environ(),
+		"GDP_SOURCE="+event.Source,
+		"GDP_NUM_RECORDS="+strconv.Itoa(len(event.Records)),
+	)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", sink.command, err, output)
+	}
+	return nil
+}
+
+// Close does nothing; no command outlives Send.
+func (sink *ExecSink) Close() error {
+	return nil
+}
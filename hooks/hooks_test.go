@@ -0,0 +1,223 @@
+package hooks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+var (
+	testSource  = gdp.GenerateHash("peer")
+	testRecords = []gdp.Record{
+		{
+			Metadatum: gdp.Metadatum{
+				Hash:     gdp.GenerateHash("b"),
+				RecNo:    2,
+				PrevHash: gdp.GenerateHash("a"),
+				Sig:      []byte("sig"),
+			},
+			Value: []byte("value"),
+		},
+	}
+)
+
+func checkEvent(t *testing.T, event *Event) {
+	assert.Equal(t, hex.EncodeToString(testSource[:]), event.Source)
+	assert.Equal(t, 1, len(event.Records))
+	assert.Equal(t, 2, event.Records[0].RecNo)
+	assert.Equal(t, hex.EncodeToString(testRecords[0].PrevHash[:]), event.Records[0].PrevHash)
+	assert.Equal(t, []byte("value"), event.Records[0].Value)
+}
+
+func TestNewEventLocal(t *testing.T) {
+	data, err := json.Marshal(NewEvent(gdp.NullHash, testRecords))
+	assert.Nil(t, err)
+
+	fields := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(data, &fields))
+	_, present := fields["source"]
+	assert.False(t, present)
+}
+
+func TestExecSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "event.json")
+
+	sink := NewExecSink("sh", "-c", `cat > "$0"; echo "$GDP_NUM_RECORDS" >> "$0"`, out)
+	dispatcher := NewDispatcher("exec", sink)
+	dispatcher.Hook(testSource, testRecords)
+	assert.Nil(t, dispatcher.Close())
+
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+
+	event := &Event{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	assert.Nil(t, decoder.Decode(event))
+	checkEvent(t, event)
+
+	var numRecords int
+	assert.Nil(t, decoder.Decode(&numRecords))
+	assert.Equal(t, 1, numRecords)
+
+	assert.NotNil(t, NewExecSink("false").Send(event))
+}
+
+func TestWebhookSink(t *testing.T) {
+	events := make(chan *Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			event := &Event{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(event))
+			events <- event
+		},
+	))
+	defer server.Close()
+
+	dispatcher := NewDispatcher("webhook", NewWebhookSink(server.URL))
+	dispatcher.Hook(testSource, testRecords)
+	assert.Nil(t, dispatcher.Close())
+	checkEvent(t, <-events)
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	assert.NotNil(t, NewWebhookSink(failing.URL).Send(NewEvent(testSource, testRecords)))
+}
+
+func TestSocketSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hooks.sock")
+
+	sink, err := NewSocketSink(path)
+	assert.Nil(t, err)
+	dispatcher := NewDispatcher("socket", sink)
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Wait for the sink to accept the client
+	for i := 0; i < 100 && numClients(sink) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dispatcher.Hook(testSource, testRecords)
+	dispatcher.Hook(testSource, testRecords)
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		line, err := reader.ReadBytes('\n')
+		assert.Nil(t, err)
+		event := &Event{}
+		assert.Nil(t, json.Unmarshal(line, event))
+		checkEvent(t, event)
+	}
+
+	assert.Nil(t, dispatcher.Close())
+	_, err = reader.ReadBytes('\n')
+	assert.NotNil(t, err)
+}
+
+func TestSocketSinkSlowClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hooks.sock")
+
+	sink, err := NewSocketSink(path)
+	assert.Nil(t, err)
+	defer sink.Close()
+	sink.timeout = 50 * time.Millisecond
+
+	// The client never reads, so the socket buffers fill up
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	defer conn.Close()
+	for i := 0; i < 100 && numClients(sink) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	event := NewEvent(testSource, testRecords)
+	start := time.Now()
+	for i := 0; i < 10000 && numClients(sink) > 0; i++ {
+		assert.Nil(t, sink.Send(event))
+	}
+	assert.Equal(t, 0, numClients(sink))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func numClients(sink *SocketSink) int {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return len(sink.clients)
+}
+
+func TestExecSinkTimeout(t *testing.T) {
+	sink := NewExecSink("sleep", "10")
+	sink.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	assert.NotNil(t, sink.Send(NewEvent(testSource, testRecords)))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// blockingSink records the events it is sent once released.
+type blockingSink struct {
+	release chan struct{}
+	events  []*Event
+}
+
+func (sink *blockingSink) Send(event *Event) error {
+	<-sink.release
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+func (sink *blockingSink) Close() error {
+	return nil
+}
+
+func TestDispatcherDrops(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	dispatcher := NewDispatcher("blocking", sink)
+
+	// The first event may be held by the sink rather than the queue
+	numEvents := queueSize + 10
+	for i := 0; i < numEvents; i++ {
+		dispatcher.Hook(testSource, testRecords)
+	}
+	close(sink.release)
+	for i := 0; i < 100 && len(dispatcher.events) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dispatcher.Hook(testSource, testRecords)
+	assert.Nil(t, dispatcher.Close())
+
+	// Sequence numbers and drop counts account for every event
+	delivered := sink.events
+	assert.True(t, len(delivered) < numEvents)
+	assert.Equal(t, uint64(1), delivered[0].Seq)
+	for i := 1; i < len(delivered); i++ {
+		gap := delivered[i].Seq - delivered[i-1].Seq - 1
+		assert.Equal(t, gap, delivered[i].Dropped)
+	}
+	last := delivered[len(delivered)-1]
+	assert.Equal(t, uint64(numEvents+1), last.Seq)
+	assert.True(t, last.Dropped > 0)
+}
@@ -0,0 +1,109 @@
+package hooks
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// socketWriteTimeout bounds each write to a client, which is
+// disconnected past it.
+const socketWriteTimeout = time.Second
+
+// SocketSink listens on a Unix socket and streams every event to each
+// connected client as one line of JSON. Clients only receive events
+// sent while they are connected, and those not reading them in time
+// are disconnected.
+type SocketSink struct {
+	listener net.Listener
+	path     string
+	timeout  time.Duration
+
+	clients map[net.Conn]bool
+	mutex   sync.Mutex
+}
+
+// NewSocketSink listens on the Unix socket at path, replacing a stale
+// socket file.
+func NewSocketSink(path string) (*SocketSink, error) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &SocketSink{
+		listener: listener,
+		path:     path,
+		timeout:  socketWriteTimeout,
+		clients:  make(map[net.Conn]bool),
+	}
+	go sink.accept()
+	return sink, nil
+}
+
+func (sink *SocketSink) accept() {
+	for {
+		conn, err := sink.listener.Accept()
+		if err != nil {
+			// The listener is closed
+			return
+		}
+
+		sink.mutex.Lock()
+		sink.clients[conn] = true
+		sink.mutex.Unlock()
+	}
+}
+
+// Send writes event to every client, disconnecting those that fail or
+// do not take it in time.
+func (sink *SocketSink) Send(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	for conn := range sink.clients {
+		err = conn.SetWriteDeadline(time.Now().Add(sink.timeout))
+		if err == nil {
+			_, err = conn.Write(data)
+		}
+		if err != nil {
+			zap.S().Infow(
+				"Disconnecting hook socket client",
+				"path", sink.path,
+				"error", err,
+			)
+			conn.Close()
+			delete(sink.clients, conn)
+		}
+	}
+	return nil
+}
+
+// Close stops listening and disconnects every client.
+func (sink *SocketSink) Close() error {
+	err := sink.listener.Close()
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	for conn := range sink.clients {
+		conn.Close()
+		delete(sink.clients, conn)
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds each delivery to a webhook.
+const webhookTimeout = 5 * time.Second
+
+// WebhookSink POSTs every event as JSON to a URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink constructs a WebhookSink posting to url.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Send posts event and fails unless the webhook answers with a 2xx
+// status.
+func (sink *WebhookSink) Send(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered %s", sink.url, resp.Status)
+	}
+	return nil
+}
+
+// Close releases idle connections to the webhook.
+func (sink *WebhookSink) Close() error {
+	if transport, ok := sink.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
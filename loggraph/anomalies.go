@@ -0,0 +1,103 @@
+package loggraph
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Hole is a record missing from a graph, neither received nor
+// deleted, which other records follow.
+type Hole struct {
+	// Missing is the hash of the missing record
+	Missing gdp.Hash
+
+	// After are the components following Missing, several if the log
+	// branches right after the hole
+	After []ComponentSummary
+
+	// Before is the component the missing record most likely extends:
+	// the one with the latest end numbered below the records after the
+	// hole, or nil if there is none
+	Before *ComponentSummary
+
+	// Gap estimates from RecNo how many records are missing, at least
+	// the missing record itself
+	Gap int
+}
+
+// Branch is a record followed by several records, which compete to
+// continue the log, e.g. after two writers appended to it at once.
+type Branch struct {
+	// Parent is the record the children follow. It may be missing from
+	// the graph, after a hole, or deleted.
+	Parent gdp.Hash
+
+	Children []gdp.Hash
+}
+
+// holes returns the holes of the graph. Records following name, the
+// name of the log, start the log rather than follow a hole.
+func (state *graphState) holes(name gdp.Hash) []Hole {
+	components := state.GetComponents()
+
+	after := make(map[gdp.Hash][]ComponentSummary)
+	order := make([]gdp.Hash, 0)
+	for _, component := range components {
+		missing := component.Follows
+		if missing == gdp.NullHash || missing == name || state.pruned.contains(missing) {
+			continue
+		}
+		if _, present := after[missing]; !present {
+			order = append(order, missing)
+		}
+		after[missing] = append(after[missing], component)
+	}
+
+	holes := make([]Hole, 0, len(order))
+	for _, missing := range order {
+		hole := Hole{Missing: missing, After: after[missing]}
+
+		// The missing record is numbered just below its children
+		recNo := hole.After[0].FirstRecNo
+		for _, component := range hole.After[1:] {
+			if component.FirstRecNo < recNo {
+				recNo = component.FirstRecNo
+			}
+		}
+
+		// Records are numbered from 1 after the metadata record
+		lastBefore := 0
+		for i := range components {
+			if components[i].Follows == missing {
+				continue
+			}
+			for _, end := range components[i].Ends {
+				endRecNo := state.recNo(end)
+				if endRecNo < recNo && (hole.Before == nil || endRecNo > lastBefore) {
+					hole.Before = &components[i]
+					lastBefore = endRecNo
+				}
+			}
+		}
+
+		hole.Gap = recNo - lastBefore - 1
+		if hole.Gap < 1 {
+			hole.Gap = 1
+		}
+		holes = append(holes, hole)
+	}
+	return holes
+}
+
+// GetBranches returns the records with more than one child.
+func (state *graphState) GetBranches() []Branch {
+	branches := make([]Branch, 0)
+	state.forward.each(func(parent gdp.Hash, children interface{}) {
+		if hashes := children.([]gdp.Hash); len(hashes) > 1 {
+			branches = append(branches, Branch{
+				Parent:   parent,
+				Children: append([]gdp.Hash{}, hashes...),
+			})
+		}
+	})
+	return branches
+}
@@ -0,0 +1,108 @@
+package loggraph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+func TestGetHoles(t *testing.T) {
+	graph, h := traversalGraph(t)
+
+	holes := graph.GetHoles()
+	assert.Equal(t, 1, len(holes))
+	hole := holes[0]
+	assert.Equal(t, h["hole"], hole.Missing)
+	assert.Equal(t, 1, len(hole.After))
+	assert.Equal(t, h["c10"], hole.After[0].Begin)
+	assert.Equal(t, h["a0"], hole.Before.Begin)
+
+	// a5 to a9 and the missing record are not in the graph
+	assert.Equal(t, 5, hole.Gap)
+
+	// Two records competing after the same hole make one hole
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{{
+		Metadatum: gdp.Metadatum{
+			Hash:     gdp.GenerateHash("d10"),
+			RecNo:    10,
+			PrevHash: h["hole"],
+		},
+	}}))
+	holes = graph.GetHoles()
+	assert.Equal(t, 1, len(holes))
+	assert.Equal(t, 2, len(holes[0].After))
+	assert.Equal(t, 5, holes[0].Gap)
+
+	// Deleted records leave no hole
+	clone, err := graph.CreateClone()
+	assert.Nil(t, err)
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{{Hash: h["a0"]}}))
+	assert.Equal(t, 1, len(graph.GetHoles()))
+	assert.Equal(t, holes, clone.GetHoles())
+}
+
+func TestGetHolesWithoutRecNo(t *testing.T) {
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+
+	// Records numbered 0, as the benchmark writer does, give no
+	// estimate of the gap or of the component before
+	a := gdp.Record{Metadatum: gdp.Metadatum{Hash: gdp.GenerateHash("a")}}
+	b := gdp.Record{Metadatum: gdp.Metadatum{
+		Hash:     gdp.GenerateHash("b"),
+		PrevHash: gdp.GenerateHash("hole"),
+	}}
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{a, b}))
+
+	holes := graph.GetHoles()
+	assert.Equal(t, 1, len(holes))
+	assert.Nil(t, holes[0].Before)
+	assert.Equal(t, 1, holes[0].Gap)
+}
+
+func TestGetHolesAtLogStart(t *testing.T) {
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+
+	metadata := gdp.LogMetadata{Created: 1}
+	first := gdp.Record{Metadatum: gdp.Metadatum{
+		Hash:     gdp.GenerateHash("first"),
+		RecNo:    1,
+		PrevHash: metadata.Name(),
+	}}
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{first}))
+
+	// Until the metadata record is known, the log may not start there
+	assert.Equal(t, 1, len(graph.GetHoles()))
+	assert.Equal(t, 1, graph.GetHoles()[0].Gap)
+
+	assert.Nil(t, graph.WriteLogMetadata(metadata))
+	assert.Equal(t, []Hole{}, graph.GetHoles())
+}
+
+func TestGetBranches(t *testing.T) {
+	graph, h := traversalGraph(t)
+	assert.Equal(t, []Branch{{
+		Parent:   h["a2"],
+		Children: []gdp.Hash{h["a3"], h["b3"]},
+	}}, graph.GetBranches())
+
+	// Branches after a hole have a missing parent
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{{
+		Metadatum: gdp.Metadatum{
+			Hash:     gdp.GenerateHash("d10"),
+			RecNo:    10,
+			PrevHash: h["hole"],
+		},
+	}}))
+	branches := make(map[gdp.Hash][]gdp.Hash)
+	for _, branch := range graph.GetBranches() {
+		branches[branch.Parent] = branch.Children
+	}
+	assert.Equal(t, map[gdp.Hash][]gdp.Hash{
+		h["a2"]:   {h["a3"], h["b3"]},
+		h["hole"]: {h["c10"], gdp.GenerateHash("d10")},
+	}, branches)
+}
@@ -0,0 +1,222 @@
+package loggraph
+
+import (
+	"math/bits"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// hashTrie is a persistent map from hashes to values: updates return a
+// new trie sharing all unchanged nodes with the old one, which stays
+// valid. Updates and lookups take time logarithmic in the size of the
+// trie, and copying a trie is free.
+//
+// Keys are SHA-256 hashes, so their bits are already uniform and index
+// the trie directly, trieBits at a time.
+type hashTrie struct {
+	root *trieNode
+	size int
+}
+
+const (
+	trieBits   = 4
+	trieFanout = 1 << trieBits
+	trieDepth  = len(gdp.NullHash) * 8 / trieBits
+)
+
+// trieNode holds the children present among the trieFanout slots of
+// one level, in slot order. A child is a *trieNode or a *trieLeaf.
+type trieNode struct {
+	bitmap   uint16
+	children []interface{}
+}
+
+type trieLeaf struct {
+	key   gdp.Hash
+	value interface{}
+}
+
+// slot returns the slot of key at depth.
+func slot(key gdp.Hash, depth int) uint {
+	b := key[depth*trieBits/8]
+	if depth%2 == 0 {
+		return uint(b >> 4)
+	}
+	return uint(b & 0xF)
+}
+
+// position returns the index in children of the child in slot, and
+// whether it is present.
+func (node *trieNode) position(slot uint) (int, bool) {
+	bit := uint16(1) << slot
+	return bits.OnesCount16(node.bitmap & (bit - 1)), node.bitmap&bit != 0
+}
+
+func (trie hashTrie) len() int {
+	return trie.size
+}
+
+// get returns the value of key.
+func (trie hashTrie) get(key gdp.Hash) (interface{}, bool) {
+	node := trie.root
+	for depth := 0; node != nil && depth < trieDepth; depth++ {
+		i, present := node.position(slot(key, depth))
+		if !present {
+			return nil, false
+		}
+		switch child := node.children[i].(type) {
+		case *trieLeaf:
+			if child.key == key {
+				return child.value, true
+			}
+			return nil, false
+		case *trieNode:
+			node = child
+		}
+	}
+	return nil, false
+}
+
+// contains reports whether key has a value.
+func (trie hashTrie) contains(key gdp.Hash) bool {
+	_, present := trie.get(key)
+	return present
+}
+
+// set returns a trie in which key has value.
+func (trie hashTrie) set(key gdp.Hash, value interface{}) hashTrie {
+	root := trie.root
+	if root == nil {
+		root = &trieNode{}
+	}
+	newRoot, added := root.set(&trieLeaf{key, value}, 0)
+	if added {
+		trie.size++
+	}
+	trie.root = newRoot
+	return trie
+}
+
+// set returns a copy of node in which leaf is stored, and whether its
+// key is new.
+func (node *trieNode) set(leaf *trieLeaf, depth int) (*trieNode, bool) {
+	s := slot(leaf.key, depth)
+	i, present := node.position(s)
+	copied := &trieNode{bitmap: node.bitmap}
+
+	if !present {
+		copied.bitmap |= 1 << s
+		copied.children = make([]interface{}, 0, len(node.children)+1)
+		copied.children = append(copied.children, node.children[:i]...)
+		copied.children = append(copied.children, leaf)
+		copied.children = append(copied.children, node.children[i:]...)
+		return copied, true
+	}
+
+	copied.children = append([]interface{}{}, node.children...)
+	added := false
+	switch child := node.children[i].(type) {
+	case *trieLeaf:
+		if child.key == leaf.key {
+			copied.children[i] = leaf
+		} else {
+			// Both leaves move down a level
+			pair, _ := (&trieNode{}).set(child, depth+1)
+			pair, _ = pair.set(leaf, depth+1)
+			copied.children[i] = pair
+			added = true
+		}
+	case *trieNode:
+		copied.children[i], added = child.set(leaf, depth+1)
+	}
+	return copied, added
+}
+
+// delete returns a trie without key.
+func (trie hashTrie) delete(key gdp.Hash) hashTrie {
+	if trie.root == nil {
+		return trie
+	}
+	newRoot, removed := trie.root.delete(key, 0)
+	if !removed {
+		return trie
+	}
+	trie.size--
+
+	switch root := newRoot.(type) {
+	case *trieNode:
+		trie.root = root
+	case *trieLeaf:
+		trie.root = &trieNode{
+			bitmap:   1 << slot(root.key, 0),
+			children: []interface{}{root},
+		}
+	default:
+		trie.root = nil
+	}
+	return trie
+}
+
+// delete returns a copy of node without key, and whether key was
+// present. A node left with a single leaf is replaced by the leaf, and
+// an empty node by nil, so that the trie stays as shallow as possible.
+func (node *trieNode) delete(key gdp.Hash, depth int) (interface{}, bool) {
+	s := slot(key, depth)
+	i, present := node.position(s)
+	if !present {
+		return node, false
+	}
+
+	var replacement interface{}
+	switch child := node.children[i].(type) {
+	case *trieLeaf:
+		if child.key != key {
+			return node, false
+		}
+	case *trieNode:
+		var removed bool
+		replacement, removed = child.delete(key, depth+1)
+		if !removed {
+			return node, false
+		}
+	}
+
+	copied := &trieNode{bitmap: node.bitmap}
+	if replacement == nil {
+		copied.bitmap &^= 1 << s
+		copied.children = make([]interface{}, 0, len(node.children)-1)
+		copied.children = append(copied.children, node.children[:i]...)
+		copied.children = append(copied.children, node.children[i+1:]...)
+	} else {
+		copied.children = append([]interface{}{}, node.children...)
+		copied.children[i] = replacement
+	}
+
+	switch len(copied.children) {
+	case 0:
+		return nil, true
+	case 1:
+		if leaf, ok := copied.children[0].(*trieLeaf); ok {
+			return leaf, true
+		}
+	}
+	return copied, true
+}
+
+// each calls fn with every key and value of the trie.
+func (trie hashTrie) each(fn func(key gdp.Hash, value interface{})) {
+	if trie.root != nil {
+		trie.root.each(fn)
+	}
+}
+
+func (node *trieNode) each(fn func(key gdp.Hash, value interface{})) {
+	for _, child := range node.children {
+		switch child := child.(type) {
+		case *trieLeaf:
+			fn(child.key, child.value)
+		case *trieNode:
+			child.each(fn)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package loggraph
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// trieContents returns the keys and values of trie as a map.
+func trieContents(trie hashTrie) map[gdp.Hash]interface{} {
+	contents := make(map[gdp.Hash]interface{})
+	trie.each(func(key gdp.Hash, value interface{}) {
+		contents[key] = value
+	})
+	return contents
+}
+
+func TestHashTrie(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	keys := make([]gdp.Hash, 0, 500)
+	for i := 0; i < 500; i++ {
+		keys = append(keys, gdp.GenerateHash(fmt.Sprint(i)))
+	}
+
+	// Keys sharing a long prefix sit deep in the trie
+	deep := gdp.GenerateHash("deep")
+	deeper := deep
+	deeper[31] ^= 1
+	keys = append(keys, deep, deeper)
+
+	trie := hashTrie{}
+	expected := make(map[gdp.Hash]interface{})
+	versions := []hashTrie{}
+	snapshots := []map[gdp.Hash]interface{}{}
+	for step := 0; step < 5000; step++ {
+		key := keys[rng.Intn(len(keys))]
+		if rng.Intn(3) == 0 {
+			trie = trie.delete(key)
+			delete(expected, key)
+		} else {
+			trie = trie.set(key, step)
+			expected[key] = step
+		}
+
+		if step%500 == 0 {
+			versions = append(versions, trie)
+			snapshot := make(map[gdp.Hash]interface{})
+			for key, value := range expected {
+				snapshot[key] = value
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	assert.Equal(t, len(expected), trie.len())
+	assert.Equal(t, expected, trieContents(trie))
+	for _, key := range keys {
+		value, present := trie.get(key)
+		expectedValue, expectedPresent := expected[key]
+		assert.Equal(t, expectedPresent, present)
+		assert.Equal(t, expectedValue, value)
+	}
+
+	// Earlier versions are left unchanged by later updates
+	for i, version := range versions {
+		assert.Equal(t, len(snapshots[i]), version.len())
+		assert.Equal(t, snapshots[i], trieContents(version))
+	}
+
+	// Deleting every key empties the trie
+	for _, key := range keys {
+		trie = trie.delete(key)
+	}
+	assert.Equal(t, 0, trie.len())
+	assert.False(t, trie.contains(deep))
+}
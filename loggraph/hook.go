@@ -0,0 +1,11 @@
+package loggraph
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Hook is called with the records a write newly persisted, in the
+// order they were written, and the peer they came from. src is
+// gdp.NullHash for records written locally. Hooks run on the write
+// path of replication and must not block.
+type Hook func(src gdp.Hash, records []gdp.Record)
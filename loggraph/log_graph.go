@@ -1,12 +1,104 @@
 package loggraph
 
 import (
+	"crypto"
+
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
 )
 
 // LogGraph provides an abstracted view of records in the database.
 // Users of LogGraph should not have to interface with LogServer.
+//
+// The methods of LogGraphClone describe the latest state of the graph.
+//
+// Implementations are safe for concurrent use, as conversations with
+// several peers share one graph. Each write is atomic: reads and clones
+// see the graph either before or after it, never in between. Writes are
+// applied one at a time, each calling the hooks before the next starts,
+// so hooks must not write to the graph themselves.
 type LogGraph interface {
+	LogGraphClone
+
+	// The pruned map maps each deleted record to its PrevHash
+	GetPrunedMap() map[gdp.Hash]gdp.Hash
+
+	// WriteRecords writes new records to the log server
+	WriteRecords(records []gdp.Record) error
+
+	// WriteRecordsFrom writes new records received from peer src to
+	// the log server, rejecting those whose hash is not
+	// gdp.RecordHash of their contents and quarantining those not
+	// signed by the writer key, if one is set
+	WriteRecordsFrom(src gdp.Hash, records []gdp.Record) error
+
+	// SetWriterKey sets the ed25519 or ECDSA P-256 public key of the
+	// writer of the log, which records from peers must be signed with
+	SetWriterKey(key crypto.PublicKey)
+
+	// GetRejectedCounts returns the number of records from each peer
+	// rejected because their hash did not match their contents
+	GetRejectedCounts() map[gdp.Hash]int
+
+	// AddPeerTombstones keeps the tombstones received from peer for
+	// records the graph holds, whether or not they were applied
+	AddPeerTombstones(peer gdp.Hash, tombstones []gdp.Tombstone)
+
+	// GetPeerPruned returns the records held that peer deleted, as
+	// told by its tombstones, which must not be sent back to it
+	GetPeerPruned(peer gdp.Hash) map[gdp.Hash]bool
+
+	// Refresh adds the records written to the log server by others
+	// since the last refresh and returns how many were added
+	Refresh() (int, error)
+
+	// AddHook registers a hook called with the records each write
+	// newly persisted
+	AddHook(hook Hook)
+
+	// WriteTombstones deletes records from the log server; they are
+	// never written again
+	WriteTombstones(tombstones []gdp.Tombstone) error
+
+	// Prune deletes the records retention does not keep and returns
+	// their tombstones
+	Prune(retention logserver.Retention) ([]gdp.Tombstone, error)
+
+	// GetExpired returns the tombstones of the records retention does
+	// not keep, without deleting them
+	GetExpired(retention logserver.Retention) ([]gdp.Tombstone, error)
+
+	// WriteLogMetadata writes the metadata record of the log, which
+	// sets the writer key unless one is set
+	WriteLogMetadata(metadata gdp.LogMetadata) error
+
+	// GetLogMetadata returns the metadata record of the log, or nil
+	// if it is not known yet
+	GetLogMetadata() *gdp.LogMetadata
+
+	// GetLogName returns the name of the log derived from its
+	// metadata record, or gdp.NullHash if it is not known yet
+	GetLogName() gdp.Hash
+
+	// IsRooted reports whether the connected component holding hash
+	// starts at the metadata record of the log, telling the logical
+	// begins that are origins apart from those after a hole
+	IsRooted(hash gdp.Hash) bool
+
+	// ReadRecords returns records with hashes
+	ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error)
+
+	// CreateClone creates a static read only version of the graph. It
+	// costs next to nothing, and later writes do not change it
+	CreateClone() (LogGraphClone, error)
+}
+
+// LogGraphClone provides a static view of the state of a LogGraph at one time.
+//
+// The maps returned must not be modified. Building them takes time
+// linear in the size of the graph, so traversals should use HasNode,
+// GetPrev and GetNext instead, which take logarithmic time.
+type LogGraphClone interface {
 
 	// Node map is a map with keys as all nodes found
 	GetNodeMap() map[gdp.Hash]bool
@@ -24,23 +116,57 @@ type LogGraph interface {
 
 	// Nodes that have dangling entries in the actual map
 	// E.g. [X] <- D but there is no entry for X in the actual map; D has a dangling entry
+	// If X is in the pruned map, D follows a pruned prefix rather than a hole
 	GetLogicalBegins() []gdp.Hash
 
-	// WriteRecords writes new records to the log server
-	WriteRecords(records []gdp.Record) error
+	// HasNode reports whether hash is a node
+	HasNode(hash gdp.Hash) bool
 
-	// ReadRecords returns records with hashes
-	ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error)
+	// GetPrev returns the entry of hash in the actual pointer map
+	GetPrev(hash gdp.Hash) (gdp.Hash, bool)
 
-	// CreateClone creates a static read only version of the graph
-	CreateClone() (*SimpleGraphClone, error)
-}
+	// GetNext returns the entry of hash in the logical pointer map
+	GetNext(hash gdp.Hash) []gdp.Hash
 
-// LogGraphClone provides a static view of the state of a LogGraph at one time
-type LogGraphClone interface {
-	GetNodeMap() map[gdp.Hash]bool
-	GetActualPtrMap() map[gdp.Hash]gdp.Hash
-	GetLogicalPtrMap() map[gdp.Hash][]gdp.Hash
-	GetLogicalEnds() []gdp.Hash
-	GetLogicalBegins() []gdp.Hash
+	// NumNodes returns the number of nodes
+	NumNodes() int
+
+	// WalkAncestors calls fn with each node hash descends from, nearest
+	// first, until fn returns false
+	WalkAncestors(hash gdp.Hash, fn func(hash gdp.Hash) bool)
+
+	// WalkDescendants calls fn with each node descending from hash,
+	// breadth first, not going past the nodes for which fn returns false
+	WalkDescendants(hash gdp.Hash, fn func(hash gdp.Hash) bool)
+
+	// GetAncestors returns up to limit nodes hash descends from, nearest
+	// first; a limit of 0 returns all of them
+	GetAncestors(hash gdp.Hash, limit int) []gdp.Hash
+
+	// GetDescendants returns up to limit nodes descending from hash,
+	// nearest first; a limit of 0 returns all of them
+	GetDescendants(hash gdp.Hash, limit int) []gdp.Hash
+
+	// GetPath returns the nodes from ancestor to descendant, both
+	// included, oldest first, and whether descendant descends from
+	// ancestor
+	GetPath(ancestor gdp.Hash, descendant gdp.Hash) ([]gdp.Hash, bool)
+
+	// GetComponent returns the nodes of the connected component holding
+	// hash, each after its PrevHash
+	GetComponent(hash gdp.Hash) []gdp.Hash
+
+	// WalkTopological calls fn with every node, each after its PrevHash,
+	// until fn returns false
+	WalkTopological(fn func(hash gdp.Hash) bool)
+
+	// GetComponents returns a summary of each connected component
+	GetComponents() []ComponentSummary
+
+	// GetHoles returns the records missing from the graph, neither
+	// received nor deleted, that other nodes follow
+	GetHoles() []Hole
+
+	// GetBranches returns the records followed by more than one node
+	GetBranches() []Branch
 }
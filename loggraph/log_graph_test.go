@@ -1,12 +1,20 @@
 package loggraph
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/logserver"
 )
 
@@ -22,12 +30,12 @@ func TestSimpleGraph(t *testing.T) {
 
 	assert.Equal(t, 3, len(graph.GetLogicalEnds()))
 	assert.Equal(t, 2, len(graph.GetLogicalBegins()))
-	assert.Equal(t, 5, len(graph.nodeMap))
-	assert.Equal(t, 5, len(graph.backwardEdges))
-	assert.Equal(t, 4, len(graph.forwardEdges))
+	assert.Equal(t, 5, len(graph.GetNodeMap()))
+	assert.Equal(t, 5, len(graph.GetActualPtrMap()))
+	assert.Equal(t, 4, len(graph.GetLogicalPtrMap()))
 
 	fmt.Println("forward edges")
-	for k, vs := range graph.forwardEdges {
+	for k, vs := range graph.GetLogicalPtrMap() {
 		fmt.Printf("%s->\n", k.Readable())
 		for _, v := range vs {
 			fmt.Printf("\t%s\n", v.Readable())
@@ -35,24 +43,686 @@ func TestSimpleGraph(t *testing.T) {
 
 	}
 	fmt.Println("backward edges")
-	for k, v := range graph.backwardEdges {
+	for k, v := range graph.GetActualPtrMap() {
 		fmt.Printf("%s<-%s\n", v.Readable(), k.Readable())
 	}
 
 	fmt.Println("nodes")
-	for v, _ := range graph.nodeMap {
+	for v, _ := range graph.GetNodeMap() {
 		fmt.Println(v.Readable())
 	}
 
 	fmt.Println("logical starts")
-	for _, vs := range graph.logicalStarts {
-		for _, v := range vs {
-			fmt.Println(v.Readable())
-		}
+	for _, v := range graph.GetLogicalBegins() {
+		fmt.Println(v.Readable())
 	}
 
 	fmt.Println("logical ends")
-	for v, _ := range graph.logicalEnds {
+	for _, v := range graph.GetLogicalEnds() {
 		fmt.Println(v.Readable())
 	}
 }
+
+func TestSimpleGraphFromStream(t *testing.T) {
+	// A chain spanning several stream batches, written out of order,
+	// and a second chain after a hole
+	numRecords := 3*logserver.StreamBatchSize + 1
+	records := make([]gdp.Record, 0, numRecords+2)
+	prev := gdp.NullHash
+	for i := 0; i < numRecords; i++ {
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{Hash: hash, RecNo: i, PrevHash: prev},
+		})
+		prev = hash
+	}
+	for i, j := 0, len(records)-1; i < j; i, j = i+2, j-2 {
+		records[i], records[j] = records[j], records[i]
+	}
+	records = append(records,
+		gdp.Record{Metadatum: gdp.Metadatum{
+			Hash:     gdp.GenerateHash("after hole"),
+			PrevHash: gdp.GenerateHash("hole"),
+		}},
+	)
+
+	logServer := logserver.NewMemoryServer()
+	assert.Nil(t, logServer.WriteRecords(records))
+
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+	assert.Equal(t, numRecords+1, len(graph.GetNodeMap()))
+	assert.ElementsMatch(
+		t,
+		[]gdp.Hash{gdp.GenerateHash("0"), gdp.GenerateHash("after hole")},
+		graph.GetLogicalBegins(),
+	)
+	assert.ElementsMatch(
+		t,
+		[]gdp.Hash{prev, gdp.GenerateHash("after hole")},
+		graph.GetLogicalEnds(),
+	)
+}
+
+func TestSimpleGraphHooks(t *testing.T) {
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+
+	var sources []gdp.Hash
+	var persisted [][]gdp.Record
+	graph.AddHook(func(src gdp.Hash, records []gdp.Record) {
+		sources = append(sources, src)
+		persisted = append(persisted, records)
+	})
+
+	a := gdp.Record{Value: []byte("a")}
+	a.Hash = gdp.RecordHash(a)
+	b := gdp.Record{Value: []byte("b")}
+	b.Hash = gdp.RecordHash(b)
+	peer := gdp.GenerateHash("peer")
+
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{a}))
+	assert.Nil(t, graph.WriteRecordsFrom(peer, []gdp.Record{a, b, b}))
+
+	// Writes persisting nothing new are not reported
+	assert.Nil(t, graph.WriteRecordsFrom(peer, []gdp.Record{a, b}))
+
+	assert.Equal(t, []gdp.Hash{gdp.NullHash, peer}, sources)
+	assert.Equal(t, [][]gdp.Record{{a}, {b}}, persisted)
+}
+
+func TestSimpleGraphPrune(t *testing.T) {
+	records := make([]gdp.Record, 0, 5)
+	prev := gdp.NullHash
+	for i := 0; i < 5; i++ {
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{Hash: hash, RecNo: i, PrevHash: prev},
+		})
+		prev = hash
+	}
+
+	logServer := logserver.NewMemoryServer()
+	assert.Nil(t, logServer.WriteRecords(records))
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+
+	// Prune the oldest two records and the newest one
+	tombstones, err := graph.Prune(logserver.Retention{MaxRecords: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tombstones))
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{
+		{Hash: records[4].Hash, PrevHash: records[3].Hash},
+	}))
+
+	assert.Equal(t, 2, len(graph.GetNodeMap()))
+	assert.Equal(t, 3, len(graph.GetPrunedMap()))
+	assert.Equal(t, []gdp.Hash{records[2].Hash}, graph.GetLogicalBegins())
+	assert.Equal(t, []gdp.Hash{records[3].Hash}, graph.GetLogicalEnds())
+	assert.Equal(t, records[0].Hash, graph.GetPrunedMap()[records[1].Hash])
+
+	// Pruned records are not written again
+	assert.Nil(t, graph.WriteRecords(records))
+	assert.Equal(t, 2, len(graph.GetNodeMap()))
+
+	// A graph built from the log server agrees
+	rebuilt, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+	assert.Equal(t, graph.GetNodeMap(), rebuilt.GetNodeMap())
+	assert.Equal(t, graph.GetPrunedMap(), rebuilt.GetPrunedMap())
+	assert.Equal(t, graph.GetLogicalBegins(), rebuilt.GetLogicalBegins())
+	assert.Equal(t, graph.GetLogicalEnds(), rebuilt.GetLogicalEnds())
+}
+
+func TestSimpleGraphRejectsWrongHashes(t *testing.T) {
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+
+	good := gdp.Record{
+		Metadatum: gdp.Metadatum{Sig: []byte{}},
+		Value:     []byte("good"),
+	}
+	good.Hash = gdp.RecordHash(good)
+	forged := gdp.Record{Value: []byte("forged")}
+	forged.Hash = good.Hash
+	forged.RecNo = 1
+	unhashed := gdp.Record{
+		Metadatum: gdp.Metadatum{Hash: gdp.GenerateHash("unhashed")},
+	}
+
+	peer := gdp.GenerateHash("peer")
+	other := gdp.GenerateHash("other")
+	assert.Nil(t, graph.WriteRecordsFrom(peer, []gdp.Record{forged, unhashed}))
+	assert.Nil(t, graph.WriteRecordsFrom(other, []gdp.Record{good}))
+
+	records, err := graph.ReadRecords([]gdp.Hash{good.Hash})
+	assert.Nil(t, err)
+	assert.Equal(t, []gdp.Record{good}, records)
+	assert.Equal(t, 1, len(graph.GetNodeMap()))
+	assert.Equal(t, map[gdp.Hash]int{peer: 2}, graph.GetRejectedCounts())
+
+	// Records written locally are not checked
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{unhashed}))
+	assert.Equal(t, 2, len(graph.GetNodeMap()))
+}
+
+func TestSimpleGraphQuarantinesBadSignatures(t *testing.T) {
+	logServer := logserver.NewMemoryServer()
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+
+	writerKey, writer, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	_, impostor, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	graph.SetWriterKey(writerKey)
+
+	signed := gdp.Record{Value: []byte("signed")}
+	assert.Nil(t, gdp.SignRecord(writer, &signed))
+	forged := gdp.Record{Value: []byte("forged")}
+	assert.Nil(t, gdp.SignRecord(impostor, &forged))
+	unsigned := gdp.Record{Value: []byte("unsigned")}
+	unsigned.Hash = gdp.RecordHash(unsigned)
+
+	peer := gdp.GenerateHash("peer")
+	assert.Nil(t, graph.WriteRecordsFrom(peer, []gdp.Record{signed, forged, unsigned}))
+	assert.Equal(t, map[gdp.Hash]bool{signed.Hash: true}, graph.GetNodeMap())
+
+	quarantined, err := logServer.ReadQuarantine()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(quarantined))
+	reasons := make(map[gdp.Hash]string)
+	for _, record := range quarantined {
+		assert.Equal(t, peer, record.Source)
+		reasons[record.Hash] = record.Reason
+	}
+	assert.Equal(t, gdp.ErrBadSignature.Error(), reasons[forged.Hash])
+	assert.Equal(t, gdp.ErrUnsigned.Error(), reasons[unsigned.Hash])
+
+	// Records written locally are not checked
+	assert.Nil(t, graph.WriteRecords([]gdp.Record{unsigned}))
+	assert.Equal(t, 2, len(graph.GetNodeMap()))
+}
+
+func TestSimpleGraphPeerTombstones(t *testing.T) {
+	records := chainedRecords(3)
+
+	logServer := logserver.NewMemoryServer()
+	assert.Nil(t, logServer.WriteRecords(records[:2]))
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+
+	// Only the tombstones of records held are kept
+	peer := gdp.GenerateHash("peer")
+	graph.AddPeerTombstones(peer, []gdp.Tombstone{
+		{Hash: records[0].Hash},
+		{Hash: records[2].Hash, PrevHash: records[1].Hash},
+	})
+	assert.Equal(t, map[gdp.Hash]bool{records[0].Hash: true}, graph.GetPeerPruned(peer))
+	assert.Equal(t, 0, len(graph.GetPeerPruned(gdp.GenerateHash("other"))))
+
+	// Records deleted here are no longer tracked
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{{Hash: records[0].Hash}}))
+	assert.Equal(t, 0, len(graph.GetPeerPruned(peer)))
+}
+
+func TestSimpleGraphRooted(t *testing.T) {
+	writerKey, writer, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(writerKey)
+	assert.Nil(t, err)
+	metadata := gdp.LogMetadata{WriterKey: der, Created: 1}
+
+	// Two records after the metadata record, and one after a hole
+	records := make([]gdp.Record, 0, 3)
+	prev := metadata.Name()
+	for i := 1; i <= 2; i++ {
+		record := gdp.Record{Metadatum: gdp.Metadatum{RecNo: i, PrevHash: prev}}
+		assert.Nil(t, gdp.SignRecord(writer, &record))
+		records = append(records, record)
+		prev = record.Hash
+	}
+	afterHole := gdp.Record{Metadatum: gdp.Metadatum{RecNo: 4, PrevHash: gdp.GenerateHash("hole")}}
+	assert.Nil(t, gdp.SignRecord(writer, &afterHole))
+	records = append(records, afterHole)
+
+	logServer := logserver.NewMemoryServer()
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+	assert.Nil(t, graph.WriteRecords(records))
+
+	// The root is unknown without the metadata record
+	assert.Equal(t, gdp.NullHash, graph.GetLogName())
+	assert.False(t, graph.IsRooted(records[1].Hash))
+
+	assert.Nil(t, graph.WriteLogMetadata(metadata))
+	assert.Equal(t, metadata.Name(), graph.GetLogName())
+	assert.True(t, graph.IsRooted(records[0].Hash))
+	assert.True(t, graph.IsRooted(records[1].Hash))
+	assert.False(t, graph.IsRooted(afterHole.Hash))
+	assert.False(t, graph.IsRooted(gdp.GenerateHash("missing")))
+
+	// The component stays rooted through a pruned prefix
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{
+		{Hash: records[0].Hash, PrevHash: records[0].PrevHash},
+	}))
+	assert.True(t, graph.IsRooted(records[1].Hash))
+
+	// The metadata record is loaded with the graph, and names the
+	// writer key records from peers are verified with
+	rebuilt, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+	assert.Equal(t, metadata.Name(), rebuilt.GetLogName())
+	assert.True(t, rebuilt.IsRooted(records[1].Hash))
+
+	unsigned := gdp.Record{Metadatum: gdp.Metadatum{RecNo: 3, PrevHash: records[1].Hash}}
+	unsigned.Hash = gdp.RecordHash(unsigned)
+	assert.Nil(t, rebuilt.WriteRecordsFrom(gdp.GenerateHash("peer"), []gdp.Record{unsigned}))
+	assert.False(t, rebuilt.GetNodeMap()[unsigned.Hash])
+
+	// A log has one metadata record
+	err = rebuilt.WriteLogMetadata(gdp.LogMetadata{Created: 2})
+	assert.Equal(t, logserver.ErrLogMetadataConflict, err)
+	assert.Equal(t, metadata.Name(), rebuilt.GetLogName())
+}
+
+func TestSimpleGraphRefresh(t *testing.T) {
+	records := make([]gdp.Record, 0, 4)
+	prev := gdp.NullHash
+	for i := 0; i < 4; i++ {
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{RecNo: i, PrevHash: prev, Sig: []byte{}},
+			Value:     []byte{},
+		}
+		record.Hash = gdp.RecordHash(record)
+		records = append(records, record)
+		prev = record.Hash
+	}
+
+	logServer := logserver.NewMemoryServer()
+	assert.Nil(t, logServer.WriteRecords(records[:1]))
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+
+	var reported []gdp.Record
+	graph.AddHook(func(src gdp.Hash, records []gdp.Record) {
+		assert.Equal(t, gdp.NullHash, src)
+		reported = append(reported, records...)
+	})
+
+	// Records written through the graph are not added again
+	assert.Nil(t, graph.WriteRecords(records[1:2]))
+	reported = nil
+
+	// Records written by another writer appear on refresh
+	assert.Nil(t, logServer.WriteRecords(records[2:]))
+	assert.Equal(t, 2, len(graph.GetNodeMap()))
+	numAdded, err := graph.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, numAdded)
+	assert.Equal(t, records[2:], reported)
+	assert.Equal(t, 4, len(graph.GetNodeMap()))
+	assert.Equal(t, []gdp.Hash{records[3].Hash}, graph.GetLogicalEnds())
+
+	numAdded, err = graph.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, numAdded)
+}
+
+// chainedRecords returns n records, each following the previous one.
+func chainedRecords(n int) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	prev := gdp.NullHash
+	for i := 0; i < n; i++ {
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{RecNo: i, PrevHash: prev, Sig: []byte{}},
+			Value:     []byte{},
+		}
+		record.Hash = gdp.RecordHash(record)
+		records = append(records, record)
+		prev = record.Hash
+	}
+	return records
+}
+
+// sqliteGraph returns a graph over a new database file, and a writer
+// to the same file standing for another process. cleanup removes both.
+func sqliteGraph(t *testing.T) (*SimpleGraph, *sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "gdp-replicate")
+	assert.Nil(t, err)
+
+	dbFile := filepath.Join(dir, "log.glob")
+	db, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	logServer := logserver.NewSqliteServer(db)
+	assert.Nil(t, logServer.Migrate())
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+
+	writer, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	cleanup := func() {
+		writer.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	return graph, writer, cleanup
+}
+
+// insertRecord stores record through writer, bypassing the graph.
+func insertRecord(t *testing.T, writer *sql.DB, record gdp.Record) {
+	_, err := writer.Exec(
+		"INSERT INTO log_entry VALUES (?, ?, ?, ?, ?, ?, ?)",
+		record.Hash[:], record.RecNo, record.Timestamp, record.Accuracy,
+		record.PrevHash[:], record.Value, record.Sig,
+	)
+	assert.Nil(t, err)
+}
+
+func TestSimpleGraphRefreshAfterDelete(t *testing.T) {
+	graph, writer, cleanup := sqliteGraph(t)
+	defer cleanup()
+
+	records := chainedRecords(4)
+	assert.Nil(t, graph.WriteRecords(records[:3]))
+	numAdded, err := graph.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, numAdded)
+
+	// The newest row is deleted, then another process appends
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{
+		{Hash: records[2].Hash, PrevHash: records[1].Hash},
+	}))
+	insertRecord(t, writer, records[3])
+
+	numAdded, err = graph.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, numAdded)
+	assert.True(t, graph.HasNode(records[3].Hash))
+}
+
+func TestSimpleGraphHooksSkipExternalWrites(t *testing.T) {
+	graph, writer, cleanup := sqliteGraph(t)
+	defer cleanup()
+
+	type report struct {
+		src     gdp.Hash
+		records []gdp.Record
+	}
+	var reports []report
+	graph.AddHook(func(src gdp.Hash, records []gdp.Record) {
+		reports = append(reports, report{src, records})
+	})
+
+	// A peer sends a record another process stored since the last
+	// refresh; the database ignores it, so it is not reported as the
+	// peer's
+	records := chainedRecords(2)
+	insertRecord(t, writer, records[0])
+	peer := gdp.GenerateHash("peer")
+	assert.Nil(t, graph.WriteRecordsFrom(peer, records))
+	assert.Equal(t, []report{{peer, records[1:]}}, reports)
+
+	// Refreshing reports it as local
+	reports = nil
+	numAdded, err := graph.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, numAdded)
+	assert.Equal(t, []report{{gdp.NullHash, records[:1]}}, reports)
+	assert.Equal(t, 2, graph.NumNodes())
+}
+
+func TestSimpleGraphClone(t *testing.T) {
+	records := make([]gdp.Record, 0, 6)
+	prev := gdp.NullHash
+	for i := 0; i < 6; i++ {
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{Hash: hash, RecNo: i, PrevHash: prev},
+		})
+		prev = hash
+	}
+
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+	assert.Nil(t, graph.WriteRecords(records[:3]))
+
+	clone, err := graph.CreateClone()
+	assert.Nil(t, err)
+
+	// Writes after the snapshot leave it as it was
+	assert.Nil(t, graph.WriteRecords(records[3:]))
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{{Hash: records[0].Hash}}))
+
+	assert.Equal(t, 3, clone.NumNodes())
+	assert.Equal(t, 3, len(clone.GetNodeMap()))
+	assert.Equal(t, []gdp.Hash{records[0].Hash}, clone.GetLogicalBegins())
+	assert.Equal(t, []gdp.Hash{records[2].Hash}, clone.GetLogicalEnds())
+	assert.True(t, clone.HasNode(records[0].Hash))
+	assert.False(t, clone.HasNode(records[3].Hash))
+	assert.Equal(t, 0, len(clone.GetNext(records[2].Hash)))
+	prevHash, present := clone.GetPrev(records[2].Hash)
+	assert.True(t, present)
+	assert.Equal(t, records[1].Hash, prevHash)
+
+	assert.Equal(t, 5, graph.NumNodes())
+	assert.Equal(t, []gdp.Hash{records[1].Hash}, graph.GetLogicalBegins())
+	assert.Equal(t, []gdp.Hash{records[5].Hash}, graph.GetLogicalEnds())
+	assert.Equal(t, []gdp.Hash{records[3].Hash}, graph.GetNext(records[2].Hash))
+}
+
+// hashedChain returns a chain of n records whose hashes are their
+// canonical hashes, so that peers may send them.
+func hashedChain(n int) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	prev := gdp.NullHash
+	for i := 0; i < n; i++ {
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{RecNo: i, PrevHash: prev, Sig: []byte{}},
+			Value:     []byte(fmt.Sprint(i)),
+		}
+		record.Hash = gdp.RecordHash(record)
+		records = append(records, record)
+		prev = record.Hash
+	}
+	return records
+}
+
+// checkConsistent checks that clone is a consistent view of the graph.
+func checkConsistent(t *testing.T, clone LogGraphClone) {
+	nodeMap := clone.GetNodeMap()
+	assert.Equal(t, clone.NumNodes(), len(nodeMap))
+
+	begins := make(map[gdp.Hash]bool)
+	for _, hash := range clone.GetLogicalBegins() {
+		begins[hash] = true
+	}
+	for hash := range nodeMap {
+		prevHash, present := clone.GetPrev(hash)
+		if present && clone.HasNode(prevHash) {
+			assert.Contains(t, clone.GetNext(prevHash), hash)
+		} else {
+			assert.True(t, begins[hash])
+		}
+	}
+}
+
+// TestSimpleGraphConcurrentConversations runs conversations with many
+// peers against one graph at once, each reading from a clone and
+// writing what it received, as GobServer does. It is meant to be run
+// with the race detector.
+// Snapshots once returned the logical ends of the graph as its begins.
+func TestSimpleGraphCloneBegins(t *testing.T) {
+	records := make([]gdp.Record, 0, 5)
+	prev := gdp.NullHash
+	for i := 0; i < 5; i++ {
+		// The fourth record follows a hole
+		if i == 3 {
+			prev = gdp.GenerateHash("missing")
+		}
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{Hash: hash, RecNo: i, PrevHash: prev},
+		})
+		prev = hash
+	}
+
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+	assert.Nil(t, graph.WriteRecords(records))
+
+	clone, err := graph.CreateClone()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []gdp.Hash{records[0].Hash, records[3].Hash}, clone.GetLogicalBegins())
+	assert.ElementsMatch(t, []gdp.Hash{records[2].Hash, records[4].Hash}, clone.GetLogicalEnds())
+}
+
+func TestSimpleGraphConcurrentConversations(t *testing.T) {
+	const numPeers = 32
+	const numRecords = 512
+
+	logServer := logserver.NewMemoryServer()
+	graph, err := NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+
+	var mutex sync.Mutex
+	reported := make(map[gdp.Hash]int)
+	graph.AddHook(func(src gdp.Hash, records []gdp.Record) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, record := range records {
+			reported[record.Hash]++
+		}
+	})
+
+	records := hashedChain(numRecords)
+	var wg sync.WaitGroup
+	for i := 0; i < numPeers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peer := gdp.GenerateHash(fmt.Sprint("peer", i))
+
+			for round := 0; round < 8; round++ {
+				clone, err := graph.CreateClone()
+				assert.Nil(t, err)
+				numNodes := clone.NumNodes()
+				checkConsistent(t, clone)
+
+				// Peers send overlapping batches, some twice
+				start := (i*37 + round*101) % numRecords
+				end := start + 1 + (i*13+round*7)%(numRecords/8)
+				if end > numRecords {
+					end = numRecords
+				}
+				batch := append([]gdp.Record{}, records[start:end]...)
+				batch = append(batch, records[start])
+				assert.Nil(t, graph.WriteRecordsFrom(peer, batch))
+
+				graph.IsRooted(records[start].Hash)
+				graph.GetRejectedCounts()
+				assert.True(t, graph.HasNode(records[start].Hash))
+
+				// Later writes leave the clone as it was
+				assert.Equal(t, numNodes, clone.NumNodes())
+				checkConsistent(t, clone)
+			}
+		}(i)
+	}
+
+	// Other writers fill the log server meanwhile
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numRecords; i += numRecords / 16 {
+			assert.Nil(t, logServer.WriteRecords(records[i:i+numRecords/16]))
+			_, err := graph.Refresh()
+			assert.Nil(t, err)
+		}
+	}()
+	wg.Wait()
+
+	_, err = graph.Refresh()
+	assert.Nil(t, err)
+	assert.Equal(t, numRecords, graph.NumNodes())
+	assert.Equal(t, []gdp.Hash{records[0].Hash}, graph.GetLogicalBegins())
+	assert.Equal(t, []gdp.Hash{records[numRecords-1].Hash}, graph.GetLogicalEnds())
+	checkConsistent(t, graph)
+
+	// Each record is reported once, by whichever write stored it
+	assert.Equal(t, numRecords, len(reported))
+	for _, record := range records {
+		assert.Equal(t, 1, reported[record.Hash])
+	}
+}
+
+// TestSimpleGraphConcurrentPrune prunes and writes records while
+// conversations read the graph.
+func TestSimpleGraphConcurrentPrune(t *testing.T) {
+	const numRecords = 256
+
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+	records := hashedChain(numRecords)
+	assert.Nil(t, graph.WriteRecords(records[:numRecords/2]))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 16; round++ {
+				clone, err := graph.CreateClone()
+				assert.Nil(t, err)
+				checkConsistent(t, clone)
+				graph.GetPrunedMap()
+				graph.GetLogicalPtrMap()
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := numRecords / 2; i < numRecords; i += 8 {
+			assert.Nil(t, graph.WriteRecords(records[i:i+8]))
+			_, err := graph.Prune(logserver.Retention{MaxRecords: 64})
+			assert.Nil(t, err)
+		}
+	}()
+	wg.Wait()
+
+	assert.Equal(t, 64, graph.NumNodes())
+	assert.Equal(t, []gdp.Hash{records[numRecords-64].Hash}, graph.GetLogicalBegins())
+	checkConsistent(t, graph)
+}
+
+func BenchmarkCreateClone(b *testing.B) {
+	logServer := logserver.NewMemoryServer()
+	graph, err := NewSimpleGraph(logServer)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	records := make([]gdp.Record, 0, 100000)
+	prev := gdp.NullHash
+	for i := 0; i < cap(records); i++ {
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{Hash: hash, RecNo: i, PrevHash: prev},
+		})
+		prev = hash
+	}
+	err = graph.WriteRecords(records)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = graph.CreateClone()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,159 +1,616 @@
 package loggraph
 
 import (
+	"crypto"
+	"sync"
+
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/logserver"
 
-	"github.com/jinzhu/copier"
+	"go.uber.org/zap"
 )
 
+// SimpleGraph is a LogGraph kept in memory over a LogServer. It is safe
+// for concurrent use: writes are serialized, and reads are answered from
+// the state left by the last completed write.
 type SimpleGraph struct {
 	logServer logserver.LogServer
-	// All log entries in the database as of last refresh
-	forwardEdges  map[gdp.Hash][]gdp.Hash
-	backwardEdges map[gdp.Hash]gdp.Hash
-	logicalEnds   map[gdp.Hash]bool
 
-	// logicalStarts maps from a record's PrevHash to their Hash
-	logicalStarts map[gdp.Hash][]gdp.Hash
-	nodeMap       map[gdp.Hash]bool
+	// writeMutex serializes writes, including the hooks they call, so
+	// that each write sees the state left by the previous one
+	writeMutex sync.Mutex
+
+	// mutex guards the fields below it, which writes replace while
+	// holding writeMutex too
+	mutex sync.RWMutex
+
+	// All log entries in the database as of last refresh. Writes
+	// replace the state rather than modify it, so snapshots share it
+	state *graphState
+
+	// called after each write that persisted new records
+	hooks []Hook
+
+	// number of records from each peer rejected for a wrong hash
+	rejected map[gdp.Hash]int
+
+	// records held that each peer deleted, from its tombstones
+	peerPruned map[gdp.Hash]map[gdp.Hash]bool
+
+	// public key of the writer of the log, if records are verified
+	writerKey crypto.PublicKey
+
+	// metadata record of the log, if known
+	logMetadata *gdp.LogMetadata
+
+	// cursor of the log server after the records in the graph, only
+	// used while holding writeMutex
+	cursor int64
 }
 
 func NewSimpleGraph(logServer logserver.LogServer) (*SimpleGraph, error) {
 	simpleGraph := &SimpleGraph{
-		logServer:     logServer,
-		forwardEdges:  make(map[gdp.Hash][]gdp.Hash),
-		backwardEdges: make(map[gdp.Hash]gdp.Hash),
-		logicalEnds:   make(map[gdp.Hash]bool),
-		logicalStarts: make(map[gdp.Hash][]gdp.Hash),
-		nodeMap:       make(map[gdp.Hash]bool),
+		logServer:  logServer,
+		state:      newGraphState(),
+		rejected:   make(map[gdp.Hash]int),
+		peerPruned: make(map[gdp.Hash]map[gdp.Hash]bool),
+	}
+
+	// Records stored during the stream are read again by Refresh
+	cursor, err := simpleGraph.logServer.MetadataCursor()
+	if err != nil {
+		return nil, err
 	}
+	simpleGraph.cursor = cursor
 
-	metadata, err := simpleGraph.logServer.ReadAllMetadata()
+	// Only one batch of metadata is held at a time, besides the graph
+	err = simpleGraph.logServer.StreamMetadata(func(metadata []gdp.Metadatum) error {
+		simpleGraph.addMetadata(metadata)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	simpleGraph.addMetadata(metadata)
+	tombstones, err := simpleGraph.logServer.ReadAllTombstones()
+	if err != nil {
+		return nil, err
+	}
+	simpleGraph.removeNodes(tombstones)
+
+	logMetadata, err := simpleGraph.logServer.ReadLogMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if logMetadata != nil {
+		err = simpleGraph.setLogMetadata(*logMetadata)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return simpleGraph, nil
 }
 
-// addMetadata updates all SimpleGraph fields to reflect new Metadata
+// addMetadata updates the graph to reflect new Metadata
 func (graph *SimpleGraph) addMetadata(metadata []gdp.Metadatum) {
-	for _, metadatum := range metadata {
-		graph.nodeMap[metadatum.Hash] = true
+	graph.setState(graph.current().withMetadata(metadata))
+}
 
-		// Edges are those between the hashes of two records
-		if metadatum.PrevHash != gdp.NullHash {
-			graph.backwardEdges[metadatum.Hash] = metadatum.PrevHash
+// removeNodes updates the graph to reflect deleted records. Their
+// children become logical begins following a pruned prefix.
+func (graph *SimpleGraph) removeNodes(tombstones []gdp.Tombstone) {
+	graph.setState(graph.current().withoutNodes(tombstones))
 
-			edges, present := graph.forwardEdges[metadatum.PrevHash]
-			if !present {
-				graph.forwardEdges[metadatum.PrevHash] = []gdp.Hash{metadatum.Hash}
-			} else {
-				graph.forwardEdges[metadatum.PrevHash] = append(edges, metadatum.Hash)
-			}
-		}
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
 
-		// determine if logical start
-		_, present := graph.nodeMap[metadatum.PrevHash]
-		if metadatum.PrevHash == gdp.NullHash || !present {
-			starts, present := graph.logicalStarts[metadatum.PrevHash]
-			if present {
-				graph.logicalStarts[metadatum.PrevHash] = append(starts, metadatum.Hash)
-			} else {
-				graph.logicalStarts[metadatum.PrevHash] = []gdp.Hash{metadatum.Hash}
-			}
+	for peer, pruned := range graph.peerPruned {
+		for _, tombstone := range tombstones {
+			delete(pruned, tombstone.Hash)
 		}
-
-		// determine if logical end
-		_, present = graph.forwardEdges[metadatum.Hash]
-		if !present {
-			graph.logicalEnds[metadatum.Hash] = true
+		if len(pruned) == 0 {
+			delete(graph.peerPruned, peer)
 		}
+	}
+}
 
-		// determine if changing a logical start
-		delete(graph.logicalStarts, metadatum.Hash)
+// current returns the state of the graph. It is never modified, so it
+// can be read without holding any lock.
+func (graph *SimpleGraph) current() *graphState {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
 
-		// determine if changing a logical end
-		delete(graph.logicalEnds, metadatum.PrevHash)
-	}
+	return graph.state
+}
+
+// setState replaces the state of the graph.
+func (graph *SimpleGraph) setState(state *graphState) {
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+
+	graph.state = state
 }
 
 func (graph *SimpleGraph) GetNodeMap() map[gdp.Hash]bool {
-	return graph.nodeMap
+	return graph.current().GetNodeMap()
 }
 
 func (graph *SimpleGraph) GetActualPtrMap() map[gdp.Hash]gdp.Hash {
-	return graph.backwardEdges
+	return graph.current().GetActualPtrMap()
 }
 
 func (graph *SimpleGraph) GetLogicalPtrMap() map[gdp.Hash][]gdp.Hash {
-	return graph.forwardEdges
+	return graph.current().GetLogicalPtrMap()
 }
 
 func (graph *SimpleGraph) GetLogicalEnds() []gdp.Hash {
-	ends := make([]gdp.Hash, 0, len(graph.logicalEnds))
-	for hash, _ := range graph.logicalEnds {
-		ends = append(ends, hash)
-	}
-	return ends
+	return graph.current().GetLogicalEnds()
 }
 
 func (graph *SimpleGraph) GetLogicalBegins() []gdp.Hash {
-	starts := make([]gdp.Hash, 0, len(graph.logicalStarts))
-	for _, hashes := range graph.logicalStarts {
-		for _, hash := range hashes {
-			starts = append(starts, hash)
-		}
-	}
-	return starts
+	return graph.current().GetLogicalBegins()
+}
+
+func (graph *SimpleGraph) HasNode(hash gdp.Hash) bool {
+	return graph.current().HasNode(hash)
+}
+
+func (graph *SimpleGraph) GetPrev(hash gdp.Hash) (gdp.Hash, bool) {
+	return graph.current().GetPrev(hash)
+}
+
+func (graph *SimpleGraph) GetNext(hash gdp.Hash) []gdp.Hash {
+	return graph.current().GetNext(hash)
+}
+
+func (graph *SimpleGraph) NumNodes() int {
+	return graph.current().NumNodes()
+}
+
+func (graph *SimpleGraph) WalkAncestors(hash gdp.Hash, fn func(hash gdp.Hash) bool) {
+	graph.current().WalkAncestors(hash, fn)
+}
+
+func (graph *SimpleGraph) WalkDescendants(hash gdp.Hash, fn func(hash gdp.Hash) bool) {
+	graph.current().WalkDescendants(hash, fn)
+}
+
+func (graph *SimpleGraph) GetAncestors(hash gdp.Hash, limit int) []gdp.Hash {
+	return graph.current().GetAncestors(hash, limit)
+}
+
+func (graph *SimpleGraph) GetDescendants(hash gdp.Hash, limit int) []gdp.Hash {
+	return graph.current().GetDescendants(hash, limit)
+}
+
+func (graph *SimpleGraph) GetPath(ancestor gdp.Hash, descendant gdp.Hash) ([]gdp.Hash, bool) {
+	return graph.current().GetPath(ancestor, descendant)
+}
+
+func (graph *SimpleGraph) GetComponent(hash gdp.Hash) []gdp.Hash {
+	return graph.current().GetComponent(hash)
+}
+
+func (graph *SimpleGraph) WalkTopological(fn func(hash gdp.Hash) bool) {
+	graph.current().WalkTopological(fn)
+}
+
+func (graph *SimpleGraph) GetComponents() []ComponentSummary {
+	return graph.current().GetComponents()
+}
+
+func (graph *SimpleGraph) GetHoles() []Hole {
+	return graph.current().holes(graph.GetLogName())
+}
+
+func (graph *SimpleGraph) GetBranches() []Branch {
+	return graph.current().GetBranches()
 }
 
 // WriteRecords writes records to the graph's log server and
 // updates the graph with those records
 func (graph *SimpleGraph) WriteRecords(records []gdp.Record) error {
-	err := graph.logServer.WriteRecords(records)
-	if err != nil {
+	return graph.WriteRecordsFrom(gdp.NullHash, records)
+}
+
+// WriteRecordsFrom writes records received from src to the graph's
+// log server, updates the graph with those records and reports the
+// ones the log server stored to the hooks. Records from peers whose
+// hash does not match their contents are rejected, and those without
+// a valid signature by the writer key are quarantined.
+func (graph *SimpleGraph) WriteRecordsFrom(src gdp.Hash, records []gdp.Record) error {
+	graph.writeMutex.Lock()
+	defer graph.writeMutex.Unlock()
+
+	if src != gdp.NullHash {
+		records = graph.verifiedRecords(src, records)
+	}
+	fresh := graph.freshRecords(records)
+	if writerKey := graph.getWriterKey(); src != gdp.NullHash && writerKey != nil {
+		var err error
+		fresh, err = graph.signedRecords(src, writerKey, fresh)
+		if err != nil {
+			return err
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	// Records another process stored since the last refresh are left
+	// to Refresh, which reports them as local
+	stored, err := graph.logServer.WriteNewRecords(fresh)
+	if err != nil || len(stored) == 0 {
 		return err
 	}
 
-	metadata := make([]gdp.Metadatum, 0, len(records))
-	for _, record := range records {
+	metadata := make([]gdp.Metadatum, 0, len(stored))
+	for _, record := range stored {
 		metadata = append(metadata, record.Metadatum)
 	}
 	graph.addMetadata(metadata)
+
+	for _, hook := range graph.getHooks() {
+		hook(src, stored)
+	}
 	return nil
 }
 
-func (graph *SimpleGraph) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
-	return graph.logServer.ReadRecords(hashes)
+// Refresh adds the records stored in the graph's log server by other
+// writers, such as the local GDP log writer, since the graph was last
+// refreshed. Their records are reported to the hooks as local ones. It
+// returns the number of records added.
+func (graph *SimpleGraph) Refresh() (int, error) {
+	graph.writeMutex.Lock()
+	defer graph.writeMutex.Unlock()
+
+	numAdded := 0
+	for {
+		metadata, cursor, err := graph.logServer.ReadMetadataSince(graph.cursor)
+		if err != nil {
+			return numAdded, err
+		}
+		graph.cursor = cursor
+		if len(metadata) == 0 {
+			return numAdded, nil
+		}
+
+		state := graph.current()
+		fresh := make([]gdp.Metadatum, 0, len(metadata))
+		for _, metadatum := range metadata {
+			pruned := state.pruned.contains(metadatum.Hash)
+			if !state.nodes.contains(metadatum.Hash) && !pruned {
+				fresh = append(fresh, metadatum)
+			}
+		}
+		if len(fresh) == 0 {
+			continue
+		}
+
+		graph.addMetadata(fresh)
+		numAdded += len(fresh)
+		err = graph.reportMetadata(fresh)
+		if err != nil {
+			return numAdded, err
+		}
+	}
 }
 
-// CreateClone uses encoding to clone the SimpleGraph.
-func (graph *SimpleGraph) CreateClone() (*SimpleGraphClone, error) {
-	forwardEdges := make(map[gdp.Hash][]gdp.Hash)
-	backwardEdges := make(map[gdp.Hash]gdp.Hash)
-	nodeMap := make(map[gdp.Hash]bool)
+// reportMetadata reports the records of metadata to the hooks.
+func (graph *SimpleGraph) reportMetadata(metadata []gdp.Metadatum) error {
+	hooks := graph.getHooks()
+	if len(hooks) == 0 {
+		return nil
+	}
 
-	err := copier.Copy(&forwardEdges, &graph.forwardEdges)
+	hashes := make([]gdp.Hash, 0, len(metadata))
+	for _, metadatum := range metadata {
+		hashes = append(hashes, metadatum.Hash)
+	}
+	records, err := graph.logServer.ReadRecords(hashes)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	for _, hook := range hooks {
+		hook(gdp.NullHash, records)
 	}
-	err = copier.Copy(&backwardEdges, &graph.backwardEdges)
+	return nil
+}
+
+// WriteTombstones deletes records from the graph's log server and
+// updates the graph.
+func (graph *SimpleGraph) WriteTombstones(tombstones []gdp.Tombstone) error {
+	graph.writeMutex.Lock()
+	defer graph.writeMutex.Unlock()
+
+	err := graph.logServer.WriteTombstones(tombstones)
+	if err != nil {
+		return err
+	}
+	graph.removeNodes(tombstones)
+	return nil
+}
+
+// Prune deletes the records retention does not keep from the graph's
+// log server, updates the graph and returns their tombstones.
+func (graph *SimpleGraph) Prune(retention logserver.Retention) ([]gdp.Tombstone, error) {
+	graph.writeMutex.Lock()
+	defer graph.writeMutex.Unlock()
+
+	tombstones, err := graph.logServer.Prune(retention)
 	if err != nil {
 		return nil, err
 	}
-	err = copier.Copy(&nodeMap, &graph.nodeMap)
+	graph.removeNodes(tombstones)
+	return tombstones, nil
+}
+
+// GetExpired returns the tombstones of the records retention does not
+// keep.
+func (graph *SimpleGraph) GetExpired(retention logserver.Retention) ([]gdp.Tombstone, error) {
+	return graph.logServer.Expired(retention)
+}
+
+func (graph *SimpleGraph) GetPrunedMap() map[gdp.Hash]gdp.Hash {
+	return graph.current().getPrunedMap()
+}
+
+// verifiedRecords returns the records from src whose hash is their
+// canonical hash, counting the others against src.
+func (graph *SimpleGraph) verifiedRecords(src gdp.Hash, records []gdp.Record) []gdp.Record {
+	verified := make([]gdp.Record, 0, len(records))
+	for _, record := range records {
+		if gdp.RecordHash(record) == record.Hash {
+			verified = append(verified, record)
+			continue
+		}
+
+		graph.mutex.Lock()
+		graph.rejected[src]++
+		numRejected := graph.rejected[src]
+		graph.mutex.Unlock()
+
+		zap.S().Warnw(
+			"Rejecting record with wrong hash",
+			"src", src.Readable(),
+			"hash", record.Hash.Readable(),
+			"numRejected", numRejected,
+		)
+	}
+	return verified
+}
+
+// signedRecords returns the records from src signed by writerKey, and
+// quarantines the others.
+func (graph *SimpleGraph) signedRecords(
+	src gdp.Hash,
+	writerKey crypto.PublicKey,
+	records []gdp.Record,
+) ([]gdp.Record, error) {
+	signed := make([]gdp.Record, 0, len(records))
+	quarantined := make([]logserver.QuarantinedRecord, 0)
+	for _, record := range records {
+		err := gdp.VerifyRecord(writerKey, record)
+		if err == nil {
+			signed = append(signed, record)
+			continue
+		}
+
+		zap.S().Warnw(
+			"Quarantining record",
+			"src", src.Readable(),
+			"hash", record.Hash.Readable(),
+			"error", err,
+		)
+		quarantined = append(quarantined, logserver.QuarantinedRecord{
+			Record: record,
+			Source: src,
+			Reason: err.Error(),
+		})
+	}
+
+	err := graph.logServer.Quarantine(quarantined)
 	if err != nil {
 		return nil, err
 	}
+	return signed, nil
+}
+
+// SetWriterKey makes the graph verify the signature of records from
+// peers with the public key of the writer of the log.
+func (graph *SimpleGraph) SetWriterKey(key crypto.PublicKey) {
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+
+	graph.writerKey = key
+}
+
+func (graph *SimpleGraph) getWriterKey() crypto.PublicKey {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	return graph.writerKey
+}
+
+// WriteLogMetadata writes the metadata record of the log to the graph's
+// log server. Unless a writer key is set, records from peers are then
+// verified with the writer key of the metadata record.
+func (graph *SimpleGraph) WriteLogMetadata(metadata gdp.LogMetadata) error {
+	graph.writeMutex.Lock()
+	defer graph.writeMutex.Unlock()
+
+	_, err := metadata.PublicKey()
+	if err != nil {
+		return err
+	}
+	err = graph.logServer.WriteLogMetadata(metadata)
+	if err != nil {
+		return err
+	}
+	return graph.setLogMetadata(metadata)
+}
+
+// setLogMetadata updates the graph with the metadata record of the
+// log.
+func (graph *SimpleGraph) setLogMetadata(metadata gdp.LogMetadata) error {
+	key, err := metadata.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+
+	if graph.writerKey == nil {
+		graph.writerKey = key
+	}
+	graph.logMetadata = &metadata
+	return nil
+}
+
+// GetLogMetadata returns the metadata record of the log, or nil if it
+// is not known yet.
+func (graph *SimpleGraph) GetLogMetadata() *gdp.LogMetadata {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	return graph.logMetadata
+}
+
+// GetLogName returns the name of the log, derived from its metadata
+// record, or gdp.NullHash if it is not known yet.
+func (graph *SimpleGraph) GetLogName() gdp.Hash {
+	logMetadata := graph.GetLogMetadata()
+	if logMetadata == nil {
+		return gdp.NullHash
+	}
+	return logMetadata.Name()
+}
+
+// IsRooted reports whether the connected component holding hash starts
+// at the metadata record of the log, possibly through pruned records.
+// The logical begin of a component that is not rooted follows a hole.
+func (graph *SimpleGraph) IsRooted(hash gdp.Hash) bool {
+	name := graph.GetLogName()
+	state := graph.current()
+	if name == gdp.NullHash || !state.HasNode(hash) {
+		return false
+	}
+
+	// Chains do not loop, but the walk is bounded in case one does
+	for steps := 0; steps <= state.nodes.len()+state.pruned.len(); steps++ {
+		if hash == name {
+			return true
+		}
+		prevHash, present := state.GetPrev(hash)
+		if !present {
+			var pruned interface{}
+			pruned, present = state.pruned.get(hash)
+			if present {
+				prevHash = pruned.(gdp.Hash)
+			}
+		}
+		if !present {
+			return false
+		}
+		hash = prevHash
+	}
+	return false
+}
+
+// GetRejectedCounts returns the number of records rejected from each
+// peer.
+func (graph *SimpleGraph) GetRejectedCounts() map[gdp.Hash]int {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	rejected := make(map[gdp.Hash]int, len(graph.rejected))
+	for src, numRejected := range graph.rejected {
+		rejected[src] = numRejected
+	}
+	return rejected
+}
+
+// AddPeerTombstones keeps the tombstones from peer of the records held.
+// Others are dropped, so a peer cannot grow the graph with them.
+func (graph *SimpleGraph) AddPeerTombstones(peer gdp.Hash, tombstones []gdp.Tombstone) {
+	// Deletes do not run in between, so no record is kept once gone
+	graph.writeMutex.Lock()
+	defer graph.writeMutex.Unlock()
+
+	state := graph.current()
+
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+
+	for _, tombstone := range tombstones {
+		if !state.nodes.contains(tombstone.Hash) {
+			continue
+		}
+		pruned, present := graph.peerPruned[peer]
+		if !present {
+			pruned = make(map[gdp.Hash]bool)
+			graph.peerPruned[peer] = pruned
+		}
+		pruned[tombstone.Hash] = true
+	}
+}
+
+// GetPeerPruned returns the records held that peer deleted.
+func (graph *SimpleGraph) GetPeerPruned(peer gdp.Hash) map[gdp.Hash]bool {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	pruned := make(map[gdp.Hash]bool, len(graph.peerPruned[peer]))
+	for hash := range graph.peerPruned[peer] {
+		pruned[hash] = true
+	}
+	return pruned
+}
+
+// freshRecords returns the records neither in the graph nor deleted,
+// each once.
+func (graph *SimpleGraph) freshRecords(records []gdp.Record) []gdp.Record {
+	state := graph.current()
+	seen := make(map[gdp.Hash]bool)
+	fresh := make([]gdp.Record, 0, len(records))
+	for _, record := range records {
+		pruned := state.pruned.contains(record.Hash)
+		if state.HasNode(record.Hash) || pruned || seen[record.Hash] {
+			continue
+		}
+		seen[record.Hash] = true
+		fresh = append(fresh, record)
+	}
+	return fresh
+}
+
+// AddHook registers a hook called with the records each write newly
+// persisted.
+func (graph *SimpleGraph) AddHook(hook Hook) {
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+
+	hooks := make([]Hook, 0, len(graph.hooks)+1)
+	hooks = append(hooks, graph.hooks...)
+	graph.hooks = append(hooks, hook)
+}
+
+// getHooks returns the registered hooks. The slice is replaced rather
+// than appended to, so it can be used without holding any lock.
+func (graph *SimpleGraph) getHooks() []Hook {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	return graph.hooks
+}
+
+func (graph *SimpleGraph) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
+	return graph.logServer.ReadRecords(hashes)
+}
 
-	return &SimpleGraphClone{
-		forwardEdges:  forwardEdges,
-		backwardEdges: backwardEdges,
-		logicalEnds:   graph.GetLogicalEnds(),
-		logicalStarts: graph.GetLogicalBegins(),
-		nodeMap:       nodeMap,
-	}, nil
+// CreateClone returns a snapshot of the SimpleGraph, which shares its
+// current state.
+func (graph *SimpleGraph) CreateClone() (LogGraphClone, error) {
+	return &SimpleGraphClone{graph.current(), graph.GetLogName()}, nil
 }
@@ -1,31 +1,258 @@
 package loggraph
 
-import "github.com/tonyyanga/gdp-replicate/gdp"
+import (
+	"sync"
 
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// SimpleGraphClone is a snapshot of a SimpleGraph. It shares the state
+// of the graph at the time it was taken, which later writes replace
+// rather than modify.
 type SimpleGraphClone struct {
-	forwardEdges  map[gdp.Hash][]gdp.Hash
-	backwardEdges map[gdp.Hash]gdp.Hash
-	logicalEnds   []gdp.Hash
-	logicalStarts []gdp.Hash
-	nodeMap       map[gdp.Hash]bool
+	*graphState
+
+	// name of the log when the snapshot was taken
+	logName gdp.Hash
+}
+
+// GetHoles returns the holes of the snapshot.
+func (clone *SimpleGraphClone) GetHoles() []Hole {
+	return clone.holes(clone.logName)
+}
+
+// graphState is the state of a SimpleGraph at one time. It is never
+// modified: updates return a new state sharing the unchanged parts of
+// the old one through persistent tries.
+type graphState struct {
+	// nodes holds the RecNo of every record, backward its PrevHash if
+	// not gdp.NullHash, and forward the children of each PrevHash
+	nodes    hashTrie
+	backward hashTrie
+	forward  hashTrie
+
+	// ends holds the logical ends, and starts maps the PrevHash of the
+	// logical begins to their Hash
+	ends   hashTrie
+	starts hashTrie
+
+	// pruned maps deleted records to their PrevHash
+	pruned hashTrie
+
+	// maps built from the tries on demand
+	cache *stateCache
+}
+
+// stateCache holds the maps of a graphState, each built at most once.
+type stateCache struct {
+	nodeMapOnce sync.Once
+	nodeMap     map[gdp.Hash]bool
+
+	actualOnce sync.Once
+	actual     map[gdp.Hash]gdp.Hash
+
+	logicalOnce sync.Once
+	logical     map[gdp.Hash][]gdp.Hash
+
+	prunedOnce sync.Once
+	prunedMap  map[gdp.Hash]gdp.Hash
+}
+
+func newGraphState() *graphState {
+	return &graphState{cache: &stateCache{}}
+}
+
+// update returns a copy of state for an update to fill in.
+func (state *graphState) update() *graphState {
+	next := *state
+	next.cache = &stateCache{}
+	return &next
+}
+
+// withMetadata returns the state with new Metadata.
+func (state *graphState) withMetadata(metadata []gdp.Metadatum) *graphState {
+	next := state.update()
+	for _, metadatum := range metadata {
+		hash, prevHash := metadatum.Hash, metadatum.PrevHash
+
+		// Records written again are already in the graph
+		if next.nodes.contains(hash) {
+			continue
+		}
+		next.nodes = next.nodes.set(hash, metadatum.RecNo)
+
+		// Edges are those between the hashes of two records
+		if prevHash != gdp.NullHash {
+			next.backward = next.backward.set(hash, prevHash)
+			next.forward = next.forward.set(
+				prevHash,
+				appendHash(hashesIn(next.forward, prevHash), hash),
+			)
+		}
+
+		// determine if logical start
+		if prevHash == gdp.NullHash || !next.nodes.contains(prevHash) {
+			next.starts = next.starts.set(
+				prevHash,
+				appendHash(hashesIn(next.starts, prevHash), hash),
+			)
+		}
+
+		// determine if logical end
+		if !next.forward.contains(hash) {
+			next.ends = next.ends.set(hash, true)
+		}
+
+		// determine if changing a logical start
+		next.starts = next.starts.delete(hash)
+
+		// determine if changing a logical end
+		next.ends = next.ends.delete(prevHash)
+	}
+	return next
+}
+
+// withoutNodes returns the state without deleted records. Their
+// children become logical begins following a pruned prefix.
+func (state *graphState) withoutNodes(tombstones []gdp.Tombstone) *graphState {
+	next := state.update()
+	for _, tombstone := range tombstones {
+		hash, prevHash := tombstone.Hash, tombstone.PrevHash
+		next.pruned = next.pruned.set(hash, prevHash)
+		if !next.nodes.contains(hash) {
+			continue
+		}
+		next.nodes = next.nodes.delete(hash)
+		next.backward = next.backward.delete(hash)
+		next.ends = next.ends.delete(hash)
+
+		siblings := without(hashesIn(next.forward, prevHash), hash)
+		if len(siblings) == 0 {
+			next.forward = next.forward.delete(prevHash)
+			if next.nodes.contains(prevHash) {
+				next.ends = next.ends.set(prevHash, true)
+			}
+		} else {
+			next.forward = next.forward.set(prevHash, siblings)
+		}
+
+		starts := without(hashesIn(next.starts, prevHash), hash)
+		if len(starts) == 0 {
+			next.starts = next.starts.delete(prevHash)
+		} else {
+			next.starts = next.starts.set(prevHash, starts)
+		}
+
+		// Edges to the children are kept, as for a hole
+		if children := hashesIn(next.forward, hash); len(children) > 0 {
+			next.starts = next.starts.set(hash, children)
+		}
+	}
+	return next
+}
+
+// hashesIn returns the hashes trie holds for key. They must not be
+// modified.
+func hashesIn(trie hashTrie, key gdp.Hash) []gdp.Hash {
+	value, present := trie.get(key)
+	if !present {
+		return nil
+	}
+	return value.([]gdp.Hash)
+}
+
+// appendHash returns a copy of hashes with hash appended, leaving
+// hashes, which may be shared with other states, as it is.
+func appendHash(hashes []gdp.Hash, hash gdp.Hash) []gdp.Hash {
+	appended := make([]gdp.Hash, 0, len(hashes)+1)
+	appended = append(appended, hashes...)
+	return append(appended, hash)
+}
+
+// without returns hashes without hash.
+func without(hashes []gdp.Hash, hash gdp.Hash) []gdp.Hash {
+	kept := make([]gdp.Hash, 0, len(hashes))
+	for _, other := range hashes {
+		if other != hash {
+			kept = append(kept, other)
+		}
+	}
+	return kept
+}
+
+func (state *graphState) GetNodeMap() map[gdp.Hash]bool {
+	state.cache.nodeMapOnce.Do(func() {
+		state.cache.nodeMap = make(map[gdp.Hash]bool, state.nodes.len())
+		state.nodes.each(func(hash gdp.Hash, _ interface{}) {
+			state.cache.nodeMap[hash] = true
+		})
+	})
+	return state.cache.nodeMap
+}
+
+func (state *graphState) GetActualPtrMap() map[gdp.Hash]gdp.Hash {
+	state.cache.actualOnce.Do(func() {
+		state.cache.actual = make(map[gdp.Hash]gdp.Hash, state.backward.len())
+		state.backward.each(func(hash gdp.Hash, prevHash interface{}) {
+			state.cache.actual[hash] = prevHash.(gdp.Hash)
+		})
+	})
+	return state.cache.actual
+}
+
+func (state *graphState) GetLogicalPtrMap() map[gdp.Hash][]gdp.Hash {
+	state.cache.logicalOnce.Do(func() {
+		state.cache.logical = make(map[gdp.Hash][]gdp.Hash, state.forward.len())
+		state.forward.each(func(hash gdp.Hash, children interface{}) {
+			state.cache.logical[hash] = children.([]gdp.Hash)
+		})
+	})
+	return state.cache.logical
+}
+
+func (state *graphState) GetLogicalEnds() []gdp.Hash {
+	ends := make([]gdp.Hash, 0, state.ends.len())
+	state.ends.each(func(hash gdp.Hash, _ interface{}) {
+		ends = append(ends, hash)
+	})
+	return ends
+}
+
+func (state *graphState) GetLogicalBegins() []gdp.Hash {
+	starts := make([]gdp.Hash, 0, state.starts.len())
+	state.starts.each(func(_ gdp.Hash, hashes interface{}) {
+		starts = append(starts, hashes.([]gdp.Hash)...)
+	})
+	return starts
 }
 
-func (graph *SimpleGraphClone) GetNodeMap() map[gdp.Hash]bool {
-	return graph.nodeMap
+func (state *graphState) HasNode(hash gdp.Hash) bool {
+	return state.nodes.contains(hash)
 }
 
-func (graph *SimpleGraphClone) GetActualPtrMap() map[gdp.Hash]gdp.Hash {
-	return graph.backwardEdges
+func (state *graphState) GetPrev(hash gdp.Hash) (gdp.Hash, bool) {
+	prevHash, present := state.backward.get(hash)
+	if !present {
+		return gdp.NullHash, false
+	}
+	return prevHash.(gdp.Hash), true
 }
 
-func (graph *SimpleGraphClone) GetLogicalPtrMap() map[gdp.Hash][]gdp.Hash {
-	return graph.forwardEdges
+func (state *graphState) GetNext(hash gdp.Hash) []gdp.Hash {
+	return hashesIn(state.forward, hash)
 }
 
-func (graph *SimpleGraphClone) GetLogicalEnds() []gdp.Hash {
-	return graph.logicalEnds
+func (state *graphState) NumNodes() int {
+	return state.nodes.len()
 }
 
-func (graph *SimpleGraphClone) GetLogicalBegins() []gdp.Hash {
-	return graph.logicalEnds
+// getPrunedMap returns the map of deleted records to their PrevHash.
+func (state *graphState) getPrunedMap() map[gdp.Hash]gdp.Hash {
+	state.cache.prunedOnce.Do(func() {
+		state.cache.prunedMap = make(map[gdp.Hash]gdp.Hash, state.pruned.len())
+		state.pruned.each(func(hash gdp.Hash, prevHash interface{}) {
+			state.cache.prunedMap[hash] = prevHash.(gdp.Hash)
+		})
+	})
+	return state.cache.prunedMap
 }
@@ -0,0 +1,181 @@
+package loggraph
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// ComponentSummary describes a connected component of a graph: the
+// records descending from one logical begin.
+type ComponentSummary struct {
+	// Begin is the oldest record of the component, and Follows its
+	// PrevHash: gdp.NullHash at the start of the log, otherwise a
+	// record missing from the graph, either deleted or not received
+	Begin   gdp.Hash
+	Follows gdp.Hash
+
+	// Ends are the records of the component without children
+	Ends []gdp.Hash
+
+	NumNodes int
+
+	// RecNo of Begin and highest RecNo in the component
+	FirstRecNo int
+	LastRecNo  int
+}
+
+// WalkAncestors calls fn with each record hash descends from, nearest
+// first, until fn returns false or the logical begin of its component
+// is reached.
+func (state *graphState) WalkAncestors(hash gdp.Hash, fn func(hash gdp.Hash) bool) {
+	// Chains do not loop, but the walk is bounded in case one does
+	for steps := 0; steps < state.nodes.len(); steps++ {
+		prevHash, present := state.GetPrev(hash)
+		if !present || !state.HasNode(prevHash) {
+			return
+		}
+		if !fn(prevHash) {
+			return
+		}
+		hash = prevHash
+	}
+}
+
+// WalkDescendants calls fn with each record descending from hash,
+// breadth first. The walk does not go past the records for which fn
+// returns false.
+func (state *graphState) WalkDescendants(hash gdp.Hash, fn func(hash gdp.Hash) bool) {
+	queue := state.GetNext(hash)
+	for len(queue) > 0 {
+		next := make([]gdp.Hash, 0)
+		for _, child := range queue {
+			if fn(child) {
+				next = append(next, state.GetNext(child)...)
+			}
+		}
+		queue = next
+	}
+}
+
+// GetAncestors returns up to limit records hash descends from, nearest
+// first, or all of them if limit is not positive.
+func (state *graphState) GetAncestors(hash gdp.Hash, limit int) []gdp.Hash {
+	ancestors := make([]gdp.Hash, 0)
+	state.WalkAncestors(hash, func(ancestor gdp.Hash) bool {
+		ancestors = append(ancestors, ancestor)
+		return limit <= 0 || len(ancestors) < limit
+	})
+	return ancestors
+}
+
+// GetDescendants returns up to limit records descending from hash,
+// nearest first, or all of them if limit is not positive.
+func (state *graphState) GetDescendants(hash gdp.Hash, limit int) []gdp.Hash {
+	descendants := make([]gdp.Hash, 0)
+	state.WalkDescendants(hash, func(descendant gdp.Hash) bool {
+		if limit > 0 && len(descendants) >= limit {
+			return false
+		}
+		descendants = append(descendants, descendant)
+		return true
+	})
+	return descendants
+}
+
+// GetPath returns the records from ancestor to descendant, both
+// included, oldest first. It reports false if descendant does not
+// descend from ancestor.
+func (state *graphState) GetPath(ancestor gdp.Hash, descendant gdp.Hash) ([]gdp.Hash, bool) {
+	if !state.HasNode(ancestor) || !state.HasNode(descendant) {
+		return nil, false
+	}
+
+	path := []gdp.Hash{descendant}
+	found := ancestor == descendant
+	if !found {
+		state.WalkAncestors(descendant, func(hash gdp.Hash) bool {
+			path = append(path, hash)
+			found = hash == ancestor
+			return !found
+		})
+	}
+	if !found {
+		return nil, false
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, true
+}
+
+// GetComponent returns the records of the connected component holding
+// hash, each after its PrevHash, or nil if hash is not a node.
+func (state *graphState) GetComponent(hash gdp.Hash) []gdp.Hash {
+	if !state.HasNode(hash) {
+		return nil
+	}
+
+	begin := hash
+	state.WalkAncestors(hash, func(ancestor gdp.Hash) bool {
+		begin = ancestor
+		return true
+	})
+	return append([]gdp.Hash{begin}, state.GetDescendants(begin, 0)...)
+}
+
+// WalkTopological calls fn with every record, each after its PrevHash,
+// until fn returns false.
+func (state *graphState) WalkTopological(fn func(hash gdp.Hash) bool) {
+	queue := state.GetLogicalBegins()
+	for len(queue) > 0 {
+		next := make([]gdp.Hash, 0)
+		for _, hash := range queue {
+			if !fn(hash) {
+				return
+			}
+			next = append(next, state.GetNext(hash)...)
+		}
+		queue = next
+	}
+}
+
+// GetComponents returns a summary of each connected component.
+func (state *graphState) GetComponents() []ComponentSummary {
+	begins := state.GetLogicalBegins()
+	summaries := make([]ComponentSummary, 0, len(begins))
+	for _, begin := range begins {
+		follows, _ := state.GetPrev(begin)
+		summary := ComponentSummary{
+			Begin:      begin,
+			Follows:    follows,
+			Ends:       make([]gdp.Hash, 0),
+			FirstRecNo: state.recNo(begin),
+		}
+		summary.LastRecNo = summary.FirstRecNo
+
+		count := func(hash gdp.Hash) bool {
+			summary.NumNodes++
+			if recNo := state.recNo(hash); recNo > summary.LastRecNo {
+				summary.LastRecNo = recNo
+			}
+			if len(state.GetNext(hash)) == 0 {
+				summary.Ends = append(summary.Ends, hash)
+			}
+			return true
+		}
+		count(begin)
+		state.WalkDescendants(begin, count)
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// recNo returns the RecNo of the record hash, or 0 if it is not a
+// node.
+func (state *graphState) recNo(hash gdp.Hash) int {
+	recNo, present := state.nodes.get(hash)
+	if !present {
+		return 0
+	}
+	return recNo.(int)
+}
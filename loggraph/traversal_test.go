@@ -0,0 +1,161 @@
+package loggraph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+// traversalGraph returns a graph of two components: a0 <- ... <- a4
+// with b3 branching off a2, and c10 <- c11 <- c12 after a hole.
+func traversalGraph(t *testing.T) (*SimpleGraph, map[string]gdp.Hash) {
+	hashes := make(map[string]gdp.Hash)
+	records := make([]gdp.Record, 0)
+	add := func(name string, recNo int, prev gdp.Hash) {
+		hashes[name] = gdp.GenerateHash(name)
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{
+				Hash:     hashes[name],
+				RecNo:    recNo,
+				PrevHash: prev,
+			},
+		})
+	}
+
+	add("a0", 0, gdp.NullHash)
+	add("a1", 1, hashes["a0"])
+	add("a2", 2, hashes["a1"])
+	add("a3", 3, hashes["a2"])
+	add("a4", 4, hashes["a3"])
+	add("b3", 3, hashes["a2"])
+	hashes["hole"] = gdp.GenerateHash("hole")
+	add("c10", 10, hashes["hole"])
+	add("c11", 11, hashes["c10"])
+	add("c12", 12, hashes["c11"])
+
+	graph, err := NewSimpleGraph(logserver.NewMemoryServer())
+	assert.Nil(t, err)
+	assert.Nil(t, graph.WriteRecords(records))
+	return graph, hashes
+}
+
+func TestAncestorsAndDescendants(t *testing.T) {
+	graph, h := traversalGraph(t)
+
+	assert.Equal(t, []gdp.Hash{h["a3"], h["a2"], h["a1"], h["a0"]}, graph.GetAncestors(h["a4"], 0))
+	assert.Equal(t, []gdp.Hash{h["a3"], h["a2"]}, graph.GetAncestors(h["a4"], 2))
+	assert.Equal(t, []gdp.Hash{}, graph.GetAncestors(h["c10"], 0))
+	assert.Equal(t, []gdp.Hash{}, graph.GetAncestors(h["hole"], 0))
+
+	descendants := graph.GetDescendants(h["a2"], 0)
+	assert.Equal(t, 3, len(descendants))
+	assert.ElementsMatch(t, []gdp.Hash{h["a3"], h["b3"]}, descendants[:2])
+	assert.Equal(t, h["a4"], descendants[2])
+	assert.ElementsMatch(t, []gdp.Hash{h["a3"], h["b3"]}, graph.GetDescendants(h["a2"], 2))
+	assert.Equal(t, []gdp.Hash{h["c10"], h["c11"], h["c12"]}, graph.GetDescendants(h["hole"], 0))
+	assert.Equal(t, []gdp.Hash{}, graph.GetDescendants(h["a4"], 0))
+
+	// Walks go no further than fn lets them
+	walked := []gdp.Hash{}
+	graph.WalkDescendants(h["a1"], func(hash gdp.Hash) bool {
+		walked = append(walked, hash)
+		return hash != h["a3"]
+	})
+	assert.Equal(t, h["a2"], walked[0])
+	assert.ElementsMatch(t, []gdp.Hash{h["a2"], h["a3"], h["b3"]}, walked)
+}
+
+func TestGetPath(t *testing.T) {
+	graph, h := traversalGraph(t)
+
+	path, found := graph.GetPath(h["a1"], h["a4"])
+	assert.True(t, found)
+	assert.Equal(t, []gdp.Hash{h["a1"], h["a2"], h["a3"], h["a4"]}, path)
+
+	path, found = graph.GetPath(h["c11"], h["c11"])
+	assert.True(t, found)
+	assert.Equal(t, []gdp.Hash{h["c11"]}, path)
+
+	for _, pair := range [][2]string{{"a4", "a1"}, {"b3", "a4"}, {"a0", "c12"}, {"hole", "c10"}} {
+		_, found = graph.GetPath(h[pair[0]], h[pair[1]])
+		assert.False(t, found, pair)
+	}
+}
+
+func TestGetComponent(t *testing.T) {
+	graph, h := traversalGraph(t)
+
+	component := graph.GetComponent(h["b3"])
+	assert.Equal(t, h["a0"], component[0])
+	assert.ElementsMatch(
+		t,
+		[]gdp.Hash{h["a0"], h["a1"], h["a2"], h["a3"], h["a4"], h["b3"]},
+		component,
+	)
+	assert.Equal(t, []gdp.Hash{h["c10"], h["c11"], h["c12"]}, graph.GetComponent(h["c12"]))
+	assert.Nil(t, graph.GetComponent(h["hole"]))
+}
+
+func TestWalkTopological(t *testing.T) {
+	graph, _ := traversalGraph(t)
+
+	seen := make(map[gdp.Hash]bool)
+	graph.WalkTopological(func(hash gdp.Hash) bool {
+		prevHash, present := graph.GetPrev(hash)
+		if present && graph.HasNode(prevHash) {
+			assert.True(t, seen[prevHash])
+		}
+		assert.False(t, seen[hash])
+		seen[hash] = true
+		return true
+	})
+	assert.Equal(t, graph.GetNodeMap(), seen)
+
+	numWalked := 0
+	graph.WalkTopological(func(hash gdp.Hash) bool {
+		numWalked++
+		return numWalked < 3
+	})
+	assert.Equal(t, 3, numWalked)
+}
+
+func TestGetComponents(t *testing.T) {
+	graph, h := traversalGraph(t)
+
+	// Components stay as they were in a clone
+	clone, err := graph.CreateClone()
+	assert.Nil(t, err)
+	assert.Nil(t, graph.WriteTombstones([]gdp.Tombstone{{Hash: h["a0"]}}))
+
+	summaries := make(map[gdp.Hash]ComponentSummary)
+	for _, summary := range clone.GetComponents() {
+		summaries[summary.Begin] = summary
+	}
+	assert.Equal(t, 2, len(summaries))
+
+	a := summaries[h["a0"]]
+	assert.Equal(t, gdp.NullHash, a.Follows)
+	assert.ElementsMatch(t, []gdp.Hash{h["a4"], h["b3"]}, a.Ends)
+	assert.Equal(t, 6, a.NumNodes)
+	assert.Equal(t, 0, a.FirstRecNo)
+	assert.Equal(t, 4, a.LastRecNo)
+
+	assert.Equal(t, ComponentSummary{
+		Begin:      h["c10"],
+		Follows:    h["hole"],
+		Ends:       []gdp.Hash{h["c12"]},
+		NumNodes:   3,
+		FirstRecNo: 10,
+		LastRecNo:  12,
+	}, summaries[h["c10"]])
+
+	// Deleting a0 leaves a1 to begin the component
+	summaries = make(map[gdp.Hash]ComponentSummary)
+	for _, summary := range graph.GetComponents() {
+		summaries[summary.Begin] = summary
+	}
+	assert.Equal(t, h["a0"], summaries[h["a1"]].Follows)
+	assert.Equal(t, 5, summaries[h["a1"]].NumNodes)
+}
@@ -0,0 +1,41 @@
+package logserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestLogMetadata(t *testing.T) {
+	sqliteServer := NewSqliteServer(emptyDB(t))
+	assert.Nil(t, sqliteServer.Migrate())
+
+	for name, s := range map[string]LogServer{
+		"sqlite": sqliteServer,
+		"memory": NewMemoryServer(),
+	} {
+		stored, err := s.ReadLogMetadata()
+		assert.Nil(t, err, name)
+		assert.Nil(t, stored, name)
+
+		metadata := gdp.LogMetadata{
+			WriterKey: []byte("key"),
+			Created:   1,
+			Params:    map[string]string{"owner": "scott"},
+		}
+		assert.Nil(t, s.WriteLogMetadata(metadata), name)
+		assert.Nil(t, s.WriteLogMetadata(metadata), name)
+
+		stored, err = s.ReadLogMetadata()
+		assert.Nil(t, err, name)
+		assert.Equal(t, metadata, *stored, name)
+
+		// A log has one metadata record
+		other := gdp.LogMetadata{Created: 2}
+		assert.Equal(t, ErrLogMetadataConflict, s.WriteLogMetadata(other), name)
+		stored, err = s.ReadLogMetadata()
+		assert.Nil(t, err, name)
+		assert.Equal(t, metadata.Name(), stored.Name(), name)
+	}
+}
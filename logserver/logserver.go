@@ -1,6 +1,7 @@
 package logserver
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
@@ -16,4 +17,66 @@ type LogServer interface {
 	ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error)
 	ReadAllRecords() ([]gdp.Record, error)
 	WriteRecords(records []gdp.Record) error
+
+	// WriteNewRecords writes records like WriteRecords and returns
+	// those it stored, leaving out the ones stored already, including
+	// by other processes, or deleted
+	WriteNewRecords(records []gdp.Record) ([]gdp.Record, error)
+
+	// StreamMetadata hands the metadata of all records to fn in
+	// batches of at most StreamBatchSize, stopping at the first error
+	// fn returns
+	StreamMetadata(fn func(metadata []gdp.Metadatum) error) error
+
+	// StreamRecords hands all records to fn in batches of at most
+	// StreamBatchSize, stopping at the first error fn returns
+	StreamRecords(fn func(records []gdp.Record) error) error
+
+	// MetadataCursor returns a cursor after all records stored so far
+	MetadataCursor() (int64, error)
+
+	// ReadMetadataSince returns the metadata of at most
+	// StreamBatchSize records stored after cursor, including those
+	// written by other processes, and the cursor after them. The
+	// cursor 0 is before all records
+	ReadMetadataSince(cursor int64) ([]gdp.Metadatum, int64, error)
+
+	// ReadAllTombstones returns the tombstones of all deleted records
+	ReadAllTombstones() ([]gdp.Tombstone, error)
+
+	// WriteTombstones deletes the records of tombstones. Records with
+	// a tombstone are never written again
+	WriteTombstones(tombstones []gdp.Tombstone) error
+
+	// Prune deletes the records retention does not keep and returns
+	// their tombstones
+	Prune(retention Retention) ([]gdp.Tombstone, error)
+
+	// Expired returns the tombstones of the records retention does not
+	// keep, without deleting them
+	Expired(retention Retention) ([]gdp.Tombstone, error)
+
+	// Quarantine stores records kept out of the log. A record is kept
+	// once per source
+	Quarantine(records []QuarantinedRecord) error
+
+	// ReadQuarantine returns all quarantined records
+	ReadQuarantine() ([]QuarantinedRecord, error)
+
+	// ReadLogMetadata returns the metadata record of the log, or nil
+	// if it has none yet
+	ReadLogMetadata() (*gdp.LogMetadata, error)
+
+	// WriteLogMetadata stores the metadata record of the log. Writing
+	// the stored one again does nothing, and writing another one
+	// fails with ErrLogMetadataConflict
+	WriteLogMetadata(metadata gdp.LogMetadata) error
 }
+
+// ErrLogMetadataConflict is returned when a log is given a metadata
+// record other than its own.
+var ErrLogMetadataConflict = errors.New("log has another metadata record")
+
+// StreamBatchSize is the most records or metadata a LogServer hands to
+// a stream callback at once.
+const StreamBatchSize = 1024
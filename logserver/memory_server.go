@@ -0,0 +1,431 @@
+package logserver
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+// MemoryServer is a LogServer that keeps records in memory, e.g. for
+// tests, simulations and relays that only cache records. Like
+// SqliteServer, it ignores records whose hash it already holds and
+// returns records in the order they were written.
+type MemoryServer struct {
+	records []gdp.Record
+
+	// position of each record in records
+	index map[gdp.Hash]int
+
+	// sequence number of each record in records, increasing, and the
+	// number of records ever stored
+	seqs    []int64
+	written int64
+
+	tombstones []gdp.Tombstone
+	deleted    map[gdp.Hash]bool
+
+	quarantine []QuarantinedRecord
+
+	// sources each quarantined record was received from
+	quarantined map[gdp.Hash]map[gdp.Hash]bool
+
+	logMetadata *gdp.LogMetadata
+
+	mutex sync.RWMutex
+}
+
+func NewMemoryServer() *MemoryServer {
+	return &MemoryServer{
+		records:     make([]gdp.Record, 0),
+		index:       make(map[gdp.Hash]int),
+		tombstones:  make([]gdp.Tombstone, 0),
+		deleted:     make(map[gdp.Hash]bool),
+		quarantine:  make([]QuarantinedRecord, 0),
+		quarantined: make(map[gdp.Hash]map[gdp.Hash]bool),
+	}
+}
+
+// ReadMetadata retrieves the metadata of records with specified
+// hashes.
+func (s *MemoryServer) ReadMetadata(hashes []gdp.Hash) ([]gdp.Metadatum, error) {
+	records, err := s.ReadRecords(hashes)
+	if err != nil {
+		return nil, err
+	}
+	return metadataOf(records), nil
+}
+
+// ReadAllMetadata retrieves the metadata of all records.
+func (s *MemoryServer) ReadAllMetadata() ([]gdp.Metadatum, error) {
+	records, err := s.ReadAllRecords()
+	if err != nil {
+		return nil, err
+	}
+	return metadataOf(records), nil
+}
+
+// ReadRecords retrieves the records with specified hashes. Hashes
+// without a record are skipped.
+func (s *MemoryServer) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	positions := make([]int, 0, len(hashes))
+	seen := make(map[int]bool)
+	for _, hash := range hashes {
+		position, present := s.index[hash]
+		if present && !seen[position] {
+			seen[position] = true
+			positions = append(positions, position)
+		}
+	}
+	sort.Ints(positions)
+
+	var records []gdp.Record
+	for _, position := range positions {
+		records = append(records, copyRecord(s.records[position]))
+	}
+	return records, nil
+}
+
+// ReadAllRecords retrieves all records.
+func (s *MemoryServer) ReadAllRecords() ([]gdp.Record, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var records []gdp.Record
+	for _, record := range s.records {
+		records = append(records, copyRecord(record))
+	}
+	return records, nil
+}
+
+// WriteRecords stores all records whose hash is not stored yet and
+// has no tombstone.
+func (s *MemoryServer) WriteRecords(records []gdp.Record) error {
+	_, err := s.WriteNewRecords(records)
+	return err
+}
+
+// WriteNewRecords stores all records whose hash is not stored yet and
+// has no tombstone, and returns them.
+func (s *MemoryServer) WriteNewRecords(records []gdp.Record) ([]gdp.Record, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored := make([]gdp.Record, 0, len(records))
+	for _, record := range records {
+		if _, present := s.index[record.Hash]; present || s.deleted[record.Hash] {
+			continue
+		}
+		s.index[record.Hash] = len(s.records)
+		s.records = append(s.records, copyRecord(record))
+		s.written++
+		s.seqs = append(s.seqs, s.written)
+		stored = append(stored, record)
+	}
+
+	zap.S().Infow(
+		"Wrote records",
+		"numRecords", len(records),
+		"numStored", len(stored),
+	)
+
+	return stored, nil
+}
+
+// StreamMetadata hands the metadata of all records to fn in batches,
+// in the order they were written.
+func (s *MemoryServer) StreamMetadata(fn func(metadata []gdp.Metadatum) error) error {
+	return s.StreamRecords(func(records []gdp.Record) error {
+		return fn(metadataOf(records))
+	})
+}
+
+// StreamRecords hands all records to fn in batches, in the order they
+// were written. The server is not locked while fn runs, so fn may
+// write records; those written during the stream may be included, and
+// records after those deleted during the stream may be skipped.
+func (s *MemoryServer) StreamRecords(fn func(records []gdp.Record) error) error {
+	for start := 0; ; start += StreamBatchSize {
+		batch := s.batchFrom(start)
+		if len(batch) == 0 {
+			return nil
+		}
+		err := fn(batch)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// batchFrom copies up to StreamBatchSize records from position start.
+func (s *MemoryServer) batchFrom(start int) []gdp.Record {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if start >= len(s.records) {
+		return nil
+	}
+	end := start + StreamBatchSize
+	if end > len(s.records) {
+		end = len(s.records)
+	}
+
+	batch := make([]gdp.Record, 0, end-start)
+	for _, record := range s.records[start:end] {
+		batch = append(batch, copyRecord(record))
+	}
+	return batch
+}
+
+// MetadataCursor returns the number of records ever stored.
+func (s *MemoryServer) MetadataCursor() (int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.written, nil
+}
+
+// ReadMetadataSince retrieves the metadata of the records stored after
+// cursor, in the order they were written.
+func (s *MemoryServer) ReadMetadataSince(cursor int64) ([]gdp.Metadatum, int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	start := sort.Search(len(s.seqs), func(i int) bool {
+		return s.seqs[i] > cursor
+	})
+	end := start + StreamBatchSize
+	if end > len(s.records) {
+		end = len(s.records)
+	}
+	if start == end {
+		return nil, cursor, nil
+	}
+
+	var metadata []gdp.Metadatum
+	for _, record := range s.records[start:end] {
+		metadata = append(metadata, copyRecord(record).Metadatum)
+	}
+	return metadata, s.seqs[end-1], nil
+}
+
+// ReadAllTombstones retrieves all tombstones, in the order they were
+// written.
+func (s *MemoryServer) ReadAllTombstones() ([]gdp.Tombstone, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]gdp.Tombstone{}, s.tombstones...), nil
+}
+
+// WriteTombstones stores tombstones and deletes their records.
+func (s *MemoryServer) WriteTombstones(tombstones []gdp.Tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.writeTombstones(tombstones)
+	return nil
+}
+
+// Prune deletes the records retention does not keep and returns their
+// tombstones.
+func (s *MemoryServer) Prune(retention Retention) ([]gdp.Tombstone, error) {
+	if retention.IsZero() {
+		return nil, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tombstones := s.expired(retention)
+	s.writeTombstones(tombstones)
+	return tombstones, nil
+}
+
+// Expired returns the tombstones of the records retention does not
+// keep.
+func (s *MemoryServer) Expired(retention Retention) ([]gdp.Tombstone, error) {
+	if retention.IsZero() {
+		return nil, nil
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.expired(retention), nil
+}
+
+// expired returns the tombstones of the records retention does not
+// keep, newest records being kept first. The caller holds the lock.
+func (s *MemoryServer) expired(retention Retention) []gdp.Tombstone {
+	newestFirst := make([]gdp.Record, len(s.records))
+	copy(newestFirst, s.records)
+	sort.Slice(newestFirst, func(i, j int) bool {
+		a, b := newestFirst[i], newestFirst[j]
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp > b.Timestamp
+		}
+		if a.RecNo != b.RecNo {
+			return a.RecNo > b.RecNo
+		}
+		return bytes.Compare(a.Hash[:], b.Hash[:]) > 0
+	})
+
+	scan := newRetentionScan(retention, time.Now())
+	tombstones := make([]gdp.Tombstone, 0)
+	for _, record := range newestFirst {
+		if scan.prune(record.Timestamp, recordSize(record.Value, record.Sig)) {
+			tombstones = append(tombstones, gdp.Tombstone{
+				Hash:     record.Hash,
+				PrevHash: record.PrevHash,
+			})
+		}
+	}
+	return tombstones
+}
+
+// writeTombstones stores tombstones and deletes their records. The
+// caller holds the write lock.
+func (s *MemoryServer) writeTombstones(tombstones []gdp.Tombstone) {
+	for _, tombstone := range tombstones {
+		if s.deleted[tombstone.Hash] {
+			continue
+		}
+		s.deleted[tombstone.Hash] = true
+		s.tombstones = append(s.tombstones, tombstone)
+	}
+
+	// Records keep their order, so positions are reassigned
+	kept := make([]gdp.Record, 0, len(s.records))
+	keptSeqs := make([]int64, 0, len(s.seqs))
+	for i, record := range s.records {
+		if s.deleted[record.Hash] {
+			delete(s.index, record.Hash)
+			continue
+		}
+		s.index[record.Hash] = len(kept)
+		kept = append(kept, record)
+		keptSeqs = append(keptSeqs, s.seqs[i])
+	}
+	s.records = kept
+	s.seqs = keptSeqs
+
+	zap.S().Infow(
+		"Wrote tombstones",
+		"numTombstones", len(tombstones),
+	)
+}
+
+// Quarantine stores quarantined records, each once per source.
+func (s *MemoryServer) Quarantine(records []QuarantinedRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, record := range records {
+		sources := s.quarantined[record.Hash]
+		if sources == nil {
+			sources = make(map[gdp.Hash]bool)
+			s.quarantined[record.Hash] = sources
+		}
+		if sources[record.Source] {
+			continue
+		}
+		sources[record.Source] = true
+		record.Record = copyRecord(record.Record)
+		s.quarantine = append(s.quarantine, record)
+	}
+	return nil
+}
+
+// ReadQuarantine retrieves all quarantined records, in the order they
+// were quarantined.
+func (s *MemoryServer) ReadQuarantine() ([]QuarantinedRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	quarantined := make([]QuarantinedRecord, 0, len(s.quarantine))
+	for _, record := range s.quarantine {
+		record.Record = copyRecord(record.Record)
+		quarantined = append(quarantined, record)
+	}
+	return quarantined, nil
+}
+
+// ReadLogMetadata retrieves the metadata record of the log, if it has
+// one.
+func (s *MemoryServer) ReadLogMetadata() (*gdp.LogMetadata, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.logMetadata == nil {
+		return nil, nil
+	}
+	metadata := copyLogMetadata(*s.logMetadata)
+	return &metadata, nil
+}
+
+// WriteLogMetadata stores the metadata record of the log, unless it has
+// one.
+func (s *MemoryServer) WriteLogMetadata(metadata gdp.LogMetadata) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.logMetadata != nil {
+		if s.logMetadata.Name() != metadata.Name() {
+			return ErrLogMetadataConflict
+		}
+		return nil
+	}
+	metadata = copyLogMetadata(metadata)
+	s.logMetadata = &metadata
+	return nil
+}
+
+// copyLogMetadata copies a metadata record so that it shares no memory
+// with the original.
+func copyLogMetadata(metadata gdp.LogMetadata) gdp.LogMetadata {
+	if metadata.Params != nil {
+		params := make(map[string]string, len(metadata.Params))
+		for key, value := range metadata.Params {
+			params[key] = value
+		}
+		metadata.Params = params
+	}
+	metadata.WriterKey = append([]byte{}, metadata.WriterKey...)
+	return metadata
+}
+
+// copyRecord copies a record so that it shares no memory with the
+// original.
+func copyRecord(record gdp.Record) gdp.Record {
+	record.Value = append([]byte{}, record.Value...)
+	record.Sig = append([]byte{}, record.Sig...)
+	return record
+}
+
+// metadataOf returns the metadata of records.
+func metadataOf(records []gdp.Record) []gdp.Metadatum {
+	var metadata []gdp.Metadatum
+	for _, record := range records {
+		metadata = append(metadata, record.Metadatum)
+	}
+	return metadata
+}
@@ -0,0 +1,48 @@
+package logserver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestMemoryServer(t *testing.T) {
+	s := NewMemoryServer()
+
+	// logServerTest expects a log of five records
+	records := make([]gdp.Record, 0, 5)
+	prev := gdp.NullHash
+	for i := 1; i <= 5; i++ {
+		hash := gdp.GenerateHash(fmt.Sprintf("record-%d", i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{
+				Hash:     hash,
+				RecNo:    i,
+				PrevHash: prev,
+				Sig:      []byte{},
+			},
+			Value: []byte(fmt.Sprint(i)),
+		})
+		prev = hash
+	}
+	assert.Nil(t, s.WriteRecords(records))
+
+	logServerTest(t, s)
+}
+
+func TestMemoryServerCopies(t *testing.T) {
+	s := NewMemoryServer()
+	record := gdp.Record{
+		Metadatum: gdp.Metadatum{Hash: gdp.GenerateHash("a"), Sig: []byte{}},
+		Value:     []byte("value"),
+	}
+	assert.Nil(t, s.WriteRecords([]gdp.Record{record}))
+	record.Value[0] = 'V'
+
+	records, err := s.ReadRecords([]gdp.Hash{record.Hash, record.Hash})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, []byte("value"), records[0].Value)
+}
@@ -0,0 +1,18 @@
+package logserver
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// QuarantinedRecord is a record received from a peer and kept out of
+// the log because its writer signature is missing or wrong. It is
+// stored for inspection only, and never replicated.
+type QuarantinedRecord struct {
+	gdp.Record
+
+	// Source is the peer the record was received from
+	Source gdp.Hash
+
+	// Reason is why the record was quarantined
+	Reason string
+}
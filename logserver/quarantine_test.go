@@ -0,0 +1,40 @@
+package logserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestQuarantine(t *testing.T) {
+	sqliteServer := NewSqliteServer(emptyDB(t))
+	assert.Nil(t, sqliteServer.Migrate())
+
+	for name, s := range map[string]LogServer{
+		"sqlite": sqliteServer,
+		"memory": NewMemoryServer(),
+	} {
+		records := numberedRecords(2)
+		peerA, peerB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+		quarantined := []QuarantinedRecord{
+			{Record: records[0], Source: peerA, Reason: "unsigned"},
+			{Record: records[1], Source: peerA, Reason: "bad signature"},
+			{Record: records[0], Source: peerB, Reason: "unsigned"},
+		}
+
+		assert.Nil(t, s.Quarantine(quarantined), name)
+
+		// A record is kept once per source
+		assert.Nil(t, s.Quarantine(quarantined[:1]), name)
+
+		read, err := s.ReadQuarantine()
+		assert.Nil(t, err, name)
+		assert.ElementsMatch(t, quarantined, read, name)
+
+		// Quarantined records are not in the log
+		all, err := s.ReadAllRecords()
+		assert.Nil(t, err, name)
+		assert.Equal(t, 0, len(all), name)
+	}
+}
@@ -0,0 +1,59 @@
+package logserver
+
+import (
+	"time"
+)
+
+// Retention bounds the records a LogServer keeps. Records are pruned
+// oldest first, by Timestamp, then RecNo. A zero field bounds nothing.
+type Retention struct {
+	// MaxAge prunes records whose Timestamp, in Unix nanoseconds, is
+	// older than this
+	MaxAge time.Duration
+
+	// MaxRecords is the number of records kept
+	MaxRecords int
+
+	// MaxBytes bounds the total size of the values and signatures
+	// kept
+	MaxBytes int64
+}
+
+// IsZero reports whether retention bounds nothing.
+func (retention Retention) IsZero() bool {
+	return retention == Retention{}
+}
+
+// retentionScan decides which records to prune while visiting them
+// newest first.
+type retentionScan struct {
+	retention Retention
+	cutoff    int64
+
+	numRecords int
+	numBytes   int64
+}
+
+func newRetentionScan(retention Retention, now time.Time) *retentionScan {
+	return &retentionScan{
+		retention: retention,
+		cutoff:    now.Add(-retention.MaxAge).UnixNano(),
+	}
+}
+
+// prune reports whether the next record, of size bytes, is pruned.
+// Once one record is pruned for count or size, so are all older ones.
+func (scan *retentionScan) prune(timestamp int64, size int64) bool {
+	scan.numRecords++
+	scan.numBytes += size
+
+	retention := scan.retention
+	return (retention.MaxAge > 0 && timestamp < scan.cutoff) ||
+		(retention.MaxRecords > 0 && scan.numRecords > retention.MaxRecords) ||
+		(retention.MaxBytes > 0 && scan.numBytes > retention.MaxBytes)
+}
+
+// recordSize is the size of a record counted against MaxBytes.
+func recordSize(value []byte, sig []byte) int64 {
+	return int64(len(value) + len(sig))
+}
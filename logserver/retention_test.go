@@ -0,0 +1,130 @@
+package logserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// datedRecords returns n records of 10 bytes each, record i written i
+// hours ago.
+func datedRecords(n int) []gdp.Record {
+	now := time.Now()
+	records := make([]gdp.Record, 0, n)
+	prev := gdp.NullHash
+	for i := 0; i < n; i++ {
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{
+				Hash:      hash,
+				RecNo:     n - i,
+				Timestamp: now.Add(-time.Duration(i) * time.Hour).UnixNano(),
+				PrevHash:  prev,
+				Sig:       []byte("sig"),
+			},
+			Value: []byte("value12"),
+		})
+		prev = hash
+	}
+	return records
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		retention Retention
+		numKept   int
+	}{
+		{Retention{}, 10},
+		{Retention{MaxAge: 150 * time.Minute}, 3},
+		{Retention{MaxRecords: 4}, 4},
+		{Retention{MaxBytes: 55}, 5},
+		{Retention{MaxAge: 150 * time.Minute, MaxRecords: 2}, 2},
+	}
+
+	for _, test := range tests {
+		sqliteServer := NewSqliteServer(emptyDB(t))
+		assert.Nil(t, sqliteServer.Migrate())
+
+		for name, s := range map[string]LogServer{
+			"sqlite": sqliteServer,
+			"memory": NewMemoryServer(),
+		} {
+			records := datedRecords(10)
+			assert.Nil(t, s.WriteRecords(records), name)
+
+			// Expired lists the records Prune deletes, deleting none
+			expired, err := s.Expired(test.retention)
+			assert.Nil(t, err, name)
+			stored, err := s.ReadAllRecords()
+			assert.Nil(t, err, name)
+			assert.Equal(t, 10, len(stored), name)
+
+			tombstones, err := s.Prune(test.retention)
+			assert.Nil(t, err, name)
+			assert.Equal(t, 10-test.numKept, len(tombstones), name)
+			assert.ElementsMatch(t, expired, tombstones, name)
+
+			kept, err := s.ReadAllRecords()
+			assert.Nil(t, err, name)
+			assert.ElementsMatch(t, records[:test.numKept], kept, name)
+
+			// The oldest records are pruned, with their place in the chain
+			storedTombstones, err := s.ReadAllTombstones()
+			assert.Nil(t, err, name)
+			assert.Equal(t, len(tombstones), len(storedTombstones), name)
+			for _, tombstone := range storedTombstones {
+				i := indexOf(records, tombstone.Hash)
+				assert.True(t, i >= test.numKept, name)
+				assert.Equal(t, records[i].PrevHash, tombstone.PrevHash, name)
+			}
+
+			// Pruned records are not written again
+			assert.Nil(t, s.WriteRecords(records), name)
+			kept, err = s.ReadAllRecords()
+			assert.Nil(t, err, name)
+			assert.Equal(t, test.numKept, len(kept), name)
+		}
+	}
+}
+
+func TestWriteTombstones(t *testing.T) {
+	sqliteServer := NewSqliteServer(emptyDB(t))
+	assert.Nil(t, sqliteServer.Migrate())
+
+	for name, s := range map[string]LogServer{
+		"sqlite": sqliteServer,
+		"memory": NewMemoryServer(),
+	} {
+		records := datedRecords(3)
+		assert.Nil(t, s.WriteRecords(records[:2]), name)
+
+		// Tombstones may precede their records
+		tombstones := []gdp.Tombstone{
+			{Hash: records[1].Hash, PrevHash: records[1].PrevHash},
+			{Hash: records[2].Hash, PrevHash: records[2].PrevHash},
+		}
+		assert.Nil(t, s.WriteTombstones(tombstones), name)
+		assert.Nil(t, s.WriteTombstones(tombstones[:1]), name)
+		assert.Nil(t, s.WriteRecords(records), name)
+
+		kept, err := s.ReadAllRecords()
+		assert.Nil(t, err, name)
+		assert.Equal(t, records[:1], kept, name)
+
+		stored, err := s.ReadAllTombstones()
+		assert.Nil(t, err, name)
+		assert.ElementsMatch(t, tombstones, stored, name)
+	}
+}
+
+func indexOf(records []gdp.Record, hash gdp.Hash) int {
+	for i, record := range records {
+		if record.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
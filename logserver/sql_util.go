@@ -72,3 +72,90 @@ func parseMetadataRows(rows *sql.Rows) ([]gdp.Metadatum, error) {
 	}
 	return metadata, nil
 }
+
+// parseCursorMetadataRows parses sql rows of a sequence number followed
+// by the metadata columns into Record Metadata and the greatest sequence
+// number.
+func parseCursorMetadataRows(rows *sql.Rows) ([]gdp.Metadatum, int64, error) {
+	var seq int64
+	var lastSeq int64
+	var hashHolder []byte
+	var prevHashHolder []byte
+	var metadata []gdp.Metadatum
+
+	for rows.Next() {
+		metadatum := gdp.Metadatum{}
+		err := rows.Scan(
+			&seq,
+			&hashHolder,
+			&metadatum.RecNo,
+			&metadatum.Timestamp,
+			&metadatum.Accuracy,
+			&prevHashHolder,
+			&metadatum.Sig,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		copy(metadatum.Hash[:], hashHolder)
+		copy(metadatum.PrevHash[:], prevHashHolder)
+		if seq > lastSeq {
+			lastSeq = seq
+		}
+		metadata = append(metadata, metadatum)
+	}
+	return metadata, lastSeq, rows.Err()
+}
+
+// parseTombstoneRows parses sql rows into Tombstones.
+func parseTombstoneRows(rows *sql.Rows) ([]gdp.Tombstone, error) {
+	var hashHolder []byte
+	var prevHashHolder []byte
+	var tombstones []gdp.Tombstone
+
+	for rows.Next() {
+		err := rows.Scan(&hashHolder, &prevHashHolder)
+		if err != nil {
+			return nil, err
+		}
+
+		tombstone := gdp.Tombstone{}
+		copy(tombstone.Hash[:], hashHolder)
+		copy(tombstone.PrevHash[:], prevHashHolder)
+		tombstones = append(tombstones, tombstone)
+	}
+	return tombstones, rows.Err()
+}
+
+// parseQuarantineRows parses sql rows into QuarantinedRecords.
+func parseQuarantineRows(rows *sql.Rows) ([]QuarantinedRecord, error) {
+	var hashHolder []byte
+	var prevHashHolder []byte
+	var sourceHolder []byte
+	var quarantined []QuarantinedRecord
+
+	for rows.Next() {
+		record := QuarantinedRecord{}
+		err := rows.Scan(
+			&hashHolder,
+			&record.RecNo,
+			&record.Timestamp,
+			&record.Accuracy,
+			&prevHashHolder,
+			&record.Value,
+			&record.Sig,
+			&sourceHolder,
+			&record.Reason,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		copy(record.Hash[:], hashHolder)
+		copy(record.PrevHash[:], prevHashHolder)
+		copy(record.Source[:], sourceHolder)
+		quarantined = append(quarantined, record)
+	}
+	return quarantined, rows.Err()
+}
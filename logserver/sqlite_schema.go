@@ -0,0 +1,176 @@
+package logserver
+
+import (
+	"database/sql"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// migration brings the schema of a database from the previous version
+// to the next one.
+type migration struct {
+	description string
+	statements  []string
+}
+
+// migrations upgrade the schema of a database, in order. The schema
+// version of a database is the number of migrations applied to it, and
+// is kept in its user_version. New migrations must be appended; a
+// released migration must never change.
+var migrations = []migration{
+	{
+		// Databases created by benchmark/gdb_log_utils.py already
+		// have this table
+		description: "create log_entry",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS log_entry (
+				hash BLOB(32) PRIMARY KEY ON CONFLICT IGNORE,
+				recno INTEGER,
+				timestamp INTEGER,
+				accuracy FLOAT,
+				prevhash BLOB(32),
+				value BLOB,
+				sig BLOB
+			)`,
+		},
+	},
+	{
+		description: "create tombstone",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS tombstone (
+				hash BLOB(32) PRIMARY KEY ON CONFLICT IGNORE,
+				prevhash BLOB(32)
+			)`,
+		},
+	},
+	{
+		description: "create quarantine",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS quarantine (
+				hash BLOB(32),
+				recno INTEGER,
+				timestamp INTEGER,
+				accuracy FLOAT,
+				prevhash BLOB(32),
+				value BLOB,
+				sig BLOB,
+				source BLOB(32),
+				reason TEXT,
+				PRIMARY KEY (hash, source) ON CONFLICT IGNORE
+			)`,
+		},
+	},
+	{
+		// A log has at most one metadata record; params are JSON
+		description: "create log_metadata",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS log_metadata (
+				name BLOB(32) PRIMARY KEY,
+				writer_key BLOB,
+				created INTEGER,
+				params TEXT
+			)`,
+		},
+	},
+	{
+		// SQLite reuses the rowid of the newest row once it is deleted,
+		// so log_entry rowids cannot tell which records are new. Rows
+		// get a sequence number instead, which AUTOINCREMENT never
+		// reuses; the triggers also number rows written by other
+		// processes.
+		description: "create log_sequence",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS log_sequence (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				hash BLOB(32) UNIQUE
+			)`,
+			`INSERT OR IGNORE INTO log_sequence (hash)
+				SELECT hash FROM log_entry ORDER BY rowid`,
+			`CREATE TRIGGER IF NOT EXISTS log_sequence_insert
+				AFTER INSERT ON log_entry
+				BEGIN
+					INSERT OR REPLACE INTO log_sequence (hash) VALUES (NEW.hash);
+				END`,
+			`CREATE TRIGGER IF NOT EXISTS log_sequence_delete
+				AFTER DELETE ON log_entry
+				BEGIN
+					DELETE FROM log_sequence WHERE hash = OLD.hash;
+				END`,
+		},
+	},
+}
+
+// SchemaVersion is the schema version of databases migrated by this
+// package.
+var SchemaVersion = len(migrations)
+
+// Migrate creates the schema of the database if it is missing and
+// upgrades it to SchemaVersion.
+func (s *SqliteServer) Migrate() error {
+	return migrate(s.db, migrations)
+}
+
+// migrate applies the migrations the database has not had yet, each in
+// its own transaction.
+func migrate(db *sql.DB, migrations []migration) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf(
+			"database schema version %d is newer than supported version %d",
+			version,
+			len(migrations),
+		)
+	}
+
+	for ; version < len(migrations); version++ {
+		zap.S().Infow(
+			"Migrating database schema",
+			"version", version+1,
+			"description", migrations[version].description,
+		)
+		err = applyMigration(db, migrations[version], version+1)
+		if err != nil {
+			return fmt.Errorf(
+				"migration to schema version %d failed: %v",
+				version+1,
+				err,
+			)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the statements of m and sets the schema version
+// to version, atomically.
+func applyMigration(db *sql.DB, m migration, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	// PRAGMA does not accept parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// schemaVersion returns the schema version of the database.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
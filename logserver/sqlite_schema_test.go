@@ -0,0 +1,103 @@
+package logserver
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// emptyDB opens an empty in-memory database.
+func emptyDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+
+	// Every connection to :memory: opens a distinct database
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	db := emptyDB(t)
+	s := NewSqliteServer(db)
+	assert.Nil(t, s.Migrate())
+
+	version, err := schemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, version)
+
+	records := make([]gdp.Record, 0, 5)
+	for i := 0; i < 5; i++ {
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{
+				Hash: gdp.GenerateHash(fmt.Sprint(i)),
+				Sig:  []byte{},
+			},
+			Value: []byte{},
+		})
+	}
+	assert.Nil(t, s.WriteRecords(records))
+	logServerTest(t, s)
+
+	// Migrating again changes nothing
+	assert.Nil(t, s.Migrate())
+	all, err := s.ReadAllRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(all))
+}
+
+func TestMigrateInOrder(t *testing.T) {
+	db := emptyDB(t)
+	steps := []migration{
+		{"create", []string{"CREATE TABLE steps (n INTEGER)"}},
+		{"first", []string{"INSERT INTO steps VALUES (1)"}},
+	}
+	assert.Nil(t, migrate(db, steps))
+
+	steps = append(steps, migration{
+		"second", []string{"INSERT INTO steps VALUES (2)"},
+	})
+	assert.Nil(t, migrate(db, steps))
+
+	rows, err := db.Query("SELECT n FROM steps ORDER BY rowid")
+	assert.Nil(t, err)
+	applied := make([]int, 0)
+	for rows.Next() {
+		var n int
+		assert.Nil(t, rows.Scan(&n))
+		applied = append(applied, n)
+	}
+	rows.Close()
+	assert.Equal(t, []int{1, 2}, applied)
+
+	version, err := schemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, version)
+}
+
+func TestMigrateFailure(t *testing.T) {
+	db := emptyDB(t)
+	steps := []migration{
+		{"create", []string{"CREATE TABLE steps (n INTEGER)"}},
+		{"broken", []string{
+			"INSERT INTO steps VALUES (1)",
+			"INSERT INTO missing VALUES (1)",
+		}},
+	}
+	assert.NotNil(t, migrate(db, steps))
+
+	// The failed migration is rolled back entirely
+	version, err := schemaVersion(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+
+	var count int
+	assert.Nil(t, db.QueryRow("SELECT count(*) FROM steps").Scan(&count))
+	assert.Equal(t, 0, count)
+
+	// A database newer than the migrations is refused
+	assert.NotNil(t, migrate(db, steps[:0]))
+}
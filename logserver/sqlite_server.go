@@ -2,78 +2,182 @@ package logserver
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"go.uber.org/zap"
 )
 
+// sqliteMaxBatch is the most hashes looked up by a single query, below
+// the default SQLITE_MAX_VARIABLE_NUMBER of 999.
+const sqliteMaxBatch = 512
+
+const (
+	metadataColumns = "hash, recno, timestamp, accuracy, prevhash, sig"
+	recordColumns   = "hash, recno, timestamp, accuracy, prevhash, value, sig"
+)
+
 type SqliteServer struct {
 	db *sql.DB
+
+	// prepared lookups by columns and number of hashes
+	stmts map[string]*sql.Stmt
+	mutex sync.Mutex
 }
 
 func NewSqliteServer(db *sql.DB) *SqliteServer {
-	return &SqliteServer{db: db}
+	return &SqliteServer{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
 }
 
-// ReadRecords will retrieive the metadat of records with specified
+// ReadMetadata will retrieve the metadata of records with specified
 // hashes from the database.
 func (s *SqliteServer) ReadMetadata(hashes []gdp.Hash) ([]gdp.Metadatum, error) {
-	if len(hashes) == 0 {
-		return nil, nil
-	}
-
-	hexHashes := make([]string, 0, len(hashes))
-	for _, hash := range hashes {
-		hexHashes = append(hexHashes, fmt.Sprintf("\"%X\"", hash))
-	}
-
-	queryString := fmt.Sprintf(
-		"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE hex(hash) IN (%s)",
-		strings.Join(hexHashes, ","),
-	)
-	fmt.Println(queryString)
-	rows, err := s.db.Query(queryString)
+	var metadata []gdp.Metadatum
+	err := s.lookup(metadataColumns, hashes, func(rows *sql.Rows) error {
+		batch, err := parseMetadataRows(rows)
+		metadata = append(metadata, batch...)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	return parseMetadataRows(rows)
+	return metadata, nil
 }
 
 // ReadRecords will retrieive the records with specified hashes from
 // the database.
 func (s *SqliteServer) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
-	if len(hashes) == 0 {
-		return nil, nil
+	var records []gdp.Record
+	err := s.lookup(recordColumns, hashes, func(rows *sql.Rows) error {
+		batch, err := parseRecordRows(rows)
+		records = append(records, batch...)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return records, nil
+}
 
-	hexHashes := make([]string, 0, len(hashes))
-	for _, hash := range hashes {
-		hexHashes = append(hexHashes, fmt.Sprintf("\"%X\"", hash))
+// lookup selects columns of the rows with the specified hashes through
+// the primary key, in batches of at most sqliteMaxBatch hashes, and
+// hands the rows of each batch to parse.
+func (s *SqliteServer) lookup(
+	columns string,
+	hashes []gdp.Hash,
+	parse func(rows *sql.Rows) error,
+) error {
+	hashes = uniqueHashes(hashes)
+	for start := 0; start < len(hashes); start += sqliteMaxBatch {
+		end := start + sqliteMaxBatch
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		batch := hashes[start:end]
+
+		// Batches are padded with their last hash so that a few
+		// statements serve every batch size
+		size := lookupSize(len(batch))
+		stmt, err := s.lookupStmt(columns, size)
+		if err != nil {
+			return err
+		}
+
+		args := make([]interface{}, size)
+		for i := range args {
+			if i < len(batch) {
+				args[i] = batch[i][:]
+			} else {
+				args[i] = batch[len(batch)-1][:]
+			}
+		}
+
+		rows, err := stmt.Query(args...)
+		if err != nil {
+			return err
+		}
+		err = parse(rows)
+		rows.Close()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	queryString := fmt.Sprintf(
-		"SELECT hash, recno, timestamp, accuracy, prevhash, value, sig FROM log_entry WHERE hex(hash) IN (%s)",
-		strings.Join(hexHashes, ","),
-	)
-	rows, err := s.db.Query(queryString)
-	if err != nil {
-		return nil, err
+// lookupSize returns the smallest power of two no smaller than
+// numHashes.
+func lookupSize(numHashes int) int {
+	size := 1
+	for size < numHashes {
+		size *= 2
+	}
+	return size
+}
+
+// lookupStmt returns the prepared statement selecting columns of the
+// rows with size hashes.
+func (s *SqliteServer) lookupStmt(columns string, size int) (*sql.Stmt, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := fmt.Sprintf("%s/%d", columns, size)
+	if stmt, present := s.stmts[key]; present {
+		return stmt, nil
 	}
 
-	records, err := parseRecordRows(rows)
+	stmt, err := s.db.Prepare(fmt.Sprintf(
+		"SELECT %s FROM log_entry WHERE hash IN (?%s)",
+		columns,
+		strings.Repeat(", ?", size-1),
+	))
 	if err != nil {
 		return nil, err
 	}
+	s.stmts[key] = stmt
+	return stmt, nil
+}
 
-	return records, nil
+// Close closes the prepared statements of s. The database belongs to
+// the caller and stays open; s prepares statements again if used.
+func (s *SqliteServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var firstErr error
+	for key, stmt := range s.stmts {
+		err := stmt.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.stmts, key)
+	}
+	return firstErr
+}
+
+// uniqueHashes returns hashes without duplicates, in order.
+func uniqueHashes(hashes []gdp.Hash) []gdp.Hash {
+	seen := make(map[gdp.Hash]bool, len(hashes))
+	unique := make([]gdp.Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+	return unique
 }
 
 // ReadAllRecords will retrieve all records from the database.
 func (s *SqliteServer) ReadAllMetadata() ([]gdp.Metadatum, error) {
-	queryString := "SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry"
+	queryString := "SELECT " + metadataColumns + " FROM log_entry"
 
 	rows, err := s.db.Query(queryString)
 	if err != nil {
@@ -90,7 +194,7 @@ func (s *SqliteServer) ReadAllMetadata() ([]gdp.Metadatum, error) {
 
 // ReadAllRecords will retrieve all records from the database.
 func (s *SqliteServer) ReadAllRecords() ([]gdp.Record, error) {
-	queryString := "SELECT hash, recno, timestamp, accuracy, prevhash, value, sig FROM log_entry"
+	queryString := "SELECT " + recordColumns + " FROM log_entry"
 
 	rows, err := s.db.Query(queryString)
 	if err != nil {
@@ -105,8 +209,286 @@ func (s *SqliteServer) ReadAllRecords() ([]gdp.Record, error) {
 	return records, nil
 }
 
+// StreamMetadata hands the metadata of all records to fn in batches,
+// in hash order. No query is open while fn runs, so fn may use the
+// database.
+func (s *SqliteServer) StreamMetadata(fn func(metadata []gdp.Metadatum) error) error {
+	return s.stream(metadataColumns, func(rows *sql.Rows) (gdp.Hash, int, error) {
+		metadata, err := parseMetadataRows(rows)
+		if err != nil || len(metadata) == 0 {
+			return gdp.NullHash, 0, err
+		}
+		return metadata[len(metadata)-1].Hash, len(metadata), fn(metadata)
+	})
+}
+
+// StreamRecords hands all records to fn in batches, in hash order. No
+// query is open while fn runs, so fn may use the database.
+func (s *SqliteServer) StreamRecords(fn func(records []gdp.Record) error) error {
+	return s.stream(recordColumns, func(rows *sql.Rows) (gdp.Hash, int, error) {
+		records, err := parseRecordRows(rows)
+		if err != nil || len(records) == 0 {
+			return gdp.NullHash, 0, err
+		}
+		return records[len(records)-1].Hash, len(records), fn(records)
+	})
+}
+
+// stream selects columns of all rows through the primary key,
+// StreamBatchSize rows at a time, and hands the rows of each batch to
+// handle, which returns the last hash and the number of rows it read.
+// Each batch resumes after the last hash of the previous one.
+func (s *SqliteServer) stream(
+	columns string,
+	handle func(rows *sql.Rows) (gdp.Hash, int, error),
+) error {
+	stmt, err := s.db.Prepare(fmt.Sprintf(
+		"SELECT %s FROM log_entry WHERE hash > ? ORDER BY hash LIMIT ?",
+		columns,
+	))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// Every hash sorts after the empty blob
+	after := []byte{}
+	for {
+		rows, err := stmt.Query(after, StreamBatchSize)
+		if err != nil {
+			return err
+		}
+		last, numRows, err := handle(rows)
+		rows.Close()
+		if err != nil || numRows < StreamBatchSize {
+			return err
+		}
+		after = last[:]
+	}
+}
+
+// MetadataCursor returns the greatest sequence number ever given to a
+// log entry.
+func (s *SqliteServer) MetadataCursor() (int64, error) {
+	var cursor int64
+	err := s.db.QueryRow(
+		"SELECT ifnull((SELECT seq FROM sqlite_sequence WHERE name = 'log_sequence'), 0)",
+	).Scan(&cursor)
+	return cursor, err
+}
+
+// ReadMetadataSince will retrieve the metadata of the records whose
+// sequence number follows cursor, in sequence order. Sequence numbers
+// increase and are never reused, even after deletes, so these are the
+// records stored after the cursor. A cursor beyond the latest sequence
+// number comes from another database, which is read from the start.
+func (s *SqliteServer) ReadMetadataSince(cursor int64) ([]gdp.Metadatum, int64, error) {
+	latest, err := s.MetadataCursor()
+	if err != nil {
+		return nil, 0, err
+	}
+	if latest < cursor {
+		cursor = 0
+	}
+
+	rows, err := s.db.Query(
+		"SELECT seq, "+metadataColumns+" FROM log_sequence JOIN log_entry USING (hash) WHERE seq > ? ORDER BY seq LIMIT ?",
+		cursor,
+		StreamBatchSize,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	metadata, last, err := parseCursorMetadataRows(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(metadata) == 0 {
+		return nil, cursor, nil
+	}
+	return metadata, last, nil
+}
+
 // WriteRecords will write all records to the database.
 func (s *SqliteServer) WriteRecords(records []gdp.Record) error {
+	_, err := s.WriteNewRecords(records)
+	return err
+}
+
+// WriteNewRecords will write all records to the database and return
+// those it stored. Records already stored, by this server or another
+// process, are ignored by the database.
+func (s *SqliteServer) WriteNewRecords(records []gdp.Record) ([]gdp.Record, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Deleted records stay deleted
+	stmt, err := tx.Prepare("INSERT INTO log_entry (hash, recno, timestamp, accuracy, prevhash, value, sig) SELECT ?, ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM tombstone WHERE hash = ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	stored := make([]gdp.Record, 0, len(records))
+	for _, record := range records {
+		result, err := stmt.Exec(
+			record.Hash[:],
+			record.RecNo,
+			record.Timestamp,
+			record.Accuracy,
+			record.PrevHash[:],
+			record.Value,
+			record.Sig,
+			record.Hash[:],
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		numRows, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if numRows > 0 {
+			stored = append(stored, record)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	zap.S().Infow(
+		"Wrote records",
+		"numRecords", len(records),
+		"numStored", len(stored),
+	)
+
+	return stored, nil
+}
+
+// ReadAllTombstones will retrieve all tombstones from the database.
+func (s *SqliteServer) ReadAllTombstones() ([]gdp.Tombstone, error) {
+	rows, err := s.db.Query("SELECT hash, prevhash FROM tombstone")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return parseTombstoneRows(rows)
+}
+
+// WriteTombstones will write all tombstones to the database and
+// delete their records.
+func (s *SqliteServer) WriteTombstones(tombstones []gdp.Tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insertStmt, err := tx.Prepare("INSERT INTO tombstone (hash, prevhash) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insertStmt.Close()
+
+	deleteStmt, err := tx.Prepare("DELETE FROM log_entry WHERE hash = ?")
+	if err != nil {
+		return err
+	}
+	defer deleteStmt.Close()
+
+	for _, tombstone := range tombstones {
+		_, err = insertStmt.Exec(tombstone.Hash[:], tombstone.PrevHash[:])
+		if err != nil {
+			return err
+		}
+		_, err = deleteStmt.Exec(tombstone.Hash[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	zap.S().Infow(
+		"Wrote tombstones",
+		"numTombstones", len(tombstones),
+	)
+	return nil
+}
+
+// Prune will delete the records retention does not keep, newest
+// records being kept first, and return their tombstones.
+func (s *SqliteServer) Prune(retention Retention) ([]gdp.Tombstone, error) {
+	tombstones, err := s.Expired(retention)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.WriteTombstones(tombstones)
+	if err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// Expired will return the tombstones of the records retention does
+// not keep, newest records being kept first.
+func (s *SqliteServer) Expired(retention Retention) ([]gdp.Tombstone, error) {
+	if retention.IsZero() {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query(
+		"SELECT hash, prevhash, timestamp, ifnull(length(value), 0) + ifnull(length(sig), 0) FROM log_entry ORDER BY timestamp DESC, recno DESC, hash DESC",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scan := newRetentionScan(retention, time.Now())
+	tombstones := make([]gdp.Tombstone, 0)
+	for rows.Next() {
+		var hashHolder []byte
+		var prevHashHolder []byte
+		var timestamp int64
+		var size int64
+		err = rows.Scan(&hashHolder, &prevHashHolder, &timestamp, &size)
+		if err != nil {
+			return nil, err
+		}
+
+		if scan.prune(timestamp, size) {
+			tombstone := gdp.Tombstone{}
+			copy(tombstone.Hash[:], hashHolder)
+			copy(tombstone.PrevHash[:], prevHashHolder)
+			tombstones = append(tombstones, tombstone)
+		}
+	}
+	return tombstones, rows.Err()
+}
+
+// Quarantine will write all quarantined records to the database.
+func (s *SqliteServer) Quarantine(records []QuarantinedRecord) error {
 	if len(records) == 0 {
 		return nil
 	}
@@ -117,7 +499,7 @@ func (s *SqliteServer) WriteRecords(records []gdp.Record) error {
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("INSERT INTO log_entry (hash, recno, timestamp, accuracy, prevhash, value, sig) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT INTO quarantine (" + recordColumns + ", source, reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -131,11 +513,12 @@ func (s *SqliteServer) WriteRecords(records []gdp.Record) error {
 			record.PrevHash[:],
 			record.Value,
 			record.Sig,
+			record.Source[:],
+			record.Reason,
 		)
 		if err != nil {
 			return err
 		}
-
 	}
 
 	err = tx.Commit()
@@ -144,9 +527,98 @@ func (s *SqliteServer) WriteRecords(records []gdp.Record) error {
 	}
 
 	zap.S().Infow(
-		"Wrote records",
+		"Quarantined records",
 		"numRecords", len(records),
 	)
+	return nil
+}
+
+// ReadQuarantine will retrieve all quarantined records from the
+// database.
+func (s *SqliteServer) ReadQuarantine() ([]QuarantinedRecord, error) {
+	rows, err := s.db.Query("SELECT " + recordColumns + ", source, reason FROM quarantine")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return parseQuarantineRows(rows)
+}
+
+// ReadLogMetadata will retrieve the metadata record of the log from
+// the database, if it has one.
+func (s *SqliteServer) ReadLogMetadata() (*gdp.LogMetadata, error) {
+	return readLogMetadata(s.db)
+}
+
+// readLogMetadata retrieves the metadata record of the log through q.
+func readLogMetadata(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (*gdp.LogMetadata, error) {
+	metadata := &gdp.LogMetadata{}
+	var params string
+	err := q.QueryRow(
+		"SELECT writer_key, created, params FROM log_metadata",
+	).Scan(&metadata.WriterKey, &metadata.Created, &params)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(params), &metadata.Params)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// WriteLogMetadata will write the metadata record of the log to the
+// database, unless it has one.
+func (s *SqliteServer) WriteLogMetadata(metadata gdp.LogMetadata) error {
+	params, err := json.Marshal(metadata.Params)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := readLogMetadata(tx)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		if stored.Name() != metadata.Name() {
+			return ErrLogMetadataConflict
+		}
+		return nil
+	}
+
+	name := metadata.Name()
+	_, err = tx.Exec(
+		"INSERT INTO log_metadata (name, writer_key, created, params) VALUES (?, ?, ?, ?)",
+		name[:],
+		metadata.WriterKey,
+		metadata.Created,
+		string(params),
+	)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
 
+	zap.S().Infow(
+		"Wrote log metadata",
+		"log", name.Readable(),
+	)
 	return nil
 }
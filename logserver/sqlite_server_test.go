@@ -2,7 +2,13 @@ package logserver
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -25,7 +31,8 @@ func logServerTest(t *testing.T, logServer LogServer) {
 	testMetadataReading(t, logServer)
 	testRecordReading(t, logServer)
 	testWriting(t, logServer)
-
+	testDuplicateWriting(t, logServer)
+	testStreaming(t, logServer)
 }
 
 func testRecordReading(t *testing.T, logServer LogServer) {
@@ -94,3 +101,309 @@ func testWriting(t *testing.T, logServer LogServer) {
 	assert.Nil(t, err)
 	assert.Equal(t, numRecords+2, len(metadata))
 }
+
+func testDuplicateWriting(t *testing.T, logServer LogServer) {
+	records, err := logServer.ReadAllRecords()
+	assert.Nil(t, err)
+	numRecords := len(records)
+
+	duplicate := records[0]
+	duplicate.Value = []byte("different value")
+	assert.Nil(t, logServer.WriteRecords([]gdp.Record{duplicate}))
+
+	records, err = logServer.ReadAllRecords()
+	assert.Nil(t, err)
+	assert.Equal(t, numRecords, len(records))
+	assert.NotEqual(t, duplicate.Value, records[0].Value)
+}
+
+func testStreaming(t *testing.T, logServer LogServer) {
+	records, err := logServer.ReadAllRecords()
+	assert.Nil(t, err)
+
+	streamed := make([]gdp.Record, 0)
+	err = logServer.StreamRecords(func(batch []gdp.Record) error {
+		streamed = append(streamed, batch...)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, records, streamed)
+
+	metadata := make([]gdp.Metadatum, 0)
+	err = logServer.StreamMetadata(func(batch []gdp.Metadatum) error {
+		metadata = append(metadata, batch...)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, metadataOf(records), metadata)
+}
+
+func TestStreamLargeLog(t *testing.T) {
+	sqliteServer := NewSqliteServer(emptyDB(t))
+	assert.Nil(t, sqliteServer.Migrate())
+
+	for name, s := range map[string]LogServer{
+		"sqlite": sqliteServer,
+		"memory": NewMemoryServer(),
+	} {
+		numRecords := 2*StreamBatchSize + 10
+		assert.Nil(t, s.WriteRecords(numberedRecords(numRecords)), name)
+
+		seen := make(map[gdp.Hash]bool)
+		numBatches := 0
+		err := s.StreamMetadata(func(metadata []gdp.Metadatum) error {
+			assert.True(t, len(metadata) <= StreamBatchSize, name)
+			for _, metadatum := range metadata {
+				seen[metadatum.Hash] = true
+			}
+			numBatches++
+			return nil
+		})
+		assert.Nil(t, err, name)
+		assert.Equal(t, numRecords, len(seen), name)
+		assert.Equal(t, 3, numBatches, name)
+
+		// The first error stops the stream
+		stop := errors.New("stop")
+		numBatches = 0
+		err = s.StreamRecords(func(records []gdp.Record) error {
+			numBatches++
+			return stop
+		})
+		assert.Equal(t, stop, err, name)
+		assert.Equal(t, 1, numBatches, name)
+	}
+}
+
+// numberedRecords returns n records with distinct hashes.
+func numberedRecords(n int) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	for i := 0; i < n; i++ {
+		records = append(records, gdp.Record{
+			Metadatum: gdp.Metadatum{
+				Hash:  gdp.GenerateHash(fmt.Sprint(i)),
+				RecNo: i,
+				Sig:   []byte{},
+			},
+			Value: []byte{},
+		})
+	}
+	return records
+}
+
+func hashesOf(records []gdp.Record) []gdp.Hash {
+	hashes := make([]gdp.Hash, 0, len(records))
+	for _, record := range records {
+		hashes = append(hashes, record.Hash)
+	}
+	return hashes
+}
+
+func TestSqliteBatchedReads(t *testing.T) {
+	s := NewSqliteServer(emptyDB(t))
+	assert.Nil(t, s.Migrate())
+
+	records := numberedRecords(3 * sqliteMaxBatch)
+	assert.Nil(t, s.WriteRecords(records))
+
+	// More hashes than fit in one statement, with duplicates and a
+	// hash that is not stored
+	hashes := hashesOf(records[:2*sqliteMaxBatch+1])
+	hashes = append(hashes, hashes[:10]...)
+	hashes = append(hashes, gdp.GenerateHash("missing"))
+
+	read, err := s.ReadRecords(hashes)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*sqliteMaxBatch+1, len(read))
+
+	metadata, err := s.ReadMetadata(hashes)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*sqliteMaxBatch+1, len(metadata))
+
+	for _, n := range []int{1, 3, sqliteMaxBatch - 1} {
+		read, err = s.ReadRecords(hashesOf(records[:n]))
+		assert.Nil(t, err)
+		assert.Equal(t, n, len(read))
+	}
+
+	// Closing releases the statements, which reads prepare again
+	assert.True(t, len(s.stmts) > 0)
+	assert.Nil(t, s.Close())
+	assert.Equal(t, 0, len(s.stmts))
+	read, err = s.ReadRecords(hashesOf(records[:3]))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(read))
+}
+
+const benchmarkRecords = 100000
+
+// benchmarkServer returns a SqliteServer over a file holding
+// benchmarkRecords records.
+func benchmarkServer(b *testing.B) (*SqliteServer, []gdp.Hash) {
+	dir, err := ioutil.TempDir("", "gdp-replicate")
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	s := NewSqliteServer(db)
+	err = s.Migrate()
+	if err != nil {
+		b.Fatal(err)
+	}
+	records := numberedRecords(benchmarkRecords)
+	err = s.WriteRecords(records)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return s, hashesOf(records)
+}
+
+// readRecordsByHex reads records the way SqliteServer used to, by the
+// hex of their hashes, for comparison.
+func readRecordsByHex(s *SqliteServer, hashes []gdp.Hash) ([]gdp.Record, error) {
+	hexHashes := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		hexHashes = append(hexHashes, fmt.Sprintf("\"%X\"", hash))
+	}
+	rows, err := s.db.Query(fmt.Sprintf(
+		"SELECT %s FROM log_entry WHERE hex(hash) IN (%s)",
+		recordColumns,
+		strings.Join(hexHashes, ","),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return parseRecordRows(rows)
+}
+
+func benchmarkReads(
+	b *testing.B,
+	numHashes int,
+	read func(s *SqliteServer, hashes []gdp.Hash) ([]gdp.Record, error),
+) {
+	s, hashes := benchmarkServer(b)
+	rng := rand.New(rand.NewSource(0))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wanted := make([]gdp.Hash, 0, numHashes)
+		for j := 0; j < numHashes; j++ {
+			wanted = append(wanted, hashes[rng.Intn(len(hashes))])
+		}
+		_, err := read(s, wanted)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSqliteReadRecords10(b *testing.B) {
+	benchmarkReads(b, 10, (*SqliteServer).ReadRecords)
+}
+
+func BenchmarkSqliteReadRecords900(b *testing.B) {
+	benchmarkReads(b, 900, (*SqliteServer).ReadRecords)
+}
+
+func BenchmarkSqliteReadRecords10000(b *testing.B) {
+	benchmarkReads(b, 10000, (*SqliteServer).ReadRecords)
+}
+
+func BenchmarkSqliteReadRecordsByHex10(b *testing.B) {
+	benchmarkReads(b, 10, readRecordsByHex)
+}
+
+func BenchmarkSqliteReadRecordsByHex900(b *testing.B) {
+	benchmarkReads(b, 900, readRecordsByHex)
+}
+
+func TestReadMetadataSince(t *testing.T) {
+	sqliteServer := NewSqliteServer(emptyDB(t))
+	assert.Nil(t, sqliteServer.Migrate())
+
+	for name, s := range map[string]LogServer{
+		"sqlite": sqliteServer,
+		"memory": NewMemoryServer(),
+	} {
+		records := numberedRecords(StreamBatchSize + 10)
+		assert.Nil(t, s.WriteRecords(records[:3]), name)
+		cursor, err := s.MetadataCursor()
+		assert.Nil(t, err, name)
+
+		// Records stored after the cursor are read in batches
+		assert.Nil(t, s.WriteRecords(records), name)
+		metadata, cursor, err := s.ReadMetadataSince(cursor)
+		assert.Nil(t, err, name)
+		assert.Equal(t, metadataOf(records[3:StreamBatchSize+3]), metadata, name)
+		metadata, cursor, err = s.ReadMetadataSince(cursor)
+		assert.Nil(t, err, name)
+		assert.Equal(t, metadataOf(records[StreamBatchSize+3:]), metadata, name)
+
+		latest, err := s.MetadataCursor()
+		assert.Nil(t, err, name)
+		assert.Equal(t, latest, cursor, name)
+		metadata, next, err := s.ReadMetadataSince(cursor)
+		assert.Nil(t, err, name)
+		assert.Equal(t, 0, len(metadata), name)
+		assert.Equal(t, cursor, next, name)
+	}
+}
+
+func TestSqliteExternalWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdp-replicate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	dbFile := filepath.Join(dir, "log.glob")
+	db, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	defer db.Close()
+	s := NewSqliteServer(db)
+	assert.Nil(t, s.Migrate())
+
+	// Another process appends and wipes rows, like benchmark/writer.py
+	writer, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	defer writer.Close()
+	insert := func(record gdp.Record) {
+		_, err := writer.Exec(
+			"INSERT INTO log_entry VALUES (?, ?, ?, ?, ?, ?, ?)",
+			record.Hash[:], record.RecNo, record.Timestamp, record.Accuracy,
+			record.PrevHash[:], record.Value, record.Sig,
+		)
+		assert.Nil(t, err)
+	}
+
+	records := numberedRecords(5)
+	assert.Nil(t, s.WriteRecords(records[:2]))
+	cursor, err := s.MetadataCursor()
+	assert.Nil(t, err)
+
+	insert(records[2])
+	metadata, cursor, err := s.ReadMetadataSince(cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, metadataOf(records[2:3]), metadata)
+
+	// Deleting the newest row does not hide the next one
+	assert.Nil(t, s.WriteTombstones([]gdp.Tombstone{{Hash: records[2].Hash}}))
+	insert(records[3])
+	metadata, cursor, err = s.ReadMetadataSince(cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, metadataOf(records[3:4]), metadata)
+
+	// Nor does wiping the log
+	_, err = writer.Exec("DELETE FROM log_entry")
+	assert.Nil(t, err)
+	insert(records[4])
+	metadata, _, err = s.ReadMetadataSince(cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, metadataOf(records[4:]), metadata)
+}
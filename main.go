@@ -1,19 +1,26 @@
 package main
 
 import (
+	"crypto"
 	"crypto/sha256"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tonyyanga/gdp-replicate/daemon"
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/hooks"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/policy"
 	"go.uber.org/zap"
 )
 
 func main() {
 	if len(os.Args) < 4 {
-		panic("Requires arguments: SQL file, listen address, peer address, fanout degree [optional:naive]")
+		panic("Requires arguments: SQL file or log directory, listen address, peer address, fanout degree [optional:naive|merkle|bloom|iblt|adaptive] [optional:bidirectional|push|pull]")
 	}
 
 	sqlFile := os.Args[1]
@@ -29,9 +36,38 @@ func main() {
 		panic("unable to parse fanout degree")
 	}
 
+	var opts daemon.Options
+	if len(os.Args) >= 7 {
+		opts.Mode, err = policy.ParseMode(os.Args[6])
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var dispatchers []*hooks.Dispatcher
+	opts.Hooks, dispatchers, err = hooksFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
+	opts.Retention, err = retentionFromEnv()
+	if err != nil {
+		panic(err)
+	}
+
 	var d *daemon.Daemon
-	if len(os.Args) >= 6 && os.Args[5] == "naive" {
-		d, err = daemon.NewDaemon(listenAddr, sqlFile, selfGDPAddr, peerMap, "naive")
+	if len(os.Args) >= 6 && isSupportedPolicy(os.Args[5]) {
+		info, statErr := os.Stat(sqlFile)
+		if statErr == nil && info.IsDir() {
+			d, err = daemon.NewLogDirDaemon(listenAddr, sqlFile, selfGDPAddr, peerMap, os.Args[5], opts)
+		} else {
+			opts.WriterKeys, err = writerKeysFromEnv()
+			if err != nil {
+				panic(err)
+			}
+			opts.AdoptLogMetadata = os.Getenv("GDP_ADOPT_LOG_METADATA") != ""
+			d, err = daemon.NewDaemonWithOptions(listenAddr, sqlFile, selfGDPAddr, peerMap, os.Args[5], opts)
+		}
 	} else {
 		panic("Regular daemon not supported rn")
 	}
@@ -41,12 +77,111 @@ func main() {
 	}
 
 	err = d.Start(fanoutDegree)
+	d.Close()
+
+	// The logs are closed, so no more events are queued
+	for _, dispatcher := range dispatchers {
+		dispatcher.Close()
+	}
 	if err != nil {
 		panic(err)
 	}
 
 }
 
+// isSupportedPolicy reports whether the daemon can be started with
+// policyType from the command line.
+func isSupportedPolicy(policyType string) bool {
+	switch policyType {
+	case "naive", "merkle", "bloom", "iblt", "adaptive":
+		return true
+	}
+	return false
+}
+
+// hooksFromEnv builds the record hooks configured in the environment,
+// and the dispatchers to close on shutdown: GDP_HOOK_EXEC runs a
+// command, GDP_HOOK_URL posts to a webhook and GDP_HOOK_SOCKET streams
+// to clients of a Unix socket.
+func hooksFromEnv() ([]func(log gdp.Hash) loggraph.Hook, []*hooks.Dispatcher, error) {
+	var dispatchers []*hooks.Dispatcher
+
+	if command := strings.Fields(os.Getenv("GDP_HOOK_EXEC")); len(command) > 0 {
+		sink := hooks.NewExecSink(command[0], command[1:]...)
+		dispatchers = append(dispatchers, hooks.NewDispatcher("exec", sink))
+	}
+
+	if url := os.Getenv("GDP_HOOK_URL"); url != "" {
+		sink := hooks.NewWebhookSink(url)
+		dispatchers = append(dispatchers, hooks.NewDispatcher("webhook", sink))
+	}
+
+	if path := os.Getenv("GDP_HOOK_SOCKET"); path != "" {
+		sink, err := hooks.NewSocketSink(path)
+		if err != nil {
+			return nil, dispatchers, err
+		}
+		dispatchers = append(dispatchers, hooks.NewDispatcher("socket", sink))
+	}
+
+	recordHooks := make([]func(log gdp.Hash) loggraph.Hook, 0, len(dispatchers))
+	for _, dispatcher := range dispatchers {
+		recordHooks = append(recordHooks, dispatcher.HookFor)
+	}
+	return recordHooks, dispatchers, nil
+}
+
+// retentionFromEnv builds the retention of the log configured in the
+// environment: GDP_RETENTION_AGE is a duration such as "72h",
+// GDP_RETENTION_RECORDS a number of records and GDP_RETENTION_BYTES a
+// number of bytes.
+func retentionFromEnv() (logserver.Retention, error) {
+	var retention logserver.Retention
+	var err error
+
+	if age := os.Getenv("GDP_RETENTION_AGE"); age != "" {
+		retention.MaxAge, err = time.ParseDuration(age)
+		if err != nil {
+			return retention, err
+		}
+	}
+
+	if numRecords := os.Getenv("GDP_RETENTION_RECORDS"); numRecords != "" {
+		retention.MaxRecords, err = strconv.Atoi(numRecords)
+		if err != nil {
+			return retention, err
+		}
+	}
+
+	if numBytes := os.Getenv("GDP_RETENTION_BYTES"); numBytes != "" {
+		retention.MaxBytes, err = strconv.ParseInt(numBytes, 10, 64)
+		if err != nil {
+			return retention, err
+		}
+	}
+
+	return retention, nil
+}
+
+// writerKeysFromEnv reads the writer key of the log of a daemon started
+// on a single file from the PEM file named by GDP_WRITER_KEY.
+func writerKeysFromEnv() (map[gdp.Hash]crypto.PublicKey, error) {
+	keyFile := os.Getenv("GDP_WRITER_KEY")
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := gdp.ParseWriterKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return map[gdp.Hash]crypto.PublicKey{daemon.DefaultLogName: key}, nil
+}
+
 // parsePeers parses a comma delimited string of IP:ports to a map from
 // GDP addr to IP addr.
 func parsePeers(peers string) map[gdp.Hash]string {
@@ -34,7 +34,7 @@ func NewGobServer(addr gdp.Hash, peerAddrs map[gdp.Hash]string) *GobServer {
 // the handler asynchronously.
 func (server *GobServer) ListenAndServe(
 	address string,
-	handler func(src gdp.Hash, msg interface{}),
+	handler func(src gdp.Hash, log gdp.Hash, msg interface{}),
 ) error {
 	zap.S().Infow(
 		"Starting server",
@@ -65,6 +65,13 @@ func (server *GobServer) ListenAndServe(
 			dec := gob.NewDecoder(conn)
 			gob.Register(&policy.NaiveMsgContent{})
 			gob.Register(&policy.GraphMsgContent{})
+			gob.Register(&policy.MerkleMsgContent{})
+			gob.Register(&policy.BloomMsgContent{})
+			gob.Register(&policy.IBLTMsgContent{})
+			gob.Register(&policy.AdaptiveMsgContent{})
+			gob.Register(&policy.TombstoneMsgContent{})
+			gob.Register(&policy.LogMetadataMsgContent{})
+			gob.Register(&UnknownLog{})
 			msg := &Message{}
 			err := dec.Decode(msg)
 			if err != nil {
@@ -74,15 +81,21 @@ func (server *GobServer) ListenAndServe(
 				)
 				return
 			}
-			handler(msg.Sender, msg.Content)
+			zap.S().Debugw(
+				"Decoded msg",
+				"sender", msg.Sender.Readable(),
+				"log", msg.Log.Readable(),
+				"session", msg.Session,
+			)
+			handler(msg.Sender, msg.Log, msg.Content)
 		}(conn)
 	}
 }
 
-// Send sends content to a peer.
+// Send sends content about log to a peer.
 // Any type can be used for content, as long as the handler of the
 // receiver is expecting that type.
-func (server *GobServer) Send(peer gdp.Hash, content interface{}) error {
+func (server *GobServer) Send(peer gdp.Hash, log gdp.Hash, content interface{}) error {
 	ipAddr, present := server.peerAddrs[peer]
 	if !present {
 		zap.S().Errorw(
@@ -100,19 +113,33 @@ func (server *GobServer) Send(peer gdp.Hash, content interface{}) error {
 
 	msg := Message{
 		Sender:  server.Addr,
+		Log:     log,
 		Content: content,
 	}
+	if sessionMsg, ok := content.(policy.SessionMessage); ok {
+		msg.Session = sessionMsg.GetSession()
+	}
 
 	encoder := gob.NewEncoder(conn)
 	gob.Register(&policy.NaiveMsgContent{})
 	gob.Register(&policy.GraphMsgContent{})
+	gob.Register(&policy.MerkleMsgContent{})
+	gob.Register(&policy.BloomMsgContent{})
+	gob.Register(&policy.IBLTMsgContent{})
+	gob.Register(&policy.AdaptiveMsgContent{})
+	gob.Register(&policy.TombstoneMsgContent{})
+	gob.Register(&policy.LogMetadataMsgContent{})
+	gob.Register(&UnknownLog{})
 
 	return encoder.Encode(msg)
 }
 
 // Message is the wrapper for communication between peers.
-// Messages contain the identifciation of the sender.
+// Messages contain the identifciation of the sender, of the log and of
+// the conversation the content belongs to, if any.
 type Message struct {
 	Sender  gdp.Hash
+	Log     gdp.Hash
+	Session policy.SessionID
 	Content interface{}
 }
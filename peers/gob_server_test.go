@@ -19,13 +19,17 @@ func TestGobServer(t *testing.T) {
 	server := NewGobServer(gdp.NullHash, peerAddrs)
 
 	var receivedMsg string
+	var receivedLog gdp.Hash
+	logName := gdp.GenerateHash("log")
 
-	go server.ListenAndServe(serverAddr, func(src gdp.Hash, msg interface{}) {
+	go server.ListenAndServe(serverAddr, func(src gdp.Hash, log gdp.Hash, msg interface{}) {
 		fmt.Println("from src", src.Readable(), "content", msg.(string))
 		receivedMsg = msg.(string)
+		receivedLog = log
 	})
-	assert.Nil(t, server.Send(gdp.NullHash, "hello there"))
+	assert.Nil(t, server.Send(gdp.NullHash, logName, "hello there"))
 	time.Sleep(1 * time.Millisecond)
 	assert.Equal(t, "hello there", receivedMsg)
+	assert.Equal(t, logName, receivedLog)
 	fmt.Println("Finishing test")
 }
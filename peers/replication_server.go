@@ -2,10 +2,16 @@ package peers
 
 import "github.com/tonyyanga/gdp-replicate/gdp"
 
+// ReplicationServer carries the messages of every log replicated by a
+// daemon. Each message is tagged with the name of its log.
 type ReplicationServer interface {
 	ListenAndServe(
 		address string,
-		handler func(src gdp.Hash, msg interface{}),
+		handler func(src gdp.Hash, log gdp.Hash, msg interface{}),
 	) error
-	Send(peer gdp.Hash, msg interface{}) error
+	Send(peer gdp.Hash, log gdp.Hash, msg interface{}) error
 }
+
+// UnknownLog is sent in reply to a message for a log the receiver does
+// not replicate, so that the sender stops sending heartbeats for it.
+type UnknownLog struct{}
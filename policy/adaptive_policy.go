@@ -0,0 +1,273 @@
+package policy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
+
+var errAdaptiveMsgContentConversion = errors.New(
+	"Unable to cast packedMsg to *AdaptiveMsgContent",
+)
+
+// Choice is the policy an AdaptivePolicy runs a conversation with.
+type Choice int
+
+const (
+	// NaiveChoice runs the conversation with NaivePolicy
+	NaiveChoice Choice = iota
+
+	// GraphDiffChoice runs the conversation with GraphDiffPolicy
+	GraphDiffChoice
+)
+
+func (choice Choice) String() string {
+	switch choice {
+	case NaiveChoice:
+		return "naive"
+	case GraphDiffChoice:
+		return "graphDiff"
+	}
+	return "unknown"
+}
+
+// Parameters of the cost model of AdaptivePolicy.
+const (
+	// Logs with fewer nodes always use the naive policy, whose
+	// conversations take fewer messages
+	adaptiveMinNodes = 64
+
+	// Weight of the latest conversations in the recent difference
+	// size of a peer, out of 1
+	adaptiveDiffWeight = 0.25
+)
+
+// AdaptivePolicy is a Policy that runs each conversation with either
+// NaivePolicy or GraphDiffPolicy, whichever it expects to be cheaper
+// with the peer. The initiator makes the choice and announces it in
+// the first message; the receiver follows it.
+//
+// Costs are estimated in hashes sent. The naive policy sends every
+// hash of the log plus the hashes of the missing records. The
+// graph-diff policy sends the logical begins and ends of both peers,
+// and every record that differs may add a begin and an end to the
+// graph of the peer. Graph-diff thus wins on long chains with few
+// differences, and naive on small or fragmented logs.
+type AdaptivePolicy struct {
+	graph     loggraph.LogGraph
+	naive     *NaivePolicy
+	graphDiff *GraphDiffPolicy
+
+	// moving average of the records exchanged per conversation
+	recentDiffs map[gdp.Hash]float64
+
+	// records exchanged with each peer since its last conversation
+	// was opened
+	exchanged map[gdp.Hash]int
+
+	mutex sync.Mutex
+}
+
+// AdaptiveMsgContent wraps the message of the chosen policy.
+type AdaptiveMsgContent struct {
+	Num     int
+	Session SessionID
+	Choice  Choice
+
+	// exactly one of Naive and Graph is set, according to Choice
+	Naive *NaiveMsgContent
+	Graph *GraphMsgContent
+}
+
+// NewAdaptivePolicy constructs an AdaptivePolicy over graph.
+func NewAdaptivePolicy(graph loggraph.LogGraph) *AdaptivePolicy {
+	return &AdaptivePolicy{
+		graph:       graph,
+		naive:       NewNaivePolicy(graph),
+		graphDiff:   NewGraphDiffPolicy(graph),
+		recentDiffs: make(map[gdp.Hash]float64),
+		exchanged:   make(map[gdp.Hash]int),
+	}
+}
+
+// GenerateMessage opens a conversation with dest using the policy
+// expected to be cheaper.
+func (policy *AdaptivePolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	choice := policy.choose(dest)
+
+	var inner interface{}
+	var err error
+	switch choice {
+	case NaiveChoice:
+		inner, err = policy.naive.GenerateMessage(dest)
+	case GraphDiffChoice:
+		inner, err = policy.graphDiff.GenerateMessage(dest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy.wrap(dest, choice, inner), nil
+}
+
+// ProcessMessage hands a message to the policy chosen by the initiator
+// of its conversation.
+func (policy *AdaptivePolicy) ProcessMessage(
+	src gdp.Hash,
+	packedMsg interface{},
+) (interface{}, error) {
+	msg, ok := packedMsg.(*AdaptiveMsgContent)
+	if !ok {
+		return nil, errAdaptiveMsgContentConversion
+	}
+
+	var inner interface{}
+	var err error
+	switch {
+	case msg.Choice == NaiveChoice && msg.Naive != nil:
+		policy.countRecords(src, len(msg.Naive.RecordsWeWant))
+		inner, err = policy.naive.ProcessMessage(src, msg.Naive)
+	case msg.Choice == GraphDiffChoice && msg.Graph != nil:
+		policy.countRecords(src, len(msg.Graph.RecordsNotInRX))
+		inner, err = policy.graphDiff.ProcessMessage(src, msg.Graph)
+	default:
+		return nil, errUnknownMessageType
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy.wrap(src, msg.Choice, inner), nil
+}
+
+// wrap wraps the message inner of the policy choice for peer.
+func (policy *AdaptivePolicy) wrap(
+	peer gdp.Hash,
+	choice Choice,
+	inner interface{},
+) interface{} {
+	switch inner := inner.(type) {
+	case *NaiveMsgContent:
+		if inner == nil {
+			return nil
+		}
+		policy.countRecords(peer, len(inner.RecordsWeWant))
+		return &AdaptiveMsgContent{
+			Num:     inner.MsgNum,
+			Session: inner.Session,
+			Choice:  choice,
+			Naive:   inner,
+		}
+	case *GraphMsgContent:
+		if inner == nil {
+			return nil
+		}
+		policy.countRecords(peer, len(inner.RecordsNotInRX))
+		return &AdaptiveMsgContent{
+			Num:     inner.Num,
+			Session: inner.Session,
+			Choice:  choice,
+			Graph:   inner,
+		}
+	}
+	return nil
+}
+
+// choose picks the policy for a new conversation with peer.
+func (policy *AdaptivePolicy) choose(peer gdp.Hash) Choice {
+	numNodes := policy.graph.NumNodes()
+	numBeginsEnds := len(policy.graph.GetLogicalBegins()) +
+		len(policy.graph.GetLogicalEnds())
+	diff := int(policy.recentDiff(peer))
+
+	naiveCost := numNodes + diff
+	graphDiffCost := 2*numBeginsEnds + 2*diff
+
+	choice := GraphDiffChoice
+	if numNodes < adaptiveMinNodes || naiveCost <= graphDiffCost {
+		choice = NaiveChoice
+	}
+
+	zap.S().Infow(
+		"Chose policy for conversation",
+		"peer", peer.Readable(),
+		"choice", choice.String(),
+		"numNodes", numNodes,
+		"numBeginsEnds", numBeginsEnds,
+		"recentDiff", diff,
+	)
+	return choice
+}
+
+// recentDiff folds the records exchanged with peer since its last
+// conversation was opened into the moving average, and returns it.
+func (policy *AdaptivePolicy) recentDiff(peer gdp.Hash) float64 {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	exchanged, present := policy.exchanged[peer]
+	if present {
+		policy.recentDiffs[peer] = (1-adaptiveDiffWeight)*policy.recentDiffs[peer] +
+			adaptiveDiffWeight*float64(exchanged)
+		delete(policy.exchanged, peer)
+	}
+	return policy.recentDiffs[peer]
+}
+
+// countRecords adds records exchanged with peer.
+func (policy *AdaptivePolicy) countRecords(peer gdp.Hash, numRecords int) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	policy.exchanged[peer] += numRecords
+}
+
+// SetMode sets the replication mode of both policies.
+func (policy *AdaptivePolicy) SetMode(mode Mode) {
+	policy.naive.SetMode(mode)
+	policy.graphDiff.SetMode(mode)
+}
+
+// SetPeerMode sets the replication mode of both policies with peer.
+func (policy *AdaptivePolicy) SetPeerMode(peer gdp.Hash, mode Mode) {
+	policy.naive.SetPeerMode(peer, mode)
+	policy.graphDiff.SetPeerMode(peer, mode)
+}
+
+// SetMaxPayload bounds the payload of graph-diff conversations. Naive
+// conversations are bounded by a number of records instead.
+func (policy *AdaptivePolicy) SetMaxPayload(bytes int) {
+	policy.graphDiff.SetMaxPayload(bytes)
+}
+
+// SetConversationTimeout sets how long both policies wait for a reply.
+func (policy *AdaptivePolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.naive.SetConversationTimeout(timeout)
+	policy.graphDiff.SetConversationTimeout(timeout)
+}
+
+// ExpireConversations resets the conversations of both policies with
+// peers that have not replied in time and returns those peers.
+func (policy *AdaptivePolicy) ExpireConversations() []gdp.Hash {
+	seen := make(map[gdp.Hash]bool)
+	expired := make([]gdp.Hash, 0)
+	peers := append(
+		policy.naive.ExpireConversations(),
+		policy.graphDiff.ExpireConversations()...,
+	)
+	for _, peer := range peers {
+		if !seen[peer] {
+			seen[peer] = true
+			expired = append(expired, peer)
+		}
+	}
+	return expired
+}
+
+// SetAddress sets the address of the local daemon in both policies.
+func (policy *AdaptivePolicy) SetAddress(addr gdp.Hash) {
+	policy.naive.SetAddress(addr)
+	policy.graphDiff.SetAddress(addr)
+}
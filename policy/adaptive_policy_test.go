@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// fragments returns n records that each follow a different missing
+// record.
+func fragments(name string, n int) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	for i := 0; i < n; i++ {
+		missing := gdp.GenerateHash(fmt.Sprintf("%s-missing-%d", name, i))
+		records = append(records, chain(fmt.Sprintf("%s-%d", name, i), 1, missing)...)
+	}
+	return records
+}
+
+func TestAdaptivePolicy(t *testing.T) {
+	long := chain("long", 200, gdp.NullHash)
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	testCases := []struct {
+		name       string
+		recordsA   []gdp.Record
+		recordsB   []gdp.Record
+		recentDiff float64
+		choice     Choice
+	}{
+		{"small", long[:20], long[:10], 0, NaiveChoice},
+		{"chain", long, long[:150], 0, GraphDiffChoice},
+		{"fragmented", fragments("a", 100), fragments("b", 50), 0, NaiveChoice},
+		{"largeDiffs", long, long[:150], 1000, NaiveChoice},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			graphA := graphFromRecords(t, testCase.recordsA)
+			graphB := graphFromRecords(t, testCase.recordsB)
+			policyA := NewAdaptivePolicy(graphA)
+			policyB := NewAdaptivePolicy(graphB)
+			policyA.recentDiffs[addrB] = testCase.recentDiff
+
+			msg, err := policyA.GenerateMessage(addrB)
+			assert.Nil(t, err)
+			content := msg.(*AdaptiveMsgContent)
+			assert.Equal(t, testCase.choice, content.Choice)
+			assert.Equal(t, first, content.Num)
+
+			// B follows the choice announced by A
+			resp, err := policyB.ProcessMessage(addrA, msg)
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.choice, resp.(*AdaptiveMsgContent).Choice)
+
+			for i := 0; i < 3; i++ {
+				converse(t, policyA, addrA, policyB, addrB)
+			}
+			assertSameNodes(t, graphA, graphB)
+		})
+	}
+}
+
+func TestAdaptiveRecentDiff(t *testing.T) {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	graphA := graphFromRecords(t, chain("a", 100, gdp.NullHash))
+	graphB := graphFromRecords(t, chain("b", 20, gdp.NullHash))
+	policyA := NewAdaptivePolicy(graphA)
+	policyB := NewAdaptivePolicy(graphB)
+
+	converse(t, policyA, addrA, policyB, addrB)
+	assertSameNodes(t, graphA, graphB)
+
+	// The records exchanged count towards the next conversation only
+	assert.Equal(t, 0.0, policyA.recentDiffs[addrB])
+	policyA.GenerateMessage(addrB)
+	assert.Equal(t, 120*adaptiveDiffWeight, policyA.recentDiffs[addrB])
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Bounds on the shape of filters, which peers choose. Filters at the
+// bounds have a negligible false positive rate for billions of hashes.
+const (
+	bloomMaxHashes = 32
+	bloomMaxBits   = 1 << 36
+)
+
+// BloomFilter is a Bloom filter over hashes. Positions are derived by
+// double hashing a salted digest of each hash, so filters built with
+// different salts have independent false positives.
+type BloomFilter struct {
+	Bits      []uint64
+	NumBits   uint64
+	NumHashes int
+	Salt      uint64
+}
+
+// newBloomFilter sizes a filter for numItems hashes with a false
+// positive rate of about fpRate.
+func newBloomFilter(numItems int, fpRate float64, salt uint64) *BloomFilter {
+	if numItems < 1 {
+		numItems = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultBloomFalsePositiveRate
+	}
+
+	n := float64(numItems)
+	numBits := uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if numBits < 64 {
+		numBits = 64
+	}
+	if numBits > bloomMaxBits {
+		numBits = bloomMaxBits
+	}
+	numHashes := int(math.Round(float64(numBits) / n * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	}
+	if numHashes > bloomMaxHashes {
+		numHashes = bloomMaxHashes
+	}
+
+	return &BloomFilter{
+		Bits:      make([]uint64, (numBits+63)/64),
+		NumBits:   numBits,
+		NumHashes: numHashes,
+		Salt:      salt,
+	}
+}
+
+// valid reports whether the filter, e.g. sent by a peer, has a shape
+// newBloomFilter could have built.
+func (filter *BloomFilter) valid() bool {
+	return filter.NumHashes >= 1 &&
+		filter.NumHashes <= bloomMaxHashes &&
+		filter.NumBits >= 64 &&
+		filter.NumBits <= bloomMaxBits &&
+		uint64(len(filter.Bits)) == (filter.NumBits+63)/64
+}
+
+// add inserts hash into the filter.
+func (filter *BloomFilter) add(hash gdp.Hash) {
+	h1, h2 := filter.baseHashes(hash)
+	for i := 0; i < filter.NumHashes; i++ {
+		pos := (h1 + uint64(i)*h2) % filter.NumBits
+		filter.Bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+// contains reports whether hash may have been added to the filter.
+// An invalid filter contains nothing.
+func (filter *BloomFilter) contains(hash gdp.Hash) bool {
+	if !filter.valid() {
+		return false
+	}
+
+	h1, h2 := filter.baseHashes(hash)
+	for i := 0; i < filter.NumHashes; i++ {
+		pos := (h1 + uint64(i)*h2) % filter.NumBits
+		if filter.Bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// baseHashes returns the two hashes used to derive bit positions.
+func (filter *BloomFilter) baseHashes(hash gdp.Hash) (uint64, uint64) {
+	var salt [8]byte
+	binary.LittleEndian.PutUint64(salt[:], filter.Salt)
+
+	hasher := sha256.New()
+	hasher.Write(salt[:])
+	hasher.Write(hash[:])
+	digest := hasher.Sum(nil)
+
+	h1 := binary.LittleEndian.Uint64(digest[0:8])
+	h2 := binary.LittleEndian.Uint64(digest[8:16]) | 1
+	return h1, h2
+}
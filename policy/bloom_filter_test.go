@@ -0,0 +1,37 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestBloomFilter(t *testing.T) {
+	numItems := 1000
+	filter := newBloomFilter(numItems, 0.01, 7)
+	for i := 0; i < numItems; i++ {
+		filter.add(gdp.GenerateHash(fmt.Sprintf("in-%d", i)))
+	}
+
+	for i := 0; i < numItems; i++ {
+		assert.True(t, filter.contains(gdp.GenerateHash(fmt.Sprintf("in-%d", i))))
+	}
+
+	falsePositives := 0
+	for i := 0; i < numItems; i++ {
+		if filter.contains(gdp.GenerateHash(fmt.Sprintf("out-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 30, "%d false positives", falsePositives)
+
+	// A filter this small cannot represent many items
+	assert.Equal(t, uint64(64), newBloomFilter(1, 0.5, 0).NumBits)
+	assert.False(t, (&BloomFilter{}).contains(gdp.NullHash))
+
+	// Filters are bounded whatever the rate asked for
+	assert.True(t, newBloomFilter(numItems, 1e-300, 0).valid())
+	assert.True(t, filter.valid())
+}
@@ -0,0 +1,244 @@
+package policy
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
+
+// DefaultBloomFalsePositiveRate is the false positive rate the daemon
+// uses for Bloom filter digests.
+const DefaultBloomFalsePositiveRate = 0.01
+
+var (
+	errBloomMsgContentConversion = errors.New(
+		"Unable to cast packedMsg to *BloomMsgContent",
+	)
+	errBloomFilterInvalid = errors.New("Bloom filter has an invalid shape")
+)
+
+// BloomPolicy is a Policy that exchanges Bloom filters of the node
+// sets of two peers instead of every hash. Each peer sends the records
+// the filter of the other says it lacks.
+//
+// A record hidden by a false positive in the first round is found by a
+// second round of filters built with fresh salts:
+//
+//  1. A -> B: filter of A
+//  2. B -> A: records missing from A's filter, filter of B
+//  3. A -> B: records missing from B's filter, second filter of A
+//  4. B -> A: records missing from A's second filter, second filter of B
+//  5. A -> B: records missing from B's second filter
+type BloomPolicy struct {
+	conversationDeadlines
+	tieBreaker
+
+	graph  loggraph.LogGraph
+	fpRate float64
+
+	// last message exchanged in each conversation in progress
+	peerStates map[session]PeerState
+
+	mutex sync.Mutex
+}
+
+// BloomMsgContent holds all communication info for Bloom policy peers.
+// All fields are labelled from the perspective of the sender.
+type BloomMsgContent struct {
+	Num            int
+	Session        SessionID
+	Filter         *BloomFilter
+	RecordsNotInRX []gdp.Record
+}
+
+// NewBloomPolicy constructs a BloomPolicy whose filters have a false
+// positive rate of about fpRate.
+func NewBloomPolicy(graph loggraph.LogGraph, fpRate float64) *BloomPolicy {
+	return &BloomPolicy{
+		graph:      graph,
+		fpRate:     fpRate,
+		peerStates: make(map[session]PeerState),
+	}
+}
+
+// GenerateMessage opens a conversation with dest by sending a filter
+// of the local node set.
+func (policy *BloomPolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{dest, newSessionID()}
+	policy.setPeerState(s, firstMsgSent)
+
+	zap.S().Infow("Generate first bloom msg")
+	return &BloomMsgContent{
+		Num:     first,
+		Session: s.id,
+		Filter:  policy.buildFilter(),
+	}, nil
+}
+
+// bloomExpectedStates maps each message number to the state a peer
+// must be in to accept it.
+var bloomExpectedStates = map[int]PeerState{
+	first:  noMsgExchanged,
+	second: firstMsgSent,
+	third:  firstMsgRecved,
+	fourth: thirdMsgSent,
+	fifth:  thirdMsgRecved,
+}
+
+// ProcessMessage stores the records in a message from src and answers
+// its filter.
+func (policy *BloomPolicy) ProcessMessage(
+	src gdp.Hash,
+	packedMsg interface{},
+) (interface{}, error) {
+	zap.S().Debugw(
+		"processing message",
+		"src", src.Readable(),
+	)
+
+	msg, ok := packedMsg.(*BloomMsgContent)
+	if !ok {
+		return nil, errBloomMsgContentConversion
+	}
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{src, msg.Session}
+	expected, ok := bloomExpectedStates[msg.Num]
+	if !ok {
+		return nil, errUnknownMessageType
+	}
+	if policy.expire(s) {
+		delete(policy.peerStates, s)
+	}
+
+	// Both peers opened this conversation at the same time
+	if msg.Num == first {
+		err := policy.breakTie(s, policy.peerStates[s] == firstMsgSent, policy.endConversation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	peerState := policy.peerStates[s]
+
+	if peerState != expected {
+		policy.endConversation(s)
+		zap.S().Errorw(
+			"inconsistent state and msg",
+			"peerStatus", peerState,
+			"msgNum", msg.Num,
+		)
+		return nil, errInconsistentStateAndMessage
+	}
+
+	err := policy.graph.WriteRecordsFrom(src, msg.RecordsNotInRX)
+	if err != nil {
+		policy.endConversation(s)
+		return nil, err
+	}
+
+	if msg.Num == fifth {
+		policy.endConversation(s)
+		return nil, ErrConversationFinished
+	}
+
+	records, err := policy.recordsMissingFrom(src, msg.Filter)
+	if err != nil {
+		policy.endConversation(s)
+		return nil, err
+	}
+
+	resp := &BloomMsgContent{
+		Num:            msg.Num + 1,
+		Session:        s.id,
+		RecordsNotInRX: records,
+	}
+
+	switch msg.Num {
+	case first:
+		resp.Filter = policy.buildFilter()
+		policy.setPeerState(s, firstMsgRecved)
+	case second:
+		resp.Filter = policy.buildFilter()
+		policy.setPeerState(s, thirdMsgSent)
+	case third:
+		resp.Filter = policy.buildFilter()
+		policy.setPeerState(s, thirdMsgRecved)
+	case fourth:
+		policy.endConversation(s)
+	}
+
+	zap.S().Infow(
+		"Generating bloom msg",
+		"msgNum", resp.Num,
+		"numRecords", len(resp.RecordsNotInRX),
+	)
+	return resp, nil
+}
+
+// buildFilter returns a freshly salted filter of the local node set.
+func (policy *BloomPolicy) buildFilter() *BloomFilter {
+	nodeMap := policy.graph.GetNodeMap()
+	filter := newBloomFilter(len(nodeMap), policy.fpRate, rand.Uint64())
+	for hash := range nodeMap {
+		filter.add(hash)
+	}
+	return filter
+}
+
+// recordsMissingFrom reads a page of the local records not found in
+// filter, the filter of peer.
+func (policy *BloomPolicy) recordsMissingFrom(
+	peer gdp.Hash,
+	filter *BloomFilter,
+) ([]gdp.Record, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	if !filter.valid() {
+		return nil, errBloomFilterInvalid
+	}
+
+	missing := make([]gdp.Hash, 0)
+	for hash := range policy.graph.GetNodeMap() {
+		if !filter.contains(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	return readRecordPage(policy.graph, peer, missing)
+}
+
+// ExpireConversations resets the conversations with peers that have
+// not replied in time and returns those peers.
+func (policy *BloomPolicy) ExpireConversations() []gdp.Hash {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := policy.expireAll()
+	for _, s := range expired {
+		delete(policy.peerStates, s)
+	}
+	return peersOf(expired)
+}
+
+// setPeerState records the last message exchanged in conversation s
+// and waits for its reply.
+func (policy *BloomPolicy) setPeerState(s session, state PeerState) {
+	policy.peerStates[s] = state
+	policy.arm(s)
+}
+
+// endConversation forgets conversation s.
+func (policy *BloomPolicy) endConversation(s session) {
+	delete(policy.peerStates, s)
+	policy.disarm(s)
+}
@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestBloomPolicy(t *testing.T) {
+	base := chain("base", 100, gdp.NullHash)
+	last := base[len(base)-1].Hash
+
+	records := append(base, chain("a", 4, last)...)
+	records = append(records, chain("a-hole", 3, gdp.GenerateHash("x"))...)
+	graphA := graphFromRecords(t, records)
+	graphB := graphFromRecords(t, append(base, chain("b", 6, last)...))
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	// A high false positive rate forces the cleanup round to work
+	policyA := NewBloomPolicy(graphA, 0.3)
+	policyB := NewBloomPolicy(graphB, 0.3)
+
+	synced := func() bool {
+		return len(graphA.GetNodeMap()) == 113 && len(graphB.GetNodeMap()) == 113
+	}
+	for i := 0; i < 5 && !synced(); i++ {
+		assert.Equal(t, 5, converse(t, policyA, addrA, policyB, addrB))
+	}
+	assert.Equal(t, 113, len(graphA.GetNodeMap()))
+	assertSameNodes(t, graphA, graphB)
+	assert.Equal(t, 0, len(policyA.peerStates))
+	assert.Equal(t, 0, len(policyB.peerStates))
+
+	_, err := policyA.ProcessMessage(addrB, &BloomMsgContent{Num: third})
+	assert.Equal(t, errInconsistentStateAndMessage, err)
+}
+
+func TestBloomPolicyInvalidFilter(t *testing.T) {
+	records := chain("log", 10, gdp.NullHash)
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	invalid := []*BloomFilter{
+		{Bits: make([]uint64, 1), NumBits: 64, NumHashes: 1 << 40},
+		{Bits: make([]uint64, 1), NumBits: 1 << 20, NumHashes: 3},
+		{Bits: make([]uint64, 2), NumBits: 64, NumHashes: 0},
+	}
+	for _, filter := range invalid {
+		policyA := NewBloomPolicy(graphFromRecords(t, records), DefaultBloomFalsePositiveRate)
+		policyB := NewBloomPolicy(graphFromRecords(t, records), DefaultBloomFalsePositiveRate)
+
+		msg, err := policyA.GenerateMessage(addrB)
+		assert.Nil(t, err)
+		msg.(*BloomMsgContent).Filter = filter
+		msg, err = policyB.ProcessMessage(addrA, msg)
+		assert.Equal(t, errBloomFilterInvalid, err)
+		assert.Nil(t, msg)
+		assert.Equal(t, 0, len(policyB.peerStates))
+	}
+}
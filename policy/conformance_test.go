@@ -0,0 +1,235 @@
+package policy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+)
+
+// Bounds of the conformance suite
+const (
+	conformanceSeeds   = 8
+	conformanceRecords = 150
+	conformanceRounds  = 10
+)
+
+// conformancePolicies are the policies the conformance suite runs on.
+// New policies should be added here.
+var conformancePolicies = map[string]func(loggraph.LogGraph) Policy{
+	"naive": func(graph loggraph.LogGraph) Policy {
+		return NewNaivePolicy(graph)
+	},
+	"graphDiff": func(graph loggraph.LogGraph) Policy {
+		return NewGraphDiffPolicy(graph)
+	},
+	"boundedGraphDiff": func(graph loggraph.LogGraph) Policy {
+		policy := NewGraphDiffPolicy(graph)
+		policy.SetMaxPayload(2000)
+		return policy
+	},
+	"merkle": func(graph loggraph.LogGraph) Policy {
+		return NewMerklePolicy(graph)
+	},
+	"bloom": func(graph loggraph.LogGraph) Policy {
+		return NewBloomPolicy(graph, DefaultBloomFalsePositiveRate)
+	},
+	"iblt": func(graph loggraph.LogGraph) Policy {
+		return NewIBLTPolicy(graph)
+	},
+	"adaptive": func(graph loggraph.LogGraph) Policy {
+		return NewAdaptivePolicy(graph)
+	},
+}
+
+func TestConformance(t *testing.T) {
+	for name, newPolicy := range conformancePolicies {
+		t.Run(name, func(t *testing.T) {
+			runConformance(t, newPolicy)
+		})
+	}
+}
+
+// runConformance checks that two replicas running policies built by
+// newPolicy converge on random logs.
+func runConformance(t *testing.T, newPolicy func(loggraph.LogGraph) Policy) {
+	for seed := int64(0); seed < conformanceSeeds; seed++ {
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+			records := randomLog(rng, fmt.Sprint(seed), conformanceRecords)
+			recordsA, recordsB := splitRandomly(rng, records)
+			graphA := graphFromRecords(t, recordsA)
+			graphB := graphFromRecords(t, recordsB)
+
+			expected := make(map[gdp.Hash]bool)
+			for _, record := range append(recordsA, recordsB...) {
+				expected[record.Hash] = true
+			}
+
+			rounds := converge(t, newPolicy(graphA), newPolicy(graphB))
+			assert.True(
+				t,
+				rounds <= conformanceRounds,
+				"no convergence within %d rounds", conformanceRounds,
+			)
+			assert.Equal(t, len(expected), len(graphA.GetNodeMap()))
+			assertSameNodes(t, graphA, graphB)
+		})
+	}
+}
+
+// converge runs rounds of conversations between policyA and policyB,
+// each round opening one conversation from each side, until their
+// graphs hold the same nodes. It returns the number of rounds run.
+func converge(t *testing.T, policyA, policyB Policy) int {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	graphA := graphOf(policyA)
+	graphB := graphOf(policyB)
+
+	for round := 1; round <= conformanceRounds; round++ {
+		converse(t, policyA, addrA, policyB, addrB)
+		converse(t, policyB, addrB, policyA, addrA)
+		if sameNodes(graphA.GetNodeMap(), graphB.GetNodeMap()) {
+			return round
+		}
+	}
+	return conformanceRounds + 1
+}
+
+// graphOf returns the graph a policy replicates.
+func graphOf(policy Policy) loggraph.LogGraph {
+	switch policy := policy.(type) {
+	case *NaivePolicy:
+		return policy.logGraph
+	case *GraphDiffPolicy:
+		return policy.graph
+	case *MerklePolicy:
+		return policy.graph
+	case *BloomPolicy:
+		return policy.graph
+	case *IBLTPolicy:
+		return policy.graph
+	case *AdaptivePolicy:
+		return policy.graph
+	}
+	panic(fmt.Sprintf("unknown policy %T", policy))
+}
+
+func sameNodes(a, b map[gdp.Hash]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for hash := range a {
+		if !b[hash] {
+			return false
+		}
+	}
+	return true
+}
+
+// randomLog returns n records forming several disjoint components,
+// some rooted at the start of the log and some at records missing from
+// it, with branches.
+func randomLog(rng *rand.Rand, name string, n int) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	recNos := make(map[gdp.Hash]int)
+
+	// tips of the components; a new record usually extends the
+	// latest one, and otherwise branches off an earlier record
+	var component []gdp.Hash
+	for i := 0; i < n; i++ {
+		var prev gdp.Hash
+		switch {
+		case len(component) == 0 || rng.Intn(30) == 0:
+			// Start a disjoint component
+			component = nil
+			if rng.Intn(2) == 0 {
+				prev = gdp.GenerateHash(fmt.Sprintf("%s-pruned-%d", name, i))
+			}
+		case rng.Intn(8) == 0:
+			prev = component[rng.Intn(len(component))]
+		default:
+			prev = component[len(component)-1]
+		}
+
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{
+				RecNo:    recNos[prev] + 1,
+				PrevHash: prev,
+				Sig:      []byte{},
+			},
+			Value: []byte(fmt.Sprintf("%s-%d", name, i)),
+		}
+		record.Hash = gdp.RecordHash(record)
+		recNos[record.Hash] = record.RecNo
+		records = append(records, record)
+		component = append(component, record.Hash)
+	}
+	return records
+}
+
+// splitRandomly gives each record to one replica or both, leaving
+// holes in both.
+func splitRandomly(rng *rand.Rand, records []gdp.Record) ([]gdp.Record, []gdp.Record) {
+	recordsA := make([]gdp.Record, 0)
+	recordsB := make([]gdp.Record, 0)
+	for _, record := range records {
+		switch rng.Intn(3) {
+		case 0:
+			recordsA = append(recordsA, record)
+		case 1:
+			recordsB = append(recordsB, record)
+		default:
+			recordsA = append(recordsA, record)
+			recordsB = append(recordsB, record)
+		}
+	}
+	return recordsA, recordsB
+}
+
+// TestConcurrentConversations has a hub replica converse with many
+// peers at once, as the daemon does, and checks that it gathers every
+// record. It is meant to be run with the race detector.
+func TestConcurrentConversations(t *testing.T) {
+	const numPeers = 16
+
+	for name, newPolicy := range conformancePolicies {
+		t.Run(name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(0))
+			records := randomLog(rng, name, conformanceRecords)
+			hubGraph := graphFromRecords(t, nil)
+			hub := newPolicy(hubGraph)
+			hubAddr := gdp.GenerateHash("hub")
+
+			var wg sync.WaitGroup
+			for i := 0; i < numPeers; i++ {
+				var peerRecords []gdp.Record
+				for j := i; j < len(records); j += numPeers / 2 {
+					peerRecords = append(peerRecords, records[j])
+				}
+				peer := newPolicy(graphFromRecords(t, peerRecords))
+				peerAddr := gdp.GenerateHash(fmt.Sprint("peer", i))
+
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for round := 0; round < 3; round++ {
+						// Both sides open conversations
+						if (i+round)%2 == 0 {
+							converse(t, peer, peerAddr, hub, hubAddr)
+						} else {
+							converse(t, hub, hubAddr, peer, peerAddr)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			assert.Equal(t, len(records), hubGraph.NumNodes())
+		})
+	}
+}
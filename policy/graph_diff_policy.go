@@ -31,32 +31,57 @@ const (
 	thirdMsgSent
 	firstMsgRecved // receiver
 	thirdMsgRecved
+	draining // either side, after the fourth message
 )
 
+// graphContinuation is the Num of messages that only carry records
+// left over from earlier messages.
+const graphContinuation = fifth
+
 // GraphDiffPolicy is a Policy and uses diff of
 // begins and ends of graph to detect differences
 // See algorithm spec on Dropbox Paper for more details
 type GraphDiffPolicy struct {
+	peerModes
+	conversationDeadlines
+	tieBreaker
+
 	graph loggraph.LogGraph // most up to date graph
 
-	// current graph in use for a specific peer
-	// should reset to nil when message exchange ends
-	graphInUse map[gdp.Hash]loggraph.LogGraphClone
+	// current graph in use for a specific conversation
+	// removed when message exchange ends
+	graphInUse map[session]loggraph.LogGraphClone
 
-	// last message sent to the peer
+	// last message sent in the conversation
 	// used to keep track of message exchanges state
-	peerLastMsgType map[gdp.Hash]PeerState
+	// removed when message exchange ends
+	peerLastMsgType map[session]PeerState
+
+	// records waiting to be sent in each conversation
+	pending map[session]*recordQueue
 
-	// mutex for each peer
-	peerMutex map[gdp.Hash]*sync.Mutex
+	// maximum size in bytes of the records in one message, 0 if
+	// unlimited
+	maxPayload int
+
+	// guards the state of the conversations, which the daemon holds
+	// with several peers at once
+	mutex sync.Mutex
 }
 
 type GraphMsgContent struct {
 	Num            int
+	Session        SessionID
+	Mode           Mode // mode of the sender with the receiver
 	LogicalBegins  []gdp.Hash
 	LogicalEnds    []gdp.Hash
 	RecordsNotInRX []gdp.Record
 	HashesTXWants  []gdp.Hash
+
+	// More is set if the sender still has records to send. Records
+	// left over are sent in continuation messages once the fourth
+	// message has been exchanged.
+	More bool
 }
 
 // Context for a specific peer
@@ -69,38 +94,47 @@ type peerPolicyContext struct {
 func NewGraphDiffPolicy(graph loggraph.LogGraph) *GraphDiffPolicy {
 	return &GraphDiffPolicy{
 		graph:           graph,
-		graphInUse:      make(map[gdp.Hash]loggraph.LogGraphClone),
-		peerLastMsgType: make(map[gdp.Hash]PeerState),
-		peerMutex:       make(map[gdp.Hash]*sync.Mutex),
+		graphInUse:      make(map[session]loggraph.LogGraphClone),
+		peerLastMsgType: make(map[session]PeerState),
+		pending:         make(map[session]*recordQueue),
 	}
 }
 
-// initPeerIfNeeded initializes a peer's state for use if necessary.
-func (policy *GraphDiffPolicy) initPeerIfNeeded(peer gdp.Hash) {
-	mutex, ok := policy.peerMutex[peer]
-	if !ok {
-		policy.peerMutex[peer] = &sync.Mutex{}
-		mutex = policy.peerMutex[peer]
-	}
-
-	mutex.Lock()
-	defer mutex.Unlock()
+// SetMaxPayload bounds the size of the records carried by a single
+// message. Records that do not fit are sent in later messages, oldest
+// first, so that a peer keeps whatever it received if a later message
+// is lost. A limit of 0 disables the bound.
+func (policy *GraphDiffPolicy) SetMaxPayload(bytes int) {
+	policy.maxPayload = bytes
+}
 
-	_, ok = policy.graphInUse[peer]
-	if !ok {
-		policy.graphInUse[peer] = nil
-	}
+// resetPeerState forgets a conversation, returning it to before any
+// contact
+func (policy *GraphDiffPolicy) resetPeerStatus(s session) {
+	delete(policy.graphInUse, s)
+	delete(policy.peerLastMsgType, s)
+	delete(policy.pending, s)
+	policy.disarm(s)
+}
 
-	_, ok = policy.peerLastMsgType[peer]
-	if !ok {
-		policy.peerLastMsgType[peer] = noMsgExchanged
-	}
+// setPeerStatus records the last message exchanged in a conversation
+// and waits for its reply.
+func (policy *GraphDiffPolicy) setPeerStatus(s session, status PeerState) {
+	policy.peerLastMsgType[s] = status
+	policy.arm(s)
 }
 
-// resetPeerState resets a peer's state to before any contact
-func (policy *GraphDiffPolicy) resetPeerStatus(peer gdp.Hash) {
-	policy.graphInUse[peer] = nil
-	policy.peerLastMsgType[peer] = noMsgExchanged
+// ExpireConversations resets the conversations with peers that have
+// not replied in time and returns those peers.
+func (policy *GraphDiffPolicy) ExpireConversations() []gdp.Hash {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := policy.expireAll()
+	for _, s := range expired {
+		policy.resetPeerStatus(s)
+	}
+	return peersOf(expired)
 }
 
 // GenerateMessage begins the heartbeat process with a peer
@@ -108,10 +142,8 @@ func (policy *GraphDiffPolicy) GenerateMessage(dest gdp.Hash) (
 	interface{},
 	error,
 ) {
-	policy.initPeerIfNeeded(dest)
-
-	policy.peerMutex[dest].Lock()
-	defer policy.peerMutex[dest].Unlock()
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
 
 	// update states to firstMsgSent
 	clone, err := policy.graph.CreateClone()
@@ -123,14 +155,17 @@ func (policy *GraphDiffPolicy) GenerateMessage(dest gdp.Hash) (
 		return nil, err
 	}
 
-	policy.graphInUse[dest] = clone
-	policy.peerLastMsgType[dest] = firstMsgSent
+	s := session{dest, newSessionID()}
+	policy.graphInUse[s] = clone
+	policy.setPeerStatus(s, firstMsgSent)
 
 	// generate message
 	content := &GraphMsgContent{
 		Num:           first,
-		LogicalBegins: policy.graphInUse[dest].GetLogicalBegins(),
-		LogicalEnds:   policy.graphInUse[dest].GetLogicalEnds(),
+		Session:       s.id,
+		Mode:          policy.modeFor(dest),
+		LogicalBegins: clone.GetLogicalBegins(),
+		LogicalEnds:   clone.GetLogicalEnds(),
 	}
 
 	zap.S().Infow("Generate first msg")
@@ -147,19 +182,29 @@ func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{
 	if !ok {
 		return nil, errConversionError
 	}
-	policy.initPeerIfNeeded(src)
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
 
-	policy.peerMutex[src].Lock()
-	defer policy.peerMutex[src].Unlock()
+	s := session{src, msg.Session}
+	if policy.expire(s) {
+		policy.resetPeerStatus(s)
+	}
 
-	peerStatus := policy.peerLastMsgType[src]
+	// Both peers opened this conversation at the same time
+	if msg.Num == first {
+		err := policy.breakTie(s, policy.peerLastMsgType[s] == firstMsgSent, policy.resetPeerStatus)
+		if err != nil {
+			return nil, err
+		}
+	}
+	peerStatus := policy.peerLastMsgType[s]
 
 	// validate peer status with incoming message
 	// if status doesn't match the message type, simply reset the state machine
 	switch msg.Num {
 	case first:
 		if peerStatus != noMsgExchanged {
-			policy.resetPeerStatus(src)
+			policy.resetPeerStatus(s)
 			zap.S().Errorw(
 				"inconsistent state and msg",
 				"peerStatus", peerStatus,
@@ -168,10 +213,10 @@ func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{
 			return nil, errInconsistentStateAndMessage
 		}
 
-		return policy.processFirstMsg(msg, src)
+		return policy.processFirstMsg(msg, s)
 	case second:
 		if peerStatus != firstMsgSent {
-			policy.resetPeerStatus(src)
+			policy.resetPeerStatus(s)
 			zap.S().Errorw(
 				"inconsistent state and msg",
 				"peerStatus", peerStatus,
@@ -180,10 +225,10 @@ func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{
 			return nil, errInconsistentStateAndMessage
 		}
 
-		return policy.processSecondMsg(msg, src)
+		return policy.processSecondMsg(msg, s)
 	case third:
 		if peerStatus != firstMsgRecved {
-			policy.resetPeerStatus(src)
+			policy.resetPeerStatus(s)
 			zap.S().Errorw(
 				"inconsistent state and msg",
 				"peerStatus", peerStatus,
@@ -192,10 +237,22 @@ func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{
 			return nil, errInconsistentStateAndMessage
 		}
 
-		return policy.processThirdMsg(msg, src)
+		return policy.processThirdMsg(msg, s)
 	case fourth:
 		if peerStatus != thirdMsgSent {
-			policy.resetPeerStatus(src)
+			policy.resetPeerStatus(s)
+			zap.S().Errorw(
+				"inconsistent state and msg",
+				"peerStatus", peerStatus,
+				"msgNum", msg.Num,
+			)
+			return nil, errInconsistentStateAndMessage
+		}
+
+		return policy.processFourthMsg(msg, s)
+	case graphContinuation:
+		if peerStatus != draining {
+			policy.resetPeerStatus(s)
 			zap.S().Errorw(
 				"inconsistent state and msg",
 				"peerStatus", peerStatus,
@@ -204,7 +261,7 @@ func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{
 			return nil, errInconsistentStateAndMessage
 		}
 
-		return policy.processFourthMsg(msg, src)
+		return policy.processContinuationMsg(msg, s)
 	default:
 		return nil, errUnknownMessageType
 	}
@@ -212,31 +269,36 @@ func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{
 }
 
 // Below are handlers for specific messages
-// Handlers assume the mutex of the src is held by caller
-func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
+// Handlers assume the mutex of the peer of s is held by caller
+func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, s session) (*GraphMsgContent, error) {
 	clone, err := policy.graph.CreateClone()
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.resetPeerStatus(s)
 		return nil, err
 	}
-	policy.graphInUse[src] = clone
-	policy.peerLastMsgType[src] = firstMsgRecved
+	policy.graphInUse[s] = clone
+	policy.setPeerStatus(s, firstMsgRecved)
 
-	ctx := policy.getPeerPolicyContext(src)
+	ctx := policy.getPeerPolicyContext(s)
+	myMode := policy.modeFor(s.peer)
 
 	// Now that we have peer begins and ends, we start processing
 	_, _, peerBeginsNotMatched, peerEndsNotMatched :=
 		ctx.compareBeginsEnds(msg.LogicalBegins, msg.LogicalEnds)
 
-	graph := policy.graphInUse[src]
-	nodeMap := graph.GetNodeMap()
+	// Send nothing if either peer does not want records to flow to it
+	if !myMode.canSend(msg.Mode) {
+		peerBeginsNotMatched, peerEndsNotMatched = nil, nil
+	}
+
+	graph := policy.graphInUse[s]
 
 	nodesToSend := make([]gdp.Hash, 0)
 
 	// Send all nodes before (a node both of us have,
 	// but that the peer thinks is a beginning)
 	for _, begin := range peerBeginsNotMatched {
-		if _, found := nodeMap[begin]; found {
+		if graph.HasNode(begin) {
 			// Search all nodes ahead of begin to be sent to peer
 			visited, _ := ctx.searchAhead(begin, msg.LogicalEnds)
 			nodesToSend = append(nodesToSend, visited...)
@@ -246,27 +308,32 @@ func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Has
 	// Send all nodes after (a node that both of us have,
 	// but that the peer thinks is an end)
 	for _, end := range peerEndsNotMatched {
-		if _, found := nodeMap[end]; found {
+		if graph.HasNode(end) {
 			// Search all nodes after end to be sent to peer
 			visited, _ := ctx.searchAfter(end, msg.LogicalBegins)
 			nodesToSend = append(nodesToSend, visited...)
 		}
 	}
 
-	recordsNotInRX, err := policy.graph.ReadRecords(nodesToSend)
+	delete(policy.pending, s)
+	policy.queueRecords(s, nodesToSend)
+	recordsNotInRX, more, err := policy.nextRecords(s)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.resetPeerStatus(s)
 		return nil, err
 	}
 
 	msgContent := &GraphMsgContent{
 		Num:            second,
+		Session:        s.id,
+		Mode:           myMode,
 		RecordsNotInRX: recordsNotInRX,
 		LogicalBegins:  graph.GetLogicalBegins(),
 		LogicalEnds:    graph.GetLogicalEnds(),
+		More:           more,
 	}
 
-	policy.peerLastMsgType[src] = firstMsgRecved
+	policy.setPeerStatus(s, firstMsgRecved)
 	zap.S().Infow(
 		"Generating second message",
 		"numRecords", len(msgContent.RecordsNotInRX),
@@ -277,8 +344,25 @@ func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Has
 	return msgContent, nil
 }
 
-func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	ctx := policy.getPeerPolicyContext(src)
+func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, s session) (*GraphMsgContent, error) {
+	myMode := policy.modeFor(s.peer)
+
+	// The records of the peer are written, and the snapshot taken
+	// after them, so that the comparison below neither requests nor
+	// sends them again
+	err := policy.writeRecords(s.peer, msg.RecordsNotInRX)
+	if err != nil {
+		policy.resetPeerStatus(s)
+		return nil, err
+	}
+
+	clone, err := policy.graph.CreateClone()
+	if err != nil {
+		policy.resetPeerStatus(s)
+		return nil, err
+	}
+	policy.graphInUse[s] = clone
+	ctx := policy.getPeerPolicyContext(s)
 
 	// Since the data section has been used to update the graph, we can compare digest of the
 	// peer's graph with up-to-date information
@@ -289,17 +373,20 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 		peerEndsNotMatched :=
 		ctx.compareBeginsEnds(msg.LogicalBegins, msg.LogicalEnds)
 
-	graph := policy.graphInUse[src]
-	nodeMap := graph.GetNodeMap()
+	graph := policy.graphInUse[s]
 
 	nodesToSend := make([]gdp.Hash, 0)
 	componentsToSend := make([]gdp.Hash, 0)
 	requests := make([]gdp.Hash, 0)
 
+	// Records deleted here are not requested back from a peer whose
+	// retention keeps them
+	pruned := policy.graph.GetPrunedMap()
+
 	myBeginsEndsToSend := make(map[gdp.Hash]int)
 
 	for _, begin := range peerBeginsNotMatched {
-		if _, found := nodeMap[begin]; found {
+		if graph.HasNode(begin) {
 			// Search all nodes ahead of begin to be sent to peer
 			// If we reach a begin / end of local graph, add to myBeginsEndsToSend
 			visited, localEnds := ctx.searchAhead(begin, msg.LogicalEnds)
@@ -308,14 +395,14 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 			for _, node := range localEnds {
 				myBeginsEndsToSend[node] = 1
 			}
-		} else {
+		} else if _, deleted := pruned[begin]; !deleted {
 			// Add the entire connected component to request
 			requests = append(requests, begin)
 		}
 	}
 
 	for _, end := range peerEndsNotMatched {
-		if _, found := nodeMap[end]; found {
+		if graph.HasNode(end) {
 			// Search all nodes ahead of begin to be sent to peer
 			// If we reach a begin / end of local graph, add to myBeginsEndsToSend
 			visited, localEnds := ctx.searchAfter(end, msg.LogicalBegins)
@@ -324,7 +411,7 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 			for _, node := range localEnds {
 				myBeginsEndsToSend[node] = 1
 			}
-		} else {
+		} else if _, deleted := pruned[end]; !deleted {
 			// Add the entire connected component to request
 			requests = append(requests, end)
 		}
@@ -346,69 +433,158 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 
 	componentsToSend = ctx.getConnectedAddrs(componentsToSend)
 	nodesToSend = append(nodesToSend, componentsToSend...)
-	recordsToSend, err := policy.graph.ReadRecords(nodesToSend)
+
+	// Only exchange records in the directions both peers allow
+	if !myMode.canSend(msg.Mode) {
+		nodesToSend = nil
+	}
+	if !myMode.canReceive(msg.Mode) {
+		requests = nil
+	}
+
+	policy.queueRecords(s, nodesToSend)
+	recordsToSend, more, err := policy.nextRecords(s)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.resetPeerStatus(s)
 		return nil, err
 	}
 
 	resp := &GraphMsgContent{
 		Num:            third,
+		Session:        s.id,
+		Mode:           myMode,
 		HashesTXWants:  requests,
 		RecordsNotInRX: recordsToSend,
+		More:           more,
 	}
 
 	zap.S().Infow(
 		"Generating message third",
 	)
 
-	policy.peerLastMsgType[src] = thirdMsgSent
+	policy.setPeerStatus(s, thirdMsgSent)
 	return resp, nil
 }
 
-func (policy *GraphDiffPolicy) processThirdMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	ctx := policy.getPeerPolicyContext(src)
+func (policy *GraphDiffPolicy) processThirdMsg(msg *GraphMsgContent, s session) (*GraphMsgContent, error) {
+	ctx := policy.getPeerPolicyContext(s)
+	myMode := policy.modeFor(s.peer)
 
-	err := policy.graph.WriteRecords(msg.RecordsNotInRX)
+	err := policy.writeRecords(s.peer, msg.RecordsNotInRX)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.resetPeerStatus(s)
 		return nil, err
 	}
 
 	reqAddrs := msg.HashesTXWants
+	if !myMode.pushes() {
+		reqAddrs = nil
+	}
 
 	// For each addr requested, send the entire connected component
 	addrs := ctx.getConnectedAddrs(reqAddrs)
-	recordsRXWants, err := policy.graph.ReadRecords(addrs)
+	policy.queueRecords(s, addrs)
+	recordsRXWants, more, err := policy.nextRecords(s)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.resetPeerStatus(s)
 		return nil, err
 	}
 
 	resp := &GraphMsgContent{
 		Num:            fourth,
+		Session:        s.id,
+		Mode:           myMode,
 		RecordsNotInRX: recordsRXWants,
+		More:           more,
 	}
 
 	zap.S().Infow(
 		"Generating fourth message",
 		"numRecords", len(recordsRXWants),
+		"more", more,
 	)
 
-	// When to revert to netural state?
-	policy.peerLastMsgType[src] = thirdMsgRecved
+	// Nothing follows the fourth message unless records are left over
+	if more || msg.More {
+		policy.setPeerStatus(s, draining)
+	} else {
+		policy.resetPeerStatus(s)
+	}
 
 	return resp, nil
 }
 
-func (policy *GraphDiffPolicy) processFourthMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	err := policy.graph.WriteRecords(msg.RecordsNotInRX)
+func (policy *GraphDiffPolicy) processFourthMsg(msg *GraphMsgContent, s session) (*GraphMsgContent, error) {
+	err := policy.writeRecords(s.peer, msg.RecordsNotInRX)
+	if err != nil {
+		policy.resetPeerStatus(s)
+		return nil, err
+	}
+
+	return policy.drain(msg, s)
+}
+
+func (policy *GraphDiffPolicy) processContinuationMsg(msg *GraphMsgContent, s session) (*GraphMsgContent, error) {
+	err := policy.writeRecords(s.peer, msg.RecordsNotInRX)
+	if err != nil {
+		policy.resetPeerStatus(s)
+		return nil, err
+	}
+
+	return policy.drain(msg, s)
+}
+
+// drain answers a message received after the fourth message has been
+// exchanged with the next records left over for the peer. The
+// conversation ends once neither side has records left.
+func (policy *GraphDiffPolicy) drain(msg *GraphMsgContent, s session) (*GraphMsgContent, error) {
+	if !msg.More && policy.pending[s].empty() {
+		// last message, nothing to respond, reset state
+		policy.resetPeerStatus(s)
+		return nil, ErrConversationFinished
+	}
+
+	records, more, err := policy.nextRecords(s)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.resetPeerStatus(s)
 		return nil, err
 	}
 
-	// last message, nothing to respond, reset state
-	policy.resetPeerStatus(src)
-	return nil, ErrConversationFinished
+	resp := &GraphMsgContent{
+		Num:            graphContinuation,
+		Session:        s.id,
+		Mode:           policy.modeFor(s.peer),
+		RecordsNotInRX: records,
+		More:           more,
+	}
+
+	zap.S().Infow(
+		"Generating continuation message",
+		"numRecords", len(records),
+		"more", more,
+	)
+
+	// The peer will not answer if neither side has records left
+	if !more && !msg.More {
+		policy.resetPeerStatus(s)
+	} else {
+		policy.setPeerStatus(s, draining)
+	}
+	return resp, nil
+}
+
+// writeRecords stores records received from peer unless the mode used
+// with peer forbids it.
+func (policy *GraphDiffPolicy) writeRecords(peer gdp.Hash, records []gdp.Record) error {
+	if !policy.modeFor(peer).pulls() {
+		if len(records) > 0 {
+			zap.S().Warnw(
+				"Dropping records received in push-only mode",
+				"peer", peer.Readable(),
+				"num", len(records),
+			)
+		}
+		return nil
+	}
+	return policy.graph.WriteRecordsFrom(peer, records)
 }
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// bigChain returns a chain whose records have values of valueSize bytes.
+func bigChain(name string, n int, prev gdp.Hash, valueSize int) []gdp.Record {
+	value := make([]byte, valueSize)
+	copy(value, name)
+	return chainOf(name, n, prev, value)
+}
+
+func TestGraphDiffMaxPayload(t *testing.T) {
+	base := bigChain("base", 10, gdp.NullHash, 1000)
+	last := base[len(base)-1].Hash
+
+	graphA := graphFromRecords(t, append(append([]gdp.Record{}, base...), bigChain("a", 30, last, 1000)...))
+	graphB := graphFromRecords(t, append(base, bigChain("b", 20, gdp.GenerateHash("x"), 1000)...))
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewGraphDiffPolicy(graphA)
+	policyB := NewGraphDiffPolicy(graphB)
+	policyA.SetMaxPayload(5000)
+	policyB.SetMaxPayload(5000)
+
+	numMsgs := converse(t, policyA, addrA, policyB, addrB)
+	assert.True(t, numMsgs > 4, "only %d messages", numMsgs)
+	assert.Equal(t, 60, len(graphA.GetNodeMap()))
+	assertSameNodes(t, graphA, graphB)
+	assert.Equal(t, 0, len(policyA.peerLastMsgType))
+	assert.Equal(t, 0, len(policyB.peerLastMsgType))
+	assert.Equal(t, 0, len(policyA.pending))
+	assert.Equal(t, 0, len(policyB.pending))
+}
+
+func TestGraphDiffLostContinuation(t *testing.T) {
+	base := bigChain("base", 10, gdp.NullHash, 1000)
+	last := base[len(base)-1].Hash
+
+	graphA := graphFromRecords(t, append(append([]gdp.Record{}, base...), bigChain("a", 30, last, 1000)...))
+	graphB := graphFromRecords(t, base)
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	clock := &fakeClock{current: time.Unix(0, 0)}
+	policyA := NewGraphDiffPolicy(graphA)
+	policyB := NewGraphDiffPolicy(graphB)
+	policyA.now, policyB.now = clock.now, clock.now
+	policyA.SetMaxPayload(5000)
+
+	msg, err := policyB.GenerateMessage(addrA)
+	assert.Nil(t, err)
+	msg, err = policyA.ProcessMessage(addrB, msg)
+	assert.Nil(t, err)
+
+	content := msg.(*GraphMsgContent)
+	assert.True(t, content.More)
+	assert.True(t, len(content.RecordsNotInRX) <= 5)
+
+	// B stores the first chunk even though the rest never arrives
+	_, err = policyB.ProcessMessage(addrA, msg)
+	assert.Nil(t, err)
+	numNodes := len(graphB.GetNodeMap())
+	assert.True(t, numNodes > 10 && numNodes < 40)
+
+	// Chunks are sent oldest first, so B holds a single chain
+	assert.Equal(t, 1, len(graphB.GetLogicalEnds()))
+	assert.Equal(t, 1, len(graphB.GetLogicalBegins()))
+
+	// Both sides abandon the conversation once it expires and a later
+	// one transfers the remaining records
+	clock.advance(DefaultConversationTimeout)
+	assert.Equal(t, []gdp.Hash{addrB}, policyA.ExpireConversations())
+	assert.Equal(t, []gdp.Hash{addrA}, policyB.ExpireConversations())
+	for i := 0; i < 3; i++ {
+		converse(t, policyA, addrA, policyB, addrB)
+	}
+	assertSameNodes(t, graphA, graphB)
+}
+
+func TestGraphDiffHoleSendsMissingOnly(t *testing.T) {
+	records := chain("log", 100, gdp.NullHash)
+	withHole := append(append([]gdp.Record{}, records[:40]...), records[60:]...)
+
+	graphA := graphFromRecords(t, records)
+	graphB := graphFromRecords(t, withHole)
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewGraphDiffPolicy(graphA)
+	policyB := NewGraphDiffPolicy(graphB)
+
+	msg, err := policyB.GenerateMessage(addrA)
+	assert.Nil(t, err)
+	msg, err = policyA.ProcessMessage(addrB, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(msg.(*GraphMsgContent).RecordsNotInRX))
+
+	msg, err = policyB.ProcessMessage(addrA, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(msg.(*GraphMsgContent).RecordsNotInRX))
+
+	_, err = policyA.ProcessMessage(addrB, msg)
+	assert.True(t, err == nil || err == ErrConversationFinished)
+	assertSameNodes(t, graphA, graphB)
+}
+
+func TestGraphDiffSecondMsgRecords(t *testing.T) {
+	records := chain("log", 30, gdp.NullHash)
+	graphA := graphFromRecords(t, records)
+	graphB := graphFromRecords(t, records[:10])
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewGraphDiffPolicy(graphA)
+	policyB := NewGraphDiffPolicy(graphB)
+
+	msg, err := policyB.GenerateMessage(addrA)
+	assert.Nil(t, err)
+	msg, err = policyA.ProcessMessage(addrB, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(msg.(*GraphMsgContent).RecordsNotInRX))
+
+	// The initiator stores the records of the second message and has
+	// nothing left to request
+	msg, err = policyB.ProcessMessage(addrA, msg)
+	assert.Nil(t, err)
+	assertSameNodes(t, graphA, graphB)
+	assert.Equal(t, 0, len(msg.(*GraphMsgContent).HashesTXWants))
+	assert.Equal(t, 0, len(msg.(*GraphMsgContent).RecordsNotInRX))
+}
@@ -1,11 +1,16 @@
 package policy
 
-import "github.com/tonyyanga/gdp-replicate/gdp"
+import (
+	"sort"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+)
 
 // Get peer policy context
-func (policy *GraphDiffPolicy) getPeerPolicyContext(peer gdp.Hash) *peerPolicyContext {
+func (policy *GraphDiffPolicy) getPeerPolicyContext(s session) *peerPolicyContext {
 	return &peerPolicyContext{
-		graph:  policy.graphInUse[peer],
+		graph:  policy.graphInUse[s],
 		policy: policy,
 	}
 }
@@ -13,29 +18,20 @@ func (policy *GraphDiffPolicy) getPeerPolicyContext(peer gdp.Hash) *peerPolicyCo
 // Return all connected hash addresses in the graph from a list of requested
 // This function should handle deduplication
 func (ctx *peerPolicyContext) getConnectedAddrs(addrs []gdp.Hash) []gdp.Hash {
-	empty := []gdp.Hash{}
-
 	result := make(map[gdp.Hash]int)
 
-	_getConnected := func(addr gdp.Hash) {
+	for _, addr := range addrs {
 		// Add addr itself
 		result[addr] = 1
 
-		prev, _ := ctx.searchAhead(addr, empty)
-		for _, node := range prev {
+		for _, node := range ctx.graph.GetAncestors(addr, 0) {
 			result[node] = 1
 		}
-
-		next, _ := ctx.searchAfter(addr, empty)
-		for _, node := range next {
+		for _, node := range ctx.graph.GetDescendants(addr, 0) {
 			result[node] = 1
 		}
 	}
 
-	for _, addr := range addrs {
-		_getConnected(addr)
-	}
-
 	ret := []gdp.Hash{}
 	for key := range result {
 		ret = append(ret, key)
@@ -50,30 +46,29 @@ func (ctx *peerPolicyContext) getConnectedAddrs(addrs []gdp.Hash) []gdp.Hash {
 //   a list of hash addresses visited, not including start or terminals
 //   a list of begins / ends in local graph reached
 func (ctx *peerPolicyContext) searchAhead(start gdp.Hash, terminals []gdp.Hash) ([]gdp.Hash, []gdp.Hash) {
-	actualMap := ctx.graph.GetActualPtrMap()
 	terminalMap := initSet(terminals)
 
 	visited := make([]gdp.Hash, 0)
 	localEnds := make([]gdp.Hash, 0)
 
+	// Stop at the first record of the log or before a hole
 	current := start
-	prev, found := actualMap[current]
-	for found {
-		if _, terminate := terminalMap[current]; terminate {
+	terminated := false
+	ctx.graph.WalkAncestors(start, func(prev gdp.Hash) bool {
+		if _, terminate := terminalMap[prev]; terminate {
 			// early termination because reaching terminal
-			return visited, localEnds
+			terminated = true
+			return false
 		}
 
+		visited = append(visited, prev)
 		current = prev
-		prev, found = actualMap[current]
+		return true
+	})
 
-		// Do not store the last pointer on the map
-		if found {
-			visited = append(visited, current)
-		}
+	if !terminated {
+		localEnds = append(localEnds, current)
 	}
-
-	localEnds = append(localEnds, current)
 	return visited, localEnds
 }
 
@@ -83,32 +78,26 @@ func (ctx *peerPolicyContext) searchAhead(start gdp.Hash, terminals []gdp.Hash)
 //   a list of hash addresses visited, not including start or terminals
 //   a list of begins / ends in local graph reached
 func (ctx *peerPolicyContext) searchAfter(start gdp.Hash, terminals []gdp.Hash) ([]gdp.Hash, []gdp.Hash) {
-	return ctx._searchAfter(start, initSet(terminals))
-}
-
-func (ctx *peerPolicyContext) _searchAfter(start gdp.Hash, terminals map[gdp.Hash]bool) ([]gdp.Hash, []gdp.Hash) {
-	logicalMap := ctx.graph.GetLogicalPtrMap()
-
-	// Use recursion since we may have branches, start is never included
-	after, found := logicalMap[start]
-
-	// base cases
-	if _, terminate := terminals[start]; terminate {
-		return []gdp.Hash{}, []gdp.Hash{}
-	}
+	terminalMap := initSet(terminals)
 
-	if !found {
+	// start is never included
+	if len(ctx.graph.GetNext(start)) == 0 {
 		return []gdp.Hash{}, []gdp.Hash{start}
 	}
 
 	visited := []gdp.Hash{}
 	localEnds := make([]gdp.Hash, 0)
-	for _, node := range after {
-		visited_, localEnds_ := ctx._searchAfter(node, terminals)
+	ctx.graph.WalkDescendants(start, func(node gdp.Hash) bool {
+		if _, terminate := terminalMap[node]; terminate {
+			return false
+		}
+
 		visited = append(visited, node)
-		visited = append(visited, visited_...)
-		localEnds = append(localEnds, localEnds_...)
-	}
+		if len(ctx.graph.GetNext(node)) == 0 {
+			localEnds = append(localEnds, node)
+		}
+		return true
+	})
 
 	return visited, localEnds
 }
@@ -129,3 +118,152 @@ func (ctx *peerPolicyContext) compareBeginsEnds(
 	localEndsRet, peerEndsRet := findDifferences(localEnds, peerEnds)
 	return localBeginsRet, localEndsRet, peerBeginsRet, peerEndsRet
 }
+
+// Approximate encoded size of a record besides its value and signature
+const recordOverhead = 128
+
+// Number of queued records read from the log server at a time
+const recordReadBatch = 64
+
+// recordQueue holds records waiting to be sent to a peer. Hashes are
+// only read from the log server when their records are about to be
+// sent.
+type recordQueue struct {
+	hashes  []gdp.Hash
+	records []gdp.Record
+}
+
+func (queue *recordQueue) empty() bool {
+	return queue == nil || (len(queue.hashes) == 0 && len(queue.records) == 0)
+}
+
+// queueRecords adds hashes to the records waiting to be sent in
+// conversation s, ancestors before their descendants. Records the peer
+// deleted are left out.
+func (policy *GraphDiffPolicy) queueRecords(s session, hashes []gdp.Hash) {
+	hashes = withoutPeerPruned(policy.graph, s.peer, hashes)
+	if len(hashes) == 0 {
+		return
+	}
+
+	queue, present := policy.pending[s]
+	if !present {
+		queue = &recordQueue{}
+		policy.pending[s] = queue
+	}
+
+	var graph loggraph.LogGraphClone = policy.graph
+	if clone := policy.graphInUse[s]; clone != nil {
+		graph = clone
+	}
+	queue.hashes = append(queue.hashes, orderAncestorsFirst(hashes, graph)...)
+}
+
+// nextRecords takes the records for the next message of conversation s
+// off its queue, up to the maximum payload but at least one record. It
+// also reports whether records are left on the queue.
+func (policy *GraphDiffPolicy) nextRecords(s session) ([]gdp.Record, bool, error) {
+	queue := policy.pending[s]
+	if queue.empty() {
+		return nil, false, nil
+	}
+
+	if policy.maxPayload <= 0 {
+		records, err := policy.graph.ReadRecords(queue.hashes)
+		if err != nil {
+			return nil, false, err
+		}
+		delete(policy.pending, s)
+		return append(queue.records, records...), false, nil
+	}
+
+	chunk := make([]gdp.Record, 0)
+	size := 0
+	for !queue.empty() {
+		if len(queue.records) == 0 {
+			numHashes := recordReadBatch
+			if numHashes > len(queue.hashes) {
+				numHashes = len(queue.hashes)
+			}
+			records, err := policy.graph.ReadRecords(queue.hashes[:numHashes])
+			if err != nil {
+				return nil, false, err
+			}
+			queue.records = orderLike(records, queue.hashes[:numHashes])
+			queue.hashes = queue.hashes[numHashes:]
+			continue
+		}
+
+		record := queue.records[0]
+		recordSize := len(record.Value) + len(record.Sig) + recordOverhead
+		if len(chunk) > 0 && size+recordSize > policy.maxPayload {
+			break
+		}
+		chunk = append(chunk, record)
+		size += recordSize
+		queue.records = queue.records[1:]
+	}
+
+	more := !queue.empty()
+	if !more {
+		delete(policy.pending, s)
+	}
+	return chunk, more, nil
+}
+
+// orderAncestorsFirst deduplicates hashes and sorts them so that every
+// hash comes after its ancestors among hashes.
+func orderAncestorsFirst(
+	hashes []gdp.Hash,
+	graph loggraph.LogGraphClone,
+) []gdp.Hash {
+	inSet := initSet(hashes)
+	depths := make(map[gdp.Hash]int, len(inSet))
+
+	for hash := range inSet {
+		// Walk back until a node of known depth or outside the set
+		path := []gdp.Hash{}
+		current := hash
+		for {
+			if _, known := depths[current]; known {
+				break
+			}
+			path = append(path, current)
+			prev, found := graph.GetPrev(current)
+			if _, present := inSet[prev]; !found || !present {
+				break
+			}
+			current = prev
+		}
+
+		depth := -1
+		if known, present := depths[current]; present {
+			depth = known
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			depth++
+			depths[path[i]] = depth
+		}
+	}
+
+	ordered := make([]gdp.Hash, 0, len(inSet))
+	for hash := range inSet {
+		ordered = append(ordered, hash)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return depths[ordered[i]] < depths[ordered[j]]
+	})
+	return ordered
+}
+
+// orderLike sorts records in the order of their hashes in hashes.
+func orderLike(records []gdp.Record, hashes []gdp.Hash) []gdp.Record {
+	positions := make(map[gdp.Hash]int, len(hashes))
+	for i, hash := range hashes {
+		positions[hash] = i
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return positions[records[i].Hash] < positions[records[j].Hash]
+	})
+	return records
+}
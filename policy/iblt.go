@@ -0,0 +1,229 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Shape of Invertible Bloom Lookup Tables and strata estimators. Both
+// peers must agree on it.
+const (
+	ibltNumHashes = 3
+	ibltMinCells  = 12
+	ibltMaxCells  = 3 << 18
+
+	strataLevels = 32
+	strataCells  = 32
+)
+
+var errIBLTSizeMismatch = errors.New("IBLTs have different sizes")
+
+// IBLTCell is one cell of an IBLT.
+type IBLTCell struct {
+	Count   int
+	KeySum  gdp.Hash
+	HashSum uint64
+}
+
+// IBLT is an Invertible Bloom Lookup Table over hashes. Subtracting the
+// tables of two sets leaves a table of their symmetric difference, which
+// can be listed as long as it is small compared to the number of cells.
+type IBLT struct {
+	Cells []IBLTCell
+}
+
+// newIBLT creates an empty table of at least numCells cells, up to
+// ibltMaxCells.
+func newIBLT(numCells int) *IBLT {
+	if numCells < ibltMinCells {
+		numCells = ibltMinCells
+	}
+	if numCells > ibltMaxCells {
+		numCells = ibltMaxCells
+	}
+	if rem := numCells % ibltNumHashes; rem != 0 {
+		numCells += ibltNumHashes - rem
+	}
+	return &IBLT{Cells: make([]IBLTCell, numCells)}
+}
+
+// newIBLTForDifference creates an empty table large enough to decode
+// a symmetric difference of about numDiffs hashes.
+func newIBLTForDifference(numDiffs int) *IBLT {
+	return newIBLT(2*numDiffs + ibltMinCells)
+}
+
+// validIBLTSize reports whether a table of numCells cells, e.g. sent
+// by a peer, has a shape newIBLT could have created.
+func validIBLTSize(numCells int) bool {
+	return numCells >= ibltMinCells &&
+		numCells <= ibltMaxCells &&
+		numCells%ibltNumHashes == 0
+}
+
+// insert adds hash to the table.
+func (table *IBLT) insert(hash gdp.Hash) {
+	table.update(hash, 1)
+}
+
+// update adds delta copies of hash to the table.
+func (table *IBLT) update(hash gdp.Hash, delta int) {
+	check := ibltChecksum(hash)
+	for _, index := range table.indexes(hash) {
+		cell := &table.Cells[index]
+		cell.Count += delta
+		cell.HashSum ^= check
+		for j := range cell.KeySum {
+			cell.KeySum[j] ^= hash[j]
+		}
+	}
+}
+
+// indexes returns the cells holding hash, one in each subtable.
+func (table *IBLT) indexes(hash gdp.Hash) [ibltNumHashes]int {
+	var indexes [ibltNumHashes]int
+	subtableSize := uint64(len(table.Cells) / ibltNumHashes)
+	for i := range indexes {
+		offset := binary.LittleEndian.Uint64(hash[8*i : 8*i+8])
+		indexes[i] = int(uint64(i)*subtableSize + offset%subtableSize)
+	}
+	return indexes
+}
+
+// subtract returns a new table holding table minus other.
+func (table *IBLT) subtract(other *IBLT) (*IBLT, error) {
+	if other == nil || len(table.Cells) != len(other.Cells) {
+		return nil, errIBLTSizeMismatch
+	}
+
+	diff := &IBLT{Cells: make([]IBLTCell, len(table.Cells))}
+	for i := range table.Cells {
+		cell := &diff.Cells[i]
+		cell.Count = table.Cells[i].Count - other.Cells[i].Count
+		cell.HashSum = table.Cells[i].HashSum ^ other.Cells[i].HashSum
+		for j := range cell.KeySum {
+			cell.KeySum[j] = table.Cells[i].KeySum[j] ^ other.Cells[i].KeySum[j]
+		}
+	}
+	return diff, nil
+}
+
+// decode lists the hashes of a difference table, destroying it.
+// Hashes with positive counts were only in the minuend and hashes
+// with negative counts only in the subtrahend. ok is false if the
+// table could not be fully decoded.
+func (table *IBLT) decode() (onlyMine, onlyTheirs []gdp.Hash, ok bool) {
+	if len(table.Cells) == 0 || len(table.Cells)%ibltNumHashes != 0 {
+		return nil, nil, false
+	}
+
+	// A table holds fewer hashes than cells unless it was forged
+	for progress := true; progress; {
+		progress = false
+		for i := range table.Cells {
+			cell := table.Cells[i]
+			if !table.isPure(i) {
+				continue
+			}
+			if len(onlyMine)+len(onlyTheirs) >= len(table.Cells) {
+				return onlyMine, onlyTheirs, false
+			}
+
+			if cell.Count == 1 {
+				onlyMine = append(onlyMine, cell.KeySum)
+			} else {
+				onlyTheirs = append(onlyTheirs, cell.KeySum)
+			}
+			table.update(cell.KeySum, -cell.Count)
+			progress = true
+		}
+	}
+
+	for _, cell := range table.Cells {
+		if cell.Count != 0 || cell.HashSum != 0 || cell.KeySum != gdp.NullHash {
+			return onlyMine, onlyTheirs, false
+		}
+	}
+	return onlyMine, onlyTheirs, true
+}
+
+// isPure reports whether cell i holds exactly one hash, which must
+// belong in that cell.
+func (table *IBLT) isPure(i int) bool {
+	cell := table.Cells[i]
+	if (cell.Count != 1 && cell.Count != -1) ||
+		cell.HashSum != ibltChecksum(cell.KeySum) {
+		return false
+	}
+	for _, index := range table.indexes(cell.KeySum) {
+		if index == i {
+			return true
+		}
+	}
+	return false
+}
+
+// ibltChecksum is independent of the cell positions chosen for hash.
+func ibltChecksum(hash gdp.Hash) uint64 {
+	digest := sha256.Sum256(hash[:])
+	return binary.LittleEndian.Uint64(digest[:8])
+}
+
+// StrataEstimator estimates the size of the symmetric difference of two
+// sets. Stratum i holds about a 2^-(i+1) fraction of the set, so small
+// strata can be decoded even when the difference is large.
+type StrataEstimator struct {
+	Strata []*IBLT
+}
+
+// newStrataEstimator builds an estimator over all hashes in nodeMap.
+func newStrataEstimator(nodeMap map[gdp.Hash]bool) *StrataEstimator {
+	estimator := &StrataEstimator{Strata: make([]*IBLT, strataLevels)}
+	for i := range estimator.Strata {
+		estimator.Strata[i] = newIBLT(strataCells)
+	}
+
+	for hash := range nodeMap {
+		estimator.Strata[strataLevel(hash)].insert(hash)
+	}
+	return estimator
+}
+
+// estimate returns the estimated size of the symmetric difference
+// between the sets of estimator and other.
+func (estimator *StrataEstimator) estimate(other *StrataEstimator) (int, error) {
+	if other == nil || len(other.Strata) != len(estimator.Strata) {
+		return 0, errIBLTSizeMismatch
+	}
+
+	count := 0
+	for i := len(estimator.Strata) - 1; i >= 0; i-- {
+		diff, err := estimator.Strata[i].subtract(other.Strata[i])
+		if err != nil {
+			return 0, err
+		}
+
+		onlyMine, onlyTheirs, ok := diff.decode()
+		if !ok {
+			if count == 0 {
+				count = 1
+			}
+			return count << uint(i+1), nil
+		}
+		count += len(onlyMine) + len(onlyTheirs)
+	}
+	return count, nil
+}
+
+// strataLevel assigns hash to a stratum by its number of trailing zeros.
+func strataLevel(hash gdp.Hash) int {
+	level := bits.TrailingZeros64(binary.LittleEndian.Uint64(hash[24:32]))
+	if level >= strataLevels {
+		level = strataLevels - 1
+	}
+	return level
+}
@@ -0,0 +1,341 @@
+package policy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
+
+var errIBLTMsgContentConversion = errors.New(
+	"Unable to cast packedMsg to *IBLTMsgContent",
+)
+
+// IBLTPolicy is a Policy that reconciles the node sets of two peers
+// with Invertible Bloom Lookup Tables, so that message sizes depend on
+// the number of records that differ rather than on the size of the log.
+//
+//  1. A -> B: strata estimator of A
+//  2. B -> A: IBLT of B sized from the estimated difference
+//  3. A -> B: records only A has, hashes only B has
+//  4. B -> A: records requested by A
+//
+// If A cannot decode the difference of the tables, it falls back to
+// the exchange of NaivePolicy, carried inside IBLTMsgContent.
+type IBLTPolicy struct {
+	conversationDeadlines
+	tieBreaker
+
+	graph loggraph.LogGraph
+
+	// naive handles conversations that could not be decoded
+	naive *NaivePolicy
+
+	// last message exchanged in each conversation in progress
+	peerStates map[session]PeerState
+
+	mutex sync.Mutex
+}
+
+// IBLTMsgContent holds all communication info for IBLT policy peers.
+// All fields are labelled from the perspective of the sender.
+type IBLTMsgContent struct {
+	Num            int
+	Session        SessionID
+	Estimator      *StrataEstimator
+	Table          *IBLT
+	RecordsNotInRX []gdp.Record
+	HashesTXWants  []gdp.Hash
+
+	// Naive carries a naive exchange after decoding failed
+	Naive *NaiveMsgContent
+}
+
+// NewIBLTPolicy constructs an IBLTPolicy over graph.
+func NewIBLTPolicy(graph loggraph.LogGraph) *IBLTPolicy {
+	return &IBLTPolicy{
+		graph:      graph,
+		naive:      NewNaivePolicy(graph),
+		peerStates: make(map[session]PeerState),
+	}
+}
+
+// GenerateMessage opens a conversation with dest by sending a strata
+// estimator of the local node set.
+func (policy *IBLTPolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{dest, newSessionID()}
+	policy.setPeerState(s, firstMsgSent)
+
+	zap.S().Infow("Generate first iblt msg")
+	return &IBLTMsgContent{
+		Num:       first,
+		Session:   s.id,
+		Estimator: newStrataEstimator(policy.graph.GetNodeMap()),
+	}, nil
+}
+
+// ibltExpectedStates maps each message number to the state a peer
+// must be in to accept it.
+var ibltExpectedStates = map[int]PeerState{
+	first:  noMsgExchanged,
+	second: firstMsgSent,
+	third:  firstMsgRecved,
+	fourth: thirdMsgSent,
+}
+
+// ProcessMessage advances the conversation with src.
+func (policy *IBLTPolicy) ProcessMessage(
+	src gdp.Hash,
+	packedMsg interface{},
+) (interface{}, error) {
+	zap.S().Debugw(
+		"processing message",
+		"src", src.Readable(),
+	)
+
+	msg, ok := packedMsg.(*IBLTMsgContent)
+	if !ok {
+		return nil, errIBLTMsgContentConversion
+	}
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{src, msg.Session}
+	if msg.Naive != nil {
+		// The naive policy keeps its own state for the fallback
+		policy.endConversation(s)
+		return policy.processNaiveMsg(s, msg.Naive)
+	}
+
+	expected, ok := ibltExpectedStates[msg.Num]
+	if !ok {
+		return nil, errUnknownMessageType
+	}
+	if policy.expire(s) {
+		delete(policy.peerStates, s)
+	}
+
+	// Both peers opened this conversation at the same time
+	if msg.Num == first {
+		err := policy.breakTie(s, policy.peerStates[s] == firstMsgSent, policy.endConversation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	peerState := policy.peerStates[s]
+
+	if peerState != expected {
+		policy.endConversation(s)
+		zap.S().Errorw(
+			"inconsistent state and msg",
+			"peerStatus", peerState,
+			"msgNum", msg.Num,
+		)
+		return nil, errInconsistentStateAndMessage
+	}
+
+	var resp interface{}
+	var err error
+	switch msg.Num {
+	case first:
+		resp, err = policy.processFirstMsg(s, msg)
+	case second:
+		resp, err = policy.processSecondMsg(s, msg)
+	case third:
+		resp, err = policy.processThirdMsg(s, msg)
+	case fourth:
+		err = policy.graph.WriteRecordsFrom(src, msg.RecordsNotInRX)
+		if err == nil {
+			err = ErrConversationFinished
+		}
+	}
+
+	if err != nil {
+		policy.endConversation(s)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// processFirstMsg estimates the difference with the peer and sends an
+// IBLT sized for it.
+func (policy *IBLTPolicy) processFirstMsg(
+	s session,
+	msg *IBLTMsgContent,
+) (interface{}, error) {
+	nodeMap := policy.graph.GetNodeMap()
+	estimator := newStrataEstimator(nodeMap)
+	numDiffs, err := estimator.estimate(msg.Estimator)
+	if err != nil {
+		return nil, err
+	}
+
+	table := newIBLTForDifference(numDiffs)
+	for hash := range nodeMap {
+		table.insert(hash)
+	}
+
+	zap.S().Infow(
+		"Generating second iblt msg",
+		"estimatedDiffs", numDiffs,
+		"numCells", len(table.Cells),
+	)
+	policy.setPeerState(s, firstMsgRecved)
+	return &IBLTMsgContent{Num: second, Session: s.id, Table: table}, nil
+}
+
+// processSecondMsg decodes the difference with the peer, sending the
+// records it lacks and requesting the ones we lack. If decoding fails,
+// it starts a naive exchange instead.
+func (policy *IBLTPolicy) processSecondMsg(
+	s session,
+	msg *IBLTMsgContent,
+) (interface{}, error) {
+	// The peer picks the size of the table, which we allocate
+	if msg.Table == nil || !validIBLTSize(len(msg.Table.Cells)) {
+		return nil, errIBLTSizeMismatch
+	}
+
+	table := &IBLT{Cells: make([]IBLTCell, len(msg.Table.Cells))}
+	for hash := range policy.graph.GetNodeMap() {
+		table.insert(hash)
+	}
+
+	diff, err := table.subtract(msg.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	onlyMine, onlyTheirs, ok := diff.decode()
+	if !ok {
+		zap.S().Warnw(
+			"Failed to decode iblt, falling back to naive exchange",
+			"numCells", len(msg.Table.Cells),
+		)
+		policy.endConversation(s)
+
+		// The naive exchange continues the same session
+		naiveContent := policy.naive.openSession(s)
+		return &IBLTMsgContent{
+			Num:     naiveContent.MsgNum,
+			Session: s.id,
+			Naive:   naiveContent,
+		}, nil
+	}
+
+	records, err := readRecordPage(policy.graph, s.peer, onlyMine)
+	if err != nil {
+		return nil, err
+	}
+
+	zap.S().Infow(
+		"Generating third iblt msg",
+		"numRecords", len(records),
+		"numRequests", len(onlyTheirs),
+	)
+	policy.setPeerState(s, thirdMsgSent)
+	return &IBLTMsgContent{
+		Num:            third,
+		Session:        s.id,
+		RecordsNotInRX: records,
+		HashesTXWants:  onlyTheirs,
+	}, nil
+}
+
+// processThirdMsg stores the records sent by the peer and answers its
+// requests, ending the conversation on this side.
+func (policy *IBLTPolicy) processThirdMsg(
+	s session,
+	msg *IBLTMsgContent,
+) (interface{}, error) {
+	err := policy.graph.WriteRecordsFrom(s.peer, msg.RecordsNotInRX)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := readRecordPage(policy.graph, s.peer, msg.HashesTXWants)
+	if err != nil {
+		return nil, err
+	}
+
+	zap.S().Infow(
+		"Generating fourth iblt msg",
+		"numRecords", len(records),
+	)
+	policy.endConversation(s)
+	return &IBLTMsgContent{
+		Num:            fourth,
+		Session:        s.id,
+		RecordsNotInRX: records,
+	}, nil
+}
+
+// processNaiveMsg hands a fallback message to the naive policy and
+// wraps its reply.
+func (policy *IBLTPolicy) processNaiveMsg(
+	s session,
+	msg *NaiveMsgContent,
+) (interface{}, error) {
+	resp, err := policy.naive.ProcessMessage(s.peer, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	naiveResp, ok := resp.(*NaiveMsgContent)
+	if !ok || naiveResp == nil {
+		return nil, ErrConversationFinished
+	}
+	return &IBLTMsgContent{
+		Num:     naiveResp.MsgNum,
+		Session: s.id,
+		Naive:   naiveResp,
+	}, nil
+}
+
+// SetConversationTimeout sets how long to wait for a reply, including
+// in naive exchanges.
+func (policy *IBLTPolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.conversationDeadlines.SetConversationTimeout(timeout)
+	policy.naive.SetConversationTimeout(timeout)
+}
+
+// SetAddress sets the address of the local daemon, including for naive
+// exchanges.
+func (policy *IBLTPolicy) SetAddress(addr gdp.Hash) {
+	policy.tieBreaker.SetAddress(addr)
+	policy.naive.SetAddress(addr)
+}
+
+// ExpireConversations resets the conversations with peers that have
+// not replied in time and returns those peers.
+func (policy *IBLTPolicy) ExpireConversations() []gdp.Hash {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := policy.expireAll()
+	for _, s := range expired {
+		delete(policy.peerStates, s)
+	}
+	return peersOf(append(expired, policy.naive.expireSessions()...))
+}
+
+// setPeerState records the last message exchanged in conversation s
+// and waits for its reply.
+func (policy *IBLTPolicy) setPeerState(s session, state PeerState) {
+	policy.peerStates[s] = state
+	policy.arm(s)
+}
+
+// endConversation forgets conversation s.
+func (policy *IBLTPolicy) endConversation(s session) {
+	delete(policy.peerStates, s)
+	policy.disarm(s)
+}
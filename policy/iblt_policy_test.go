@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestIBLTPolicy(t *testing.T) {
+	base := chain("base", 300, gdp.NullHash)
+	last := base[len(base)-1].Hash
+
+	graphA := graphFromRecords(t, append(base, chain("a", 4, last)...))
+	graphB := graphFromRecords(t, append(base, chain("b", 7, gdp.GenerateHash("x"))...))
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewIBLTPolicy(graphA)
+	policyB := NewIBLTPolicy(graphB)
+
+	assert.Equal(t, 4, converse(t, policyA, addrA, policyB, addrB))
+	assert.Equal(t, 311, len(graphA.GetNodeMap()))
+	assertSameNodes(t, graphA, graphB)
+	assert.Equal(t, 0, len(policyA.peerStates))
+	assert.Equal(t, 0, len(policyB.peerStates))
+}
+
+func TestIBLTPolicyFallback(t *testing.T) {
+	base := chain("base", 50, gdp.NullHash)
+
+	graphA := graphFromRecords(t, append(base, chain("a", 40, gdp.NullHash)...))
+	graphB := graphFromRecords(t, append(base, chain("b", 40, gdp.NullHash)...))
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewIBLTPolicy(graphA)
+	policyB := NewIBLTPolicy(graphB)
+
+	msg, err := policyA.GenerateMessage(addrB)
+	assert.Nil(t, err)
+	msg, err = policyB.ProcessMessage(addrA, msg)
+	assert.Nil(t, err)
+
+	// Replace the table with one too small to decode
+	table := newIBLT(ibltMinCells)
+	for hash := range graphB.GetNodeMap() {
+		table.insert(hash)
+	}
+	msg.(*IBLTMsgContent).Table = table
+
+	msg, err = policyA.ProcessMessage(addrB, msg)
+	assert.Nil(t, err)
+	assert.NotNil(t, msg.(*IBLTMsgContent).Naive)
+
+	for msg != nil {
+		msg, err = policyB.ProcessMessage(addrA, msg)
+		if err == ErrConversationFinished {
+			break
+		}
+		assert.Nil(t, err)
+		addrA, addrB = addrB, addrA
+		policyA, policyB = policyB, policyA
+	}
+	assert.Equal(t, 130, len(graphA.GetNodeMap()))
+	assertSameNodes(t, graphA, graphB)
+}
+
+func TestIBLTPolicyInvalidTable(t *testing.T) {
+	records := chain("log", 10, gdp.NullHash)
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	for _, numCells := range []int{0, 2} {
+		policyA := NewIBLTPolicy(graphFromRecords(t, records))
+		policyB := NewIBLTPolicy(graphFromRecords(t, records))
+
+		msg, err := policyA.GenerateMessage(addrB)
+		assert.Nil(t, err)
+		msg, err = policyB.ProcessMessage(addrA, msg)
+		assert.Nil(t, err)
+
+		msg.(*IBLTMsgContent).Table = &IBLT{Cells: make([]IBLTCell, numCells)}
+		msg, err = policyA.ProcessMessage(addrB, msg)
+		assert.Equal(t, errIBLTSizeMismatch, err)
+		assert.Nil(t, msg)
+		assert.Equal(t, 0, len(policyA.peerStates))
+	}
+}
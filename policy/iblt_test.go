@@ -0,0 +1,94 @@
+package policy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func hashSet(prefix string, n int) map[gdp.Hash]bool {
+	set := make(map[gdp.Hash]bool)
+	for i := 0; i < n; i++ {
+		set[gdp.GenerateHash(fmt.Sprintf("%s-%d", prefix, i))] = true
+	}
+	return set
+}
+
+func TestIBLTDecode(t *testing.T) {
+	shared := hashSet("shared", 1000)
+	mine := hashSet("mine", 10)
+	theirs := hashSet("theirs", 15)
+
+	myTable := newIBLTForDifference(25)
+	theirTable := newIBLTForDifference(25)
+	for hash := range shared {
+		myTable.insert(hash)
+		theirTable.insert(hash)
+	}
+	for hash := range mine {
+		myTable.insert(hash)
+	}
+	for hash := range theirs {
+		theirTable.insert(hash)
+	}
+
+	diff, err := myTable.subtract(theirTable)
+	assert.Nil(t, err)
+	onlyMine, onlyTheirs, ok := diff.decode()
+	assert.True(t, ok)
+	assert.Equal(t, len(mine), len(onlyMine))
+	assert.Equal(t, len(theirs), len(onlyTheirs))
+	for _, hash := range onlyMine {
+		assert.True(t, mine[hash])
+	}
+	for _, hash := range onlyTheirs {
+		assert.True(t, theirs[hash])
+	}
+
+	// A difference much larger than the table cannot be decoded
+	small := newIBLT(ibltMinCells)
+	for hash := range hashSet("many", 100) {
+		small.insert(hash)
+	}
+	_, _, ok = small.decode()
+	assert.False(t, ok)
+
+	_, err = small.subtract(myTable)
+	assert.Equal(t, errIBLTSizeMismatch, err)
+}
+
+func TestIBLTDecodeForged(t *testing.T) {
+	// A pure cell whose hash belongs in other cells
+	table := newIBLT(ibltMinCells)
+	var hash gdp.Hash
+	for i := 0; ; i++ {
+		hash = gdp.GenerateHash(fmt.Sprint("forged-", i))
+		if table.indexes(hash)[0] != 0 {
+			break
+		}
+	}
+	table.Cells[0] = IBLTCell{Count: 1, KeySum: hash, HashSum: ibltChecksum(hash)}
+
+	onlyMine, onlyTheirs, ok := table.decode()
+	assert.False(t, ok)
+	assert.True(t, len(onlyMine)+len(onlyTheirs) <= len(table.Cells))
+}
+
+func TestStrataEstimator(t *testing.T) {
+	shared := hashSet("shared", 2000)
+	mine := newStrataEstimator(shared)
+	theirs := newStrataEstimator(shared)
+
+	numDiffs, err := mine.estimate(theirs)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, numDiffs)
+
+	for hash := range hashSet("extra", 300) {
+		shared[hash] = true
+	}
+	numDiffs, err = newStrataEstimator(shared).estimate(theirs)
+	assert.Nil(t, err)
+	assert.True(t, numDiffs >= 150 && numDiffs <= 600, "estimated %d", numDiffs)
+}
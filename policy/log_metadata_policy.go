@@ -0,0 +1,165 @@
+package policy
+
+import (
+	"errors"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
+
+var (
+	errLogMetadataMsgContentConversion = errors.New(
+		"Unable to cast packedMsg to *LogMetadataMsgContent",
+	)
+	errLogNameMismatch = errors.New("peer replicates a log with another name")
+)
+
+// LogMetadataPolicy wraps a Policy to replicate the metadata record of
+// a log ahead of its records.
+//
+// Every message carries the name of the log of its sender. Messages
+// opening a conversation carry the metadata record as well, and so do
+// replies to a peer without it. The metadata record of a message is
+// written before the wrapped policy handles it, so the records of the
+// message are verified with its writer key. Messages from a peer whose
+// log has another name are refused, and so are metadata records of
+// another log than the one replicated, since they would let the peer
+// pick the writer key.
+type LogMetadataPolicy struct {
+	wrappedPolicy
+
+	graph loggraph.LogGraph
+
+	// name is the name of the log replicated, gdp.NullHash if unknown.
+	// An unnamed log only takes a metadata record from peers if
+	// adoptMetadata is set
+	name          gdp.Hash
+	adoptMetadata bool
+}
+
+// LogMetadataMsgContent wraps the message of the wrapped policy.
+type LogMetadataMsgContent struct {
+	// Name is the name of the log of the sender, gdp.NullHash if it
+	// does not have the metadata record yet
+	Name gdp.Hash
+
+	// Metadata is the metadata record of the sender, if attached
+	Metadata *gdp.LogMetadata
+
+	Inner interface{}
+}
+
+// NewLogMetadataPolicy wraps policy, which replicates graph, the log
+// name.
+func NewLogMetadataPolicy(
+	graph loggraph.LogGraph,
+	name gdp.Hash,
+	policy Policy,
+) *LogMetadataPolicy {
+	return &LogMetadataPolicy{
+		wrappedPolicy: wrappedPolicy{policy},
+		graph:         graph,
+		name:          name,
+	}
+}
+
+// SetAdoptMetadata sets whether an unnamed log takes the metadata
+// record of the first peer sending one, trusting it with the writer
+// key of the log.
+func (policy *LogMetadataPolicy) SetAdoptMetadata(adopt bool) {
+	policy.adoptMetadata = adopt
+}
+
+// GenerateMessage wraps the message opening a conversation with dest.
+func (policy *LogMetadataPolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	inner, err := policy.Policy.GenerateMessage(dest)
+	if err != nil || inner == nil {
+		return nil, err
+	}
+	msg := policy.wrap(inner)
+	msg.Metadata = policy.graph.GetLogMetadata()
+	return msg, nil
+}
+
+// ProcessMessage writes the metadata record of a message from src,
+// hands the wrapped message to the wrapped policy and wraps its reply.
+func (policy *LogMetadataPolicy) ProcessMessage(
+	src gdp.Hash,
+	packedMsg interface{},
+) (interface{}, error) {
+	msg, ok := packedMsg.(*LogMetadataMsgContent)
+	if !ok {
+		return nil, errLogMetadataMsgContentConversion
+	}
+
+	if msg.Metadata != nil && policy.graph.GetLogMetadata() == nil {
+		err := policy.writeLogMetadata(src, msg.Metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	name := policy.graph.GetLogName()
+	if name != gdp.NullHash && msg.Name != gdp.NullHash && name != msg.Name {
+		zap.S().Warnw(
+			"Refusing message for another log",
+			"src", src.Readable(),
+			"log", name.Readable(),
+			"peerLog", msg.Name.Readable(),
+		)
+		return nil, errLogNameMismatch
+	}
+
+	inner, err := policy.Policy.ProcessMessage(src, msg.Inner)
+	if err != nil || inner == nil {
+		return nil, err
+	}
+
+	resp := policy.wrap(inner)
+	if msg.Name != resp.Name {
+		resp.Metadata = policy.graph.GetLogMetadata()
+	}
+	return resp, nil
+}
+
+// writeLogMetadata writes metadata, the metadata record sent by src,
+// if it is the one of the log replicated.
+func (policy *LogMetadataPolicy) writeLogMetadata(
+	src gdp.Hash,
+	metadata *gdp.LogMetadata,
+) error {
+	peerName := metadata.Name()
+	if policy.name == gdp.NullHash && !policy.adoptMetadata {
+		zap.S().Debugw(
+			"Ignoring log metadata from peer",
+			"src", src.Readable(),
+			"peerLog", peerName.Readable(),
+		)
+		return nil
+	}
+	if policy.name != gdp.NullHash && policy.name != peerName {
+		zap.S().Warnw(
+			"Refusing log metadata for another log",
+			"src", src.Readable(),
+			"log", policy.name.Readable(),
+			"peerLog", peerName.Readable(),
+		)
+		return errLogNameMismatch
+	}
+
+	zap.S().Infow(
+		"Writing log metadata from peer",
+		"src", src.Readable(),
+		"log", peerName.Readable(),
+	)
+	return policy.graph.WriteLogMetadata(*metadata)
+}
+
+// wrap wraps inner with the name of the local log.
+func (policy *LogMetadataPolicy) wrap(inner interface{}) *LogMetadataMsgContent {
+	return &LogMetadataMsgContent{
+		Name:  policy.graph.GetLogName(),
+		Inner: inner,
+	}
+}
@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// signedLog returns the metadata record of a log and n records after
+// it signed by its writer.
+func signedLog(t *testing.T, n int) (gdp.LogMetadata, []gdp.Record) {
+	writerKey, writer, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(writerKey)
+	assert.Nil(t, err)
+	metadata := gdp.LogMetadata{WriterKey: der, Created: 1}
+
+	records := make([]gdp.Record, 0, n)
+	prev := metadata.Name()
+	for i := 1; i <= n; i++ {
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{RecNo: i, PrevHash: prev},
+			Value:     []byte("signed"),
+		}
+		assert.Nil(t, gdp.SignRecord(writer, &record))
+		records = append(records, record)
+		prev = record.Hash
+	}
+	return metadata, records
+}
+
+func TestLogMetadataPolicy(t *testing.T) {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	for name, newPolicy := range conformancePolicies {
+		// Either replica may open the first conversation
+		for _, aOpens := range []bool{true, false} {
+			metadata, records := signedLog(t, 10)
+			graphA := graphFromRecords(t, records)
+			assert.Nil(t, graphA.WriteLogMetadata(metadata), name)
+			graphB := graphFromRecords(t, nil)
+
+			policyA := NewLogMetadataPolicy(graphA, metadata.Name(), newPolicy(graphA))
+			policyB := NewLogMetadataPolicy(graphB, metadata.Name(), newPolicy(graphB))
+			for round := 0; round < 3; round++ {
+				if aOpens {
+					converse(t, policyA, addrA, policyB, addrB)
+				} else {
+					converse(t, policyB, addrB, policyA, addrA)
+				}
+			}
+
+			assertSameNodes(t, graphA, graphB)
+			assert.Equal(t, metadata.Name(), graphB.GetLogName(), name)
+			for _, record := range records {
+				assert.True(t, graphB.IsRooted(record.Hash), name)
+			}
+		}
+	}
+}
+
+func TestLogMetadataPolicyOtherLog(t *testing.T) {
+	metadataA, recordsA := signedLog(t, 3)
+	metadataB, recordsB := signedLog(t, 3)
+	graphA := graphFromRecords(t, recordsA)
+	assert.Nil(t, graphA.WriteLogMetadata(metadataA))
+	graphB := graphFromRecords(t, recordsB)
+	assert.Nil(t, graphB.WriteLogMetadata(metadataB))
+
+	policyA := NewLogMetadataPolicy(graphA, metadataA.Name(), NewNaivePolicy(graphA))
+	policyB := NewLogMetadataPolicy(graphB, metadataB.Name(), NewNaivePolicy(graphB))
+
+	msg, err := policyA.GenerateMessage(gdp.GenerateHash("B"))
+	assert.Nil(t, err)
+	_, err = policyB.ProcessMessage(gdp.GenerateHash("A"), msg)
+	assert.Equal(t, errLogNameMismatch, err)
+	assert.Equal(t, 3, len(graphB.GetNodeMap()))
+	assert.Equal(t, metadataB.Name(), graphB.GetLogName())
+}
+
+func TestLogMetadataPolicyForgedMetadata(t *testing.T) {
+	metadata, _ := signedLog(t, 3)
+	forged, forgedRecords := signedLog(t, 3)
+	graphA := graphFromRecords(t, forgedRecords)
+	assert.Nil(t, graphA.WriteLogMetadata(forged))
+	graphB := graphFromRecords(t, nil)
+
+	policyA := NewLogMetadataPolicy(graphA, forged.Name(), NewNaivePolicy(graphA))
+	policyB := NewLogMetadataPolicy(graphB, metadata.Name(), NewNaivePolicy(graphB))
+
+	msg, err := policyA.GenerateMessage(gdp.GenerateHash("B"))
+	assert.Nil(t, err)
+	_, err = policyB.ProcessMessage(gdp.GenerateHash("A"), msg)
+	assert.Equal(t, errLogNameMismatch, err)
+	assert.Nil(t, graphB.GetLogMetadata())
+	assert.Equal(t, 0, len(graphB.GetNodeMap()))
+}
+
+func TestLogMetadataPolicyUnnamedLog(t *testing.T) {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	for _, adopt := range []bool{false, true} {
+		metadata, records := signedLog(t, 3)
+		graphA := graphFromRecords(t, records)
+		assert.Nil(t, graphA.WriteLogMetadata(metadata))
+		graphB := graphFromRecords(t, nil)
+
+		policyA := NewLogMetadataPolicy(graphA, metadata.Name(), NewNaivePolicy(graphA))
+		policyB := NewLogMetadataPolicy(graphB, gdp.NullHash, NewNaivePolicy(graphB))
+		policyB.SetAdoptMetadata(adopt)
+		converse(t, policyA, addrA, policyB, addrB)
+
+		if adopt {
+			assert.Equal(t, metadata.Name(), graphB.GetLogName())
+		} else {
+			assert.Nil(t, graphB.GetLogMetadata())
+		}
+	}
+}
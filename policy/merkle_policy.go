@@ -0,0 +1,297 @@
+package policy
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
+
+var errMerkleMsgContentConversion = errors.New(
+	"Unable to cast packedMsg to *MerkleMsgContent",
+)
+
+// MerklePolicy is a Policy that keeps a Merkle tree over the hash space
+// of the graph and compares subtree digests with a peer top-down.
+// Only subtrees whose digests differ are expanded, so a conversation
+// costs bandwidth proportional to the difference between the peers
+// rather than to the size of the log.
+//
+// A conversation is a sequence of replies in which each side answers
+// the digests, buckets and requests of the previous message. It ends
+// once a message asks nothing of its receiver.
+type MerklePolicy struct {
+	conversationDeadlines
+	tieBreaker
+
+	graph loggraph.LogGraph
+
+	// tree over the graph, which a hook keeps up to date as records
+	// are written. Hooks run while conversations hold mutex, so the
+	// tree has its own
+	tree      *merkleTree
+	treeMutex sync.Mutex
+
+	// tree in use for each conversation in progress
+	trees map[session]*merkleTree
+
+	// conversations we opened that the peer has not replied to yet
+	opened map[session]bool
+
+	mutex sync.Mutex
+}
+
+// MerkleMsgContent holds all communication info for Merkle policy
+// peers. All fields are labelled from the perspective of the sender.
+type MerkleMsgContent struct {
+	// Num is first for the message opening a conversation and second
+	// for every reply after it
+	Num     int
+	Session SessionID
+
+	// Digests of subtrees the receiver should compare with its own
+	Digests []MerkleDigest
+
+	// Buckets are leaves whose digests differed
+	Buckets []MerkleBucket
+
+	// EmptyNodes are subtrees the sender has no hashes in; the
+	// receiver should send everything it has there
+	EmptyNodes []MerkleNode
+
+	RecordsNotInRX []gdp.Record
+	HashesTXWants  []gdp.Hash
+}
+
+// NewMerklePolicy constructs a MerklePolicy over graph.
+func NewMerklePolicy(graph loggraph.LogGraph) *MerklePolicy {
+	policy := &MerklePolicy{
+		graph:  graph,
+		tree:   newMerkleTree(graph.GetNodeMap()),
+		trees:  make(map[session]*merkleTree),
+		opened: make(map[session]bool),
+	}
+	graph.AddHook(policy.addRecords)
+	return policy
+}
+
+// addRecords adds records newly written to the graph to the tree. It
+// is a loggraph.Hook.
+func (policy *MerklePolicy) addRecords(src gdp.Hash, records []gdp.Record) {
+	hashes := make([]gdp.Hash, 0, len(records))
+	for _, record := range records {
+		hashes = append(hashes, record.Hash)
+	}
+
+	policy.treeMutex.Lock()
+	defer policy.treeMutex.Unlock()
+
+	policy.tree = policy.tree.with(hashes)
+}
+
+// currentTree returns the tree over the graph. Hooks are not told of
+// deleted records, so the tree is built again once it holds more
+// records than the graph.
+func (policy *MerklePolicy) currentTree() *merkleTree {
+	policy.treeMutex.Lock()
+	defer policy.treeMutex.Unlock()
+
+	if policy.tree.size > policy.graph.NumNodes() {
+		policy.tree = newMerkleTree(policy.graph.GetNodeMap())
+	}
+	return policy.tree
+}
+
+// GenerateMessage opens a conversation with dest by sending the root
+// digest of the current graph.
+func (policy *MerklePolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{dest, newSessionID()}
+	tree := policy.currentTree()
+	policy.trees[s] = tree
+	policy.opened[s] = true
+	policy.arm(s)
+
+	zap.S().Infow("Generate first merkle msg")
+	return &MerkleMsgContent{
+		Num:     first,
+		Session: s.id,
+		Digests: []MerkleDigest{tree.root()},
+	}, nil
+}
+
+// ProcessMessage answers the digests, buckets and requests of a
+// message from src.
+func (policy *MerklePolicy) ProcessMessage(
+	src gdp.Hash,
+	packedMsg interface{},
+) (interface{}, error) {
+	zap.S().Debugw(
+		"processing message",
+		"src", src.Readable(),
+	)
+
+	msg, ok := packedMsg.(*MerkleMsgContent)
+	if !ok {
+		return nil, errMerkleMsgContentConversion
+	}
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{src, msg.Session}
+	if policy.expire(s) {
+		policy.endConversation(s)
+	}
+
+	// Both peers opened this conversation at the same time
+	if msg.Num == first {
+		err := policy.breakTie(s, policy.opened[s], policy.endConversation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	delete(policy.opened, s)
+
+	switch msg.Num {
+	case first:
+		policy.trees[s] = policy.currentTree()
+	case second:
+		if _, present := policy.trees[s]; !present {
+			zap.S().Errorw(
+				"inconsistent state and msg",
+				"msgNum", msg.Num,
+			)
+			return nil, errInconsistentStateAndMessage
+		}
+	default:
+		return nil, errUnknownMessageType
+	}
+
+	err := policy.graph.WriteRecordsFrom(src, msg.RecordsNotInRX)
+	if err != nil {
+		policy.endConversation(s)
+		return nil, err
+	}
+
+	if msg.isTerminal() {
+		policy.endConversation(s)
+		return nil, ErrConversationFinished
+	}
+
+	resp, err := policy.reply(s.peer, policy.trees[s], msg)
+	if err != nil {
+		policy.endConversation(s)
+		return nil, err
+	}
+	resp.Session = s.id
+
+	zap.S().Infow(
+		"Generating merkle reply",
+		"numDigests", len(resp.Digests),
+		"numBuckets", len(resp.Buckets),
+		"numEmptyNodes", len(resp.EmptyNodes),
+		"numRecords", len(resp.RecordsNotInRX),
+		"numRequests", len(resp.HashesTXWants),
+	)
+
+	// The peer expects nothing after a terminal reply; it is still
+	// sent so that the peer can close its side of the conversation.
+	if resp.isTerminal() {
+		policy.endConversation(s)
+	} else {
+		policy.arm(s)
+	}
+	return resp, nil
+}
+
+// ExpireConversations resets the conversations with peers that have
+// not replied in time and returns those peers.
+func (policy *MerklePolicy) ExpireConversations() []gdp.Hash {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := policy.expireAll()
+	for _, s := range expired {
+		delete(policy.trees, s)
+		delete(policy.opened, s)
+	}
+	return peersOf(expired)
+}
+
+// endConversation forgets conversation s.
+func (policy *MerklePolicy) endConversation(s session) {
+	delete(policy.trees, s)
+	delete(policy.opened, s)
+	policy.disarm(s)
+}
+
+// reply builds the answer to msg from peer using tree as the local
+// view.
+func (policy *MerklePolicy) reply(
+	peer gdp.Hash,
+	tree *merkleTree,
+	msg *MerkleMsgContent,
+) (*MerkleMsgContent, error) {
+	resp := &MerkleMsgContent{Num: second}
+	nodesToSend := make([]gdp.Hash, 0)
+
+	for _, peerDigest := range msg.Digests {
+		myDigest := tree.digest(peerDigest.MerkleNode)
+		switch {
+		case myDigest == peerDigest.Digest:
+			continue
+		case myDigest == gdp.NullHash:
+			resp.EmptyNodes = append(resp.EmptyNodes, peerDigest.MerkleNode)
+		case peerDigest.Digest == gdp.NullHash:
+			nodesToSend = append(
+				nodesToSend,
+				tree.hashesUnder(peerDigest.MerkleNode)...,
+			)
+		case peerDigest.Level == merkleDepth:
+			resp.Buckets = append(resp.Buckets, MerkleBucket{
+				MerkleNode: peerDigest.MerkleNode,
+				Hashes:     tree.bucket(peerDigest.MerkleNode),
+			})
+		default:
+			resp.Digests = append(
+				resp.Digests,
+				tree.children(peerDigest.MerkleNode)...,
+			)
+		}
+	}
+
+	for _, node := range msg.EmptyNodes {
+		nodesToSend = append(nodesToSend, tree.hashesUnder(node)...)
+	}
+
+	for _, bucket := range msg.Buckets {
+		onlyMine, onlyTheirs := findDifferences(
+			tree.bucket(bucket.MerkleNode),
+			bucket.Hashes,
+		)
+		nodesToSend = append(nodesToSend, onlyMine...)
+		resp.HashesTXWants = append(resp.HashesTXWants, onlyTheirs...)
+	}
+
+	nodesToSend = append(nodesToSend, msg.HashesTXWants...)
+
+	records, err := readRecordPage(policy.graph, peer, nodesToSend)
+	if err != nil {
+		return nil, err
+	}
+	resp.RecordsNotInRX = records
+	return resp, nil
+}
+
+// isTerminal reports whether msg asks nothing of its receiver.
+func (msg *MerkleMsgContent) isTerminal() bool {
+	return len(msg.Digests) == 0 &&
+		len(msg.Buckets) == 0 &&
+		len(msg.EmptyNodes) == 0 &&
+		len(msg.HashesTXWants) == 0
+}
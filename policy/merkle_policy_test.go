@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+func TestMerklePolicy(t *testing.T) {
+	base := chain("base", 200, gdp.NullHash)
+	last := base[len(base)-1].Hash
+
+	graphA := graphFromRecords(t, append(base, chain("a", 3, last)...))
+	graphB := graphFromRecords(t, append(base, chain("b", 5, gdp.GenerateHash("hole"))...))
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewMerklePolicy(graphA)
+	policyB := NewMerklePolicy(graphB)
+
+	converse(t, policyA, addrA, policyB, addrB)
+	assert.Equal(t, 208, len(graphA.GetNodeMap()))
+	assertSameNodes(t, graphA, graphB)
+	assert.Equal(t, 0, len(policyA.trees))
+	assert.Equal(t, 0, len(policyB.trees))
+
+	// Peers in sync only exchange the root digest
+	msg, err := policyB.GenerateMessage(addrA)
+	assert.Nil(t, err)
+	resp, err := policyA.ProcessMessage(addrB, msg)
+	assert.Nil(t, err)
+	assert.True(t, resp.(*MerkleMsgContent).isTerminal())
+	assert.Equal(t, 0, len(resp.(*MerkleMsgContent).RecordsNotInRX))
+
+	resp, err = policyB.ProcessMessage(addrA, resp)
+	assert.Equal(t, ErrConversationFinished, err)
+	assert.Nil(t, resp)
+}
+
+func TestMerklePolicyTreeFollowsGraph(t *testing.T) {
+	records := chain("tree", 20, gdp.NullHash)
+	graph := graphFromRecords(t, records[:10])
+	policy := NewMerklePolicy(graph)
+
+	// Conversations share the tree until the graph changes
+	tree := policy.currentTree()
+	assert.True(t, tree == policy.currentTree())
+
+	// Writes add their records to the tree
+	assert.Nil(t, graph.WriteRecords(records[10:]))
+	assert.Equal(t, 20, policy.currentTree().size)
+	assert.Equal(t, newMerkleTree(graph.GetNodeMap()).root(), policy.currentTree().root())
+	assert.Equal(t, 10, tree.size)
+
+	// Deletes make it build the tree again
+	_, err := graph.Prune(logserver.Retention{MaxRecords: 15})
+	assert.Nil(t, err)
+	assert.Equal(t, 15, policy.currentTree().size)
+	assert.Equal(t, newMerkleTree(graph.GetNodeMap()).root(), policy.currentTree().root())
+}
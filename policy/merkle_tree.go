@@ -0,0 +1,261 @@
+package policy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Shape of the Merkle tree over the hash space. Every level of the tree
+// consumes one nibble of a hash, so a node at level l covers all hashes
+// sharing the same first l nibbles. Both peers must agree on the shape.
+const (
+	merkleFanout = 16
+	merkleDepth  = 4
+)
+
+// MerkleNode identifies a subtree of the hash space: all hashes whose
+// first Level nibbles equal Index.
+type MerkleNode struct {
+	Level int
+	Index int
+}
+
+// MerkleDigest is the digest of a subtree as seen by the sender.
+type MerkleDigest struct {
+	MerkleNode
+	Digest gdp.Hash
+}
+
+// MerkleBucket holds every hash of the sender found in a leaf.
+type MerkleBucket struct {
+	MerkleNode
+	Hashes []gdp.Hash
+}
+
+// merkleTree is a persistent Merkle tree over a set of hashes: adding
+// hashes returns a new tree sharing every unchanged subtree with the
+// old one, which stays valid. A conversation can thus keep the tree it
+// started with while the policy keeps its own up to date with the
+// graph, each write only rehashing the paths to the hashes it adds.
+// Empty subtrees are nil and have gdp.NullHash as digest.
+type merkleTree struct {
+	top  *merkleSubtree
+	size int
+}
+
+// merkleSubtree is a non-empty node of a merkleTree. Interior nodes
+// have children, and leaves the sorted hashes of their bucket. It is
+// never modified once built.
+type merkleSubtree struct {
+	digest   gdp.Hash
+	children [merkleFanout]*merkleSubtree
+	hashes   []gdp.Hash
+}
+
+// newMerkleTree builds a tree over all hashes in nodeMap.
+func newMerkleTree(nodeMap map[gdp.Hash]bool) *merkleTree {
+	hashes := make([]gdp.Hash, 0, len(nodeMap))
+	for hash := range nodeMap {
+		hashes = append(hashes, hash)
+	}
+	return (&merkleTree{}).with(hashes)
+}
+
+// with returns the tree holding the hashes of tree and hashes.
+func (tree *merkleTree) with(hashes []gdp.Hash) *merkleTree {
+	if len(hashes) == 0 {
+		return tree
+	}
+	top, numAdded := tree.top.with(0, hashes)
+	if numAdded == 0 {
+		return tree
+	}
+	return &merkleTree{top: top, size: tree.size + numAdded}
+}
+
+// with returns subtree, at level, with hashes added, and the number of
+// hashes it did not hold yet. All hashes fall under subtree.
+func (subtree *merkleSubtree) with(level int, hashes []gdp.Hash) (*merkleSubtree, int) {
+	updated := &merkleSubtree{}
+	if subtree != nil {
+		*updated = *subtree
+	}
+
+	if level == merkleDepth {
+		held := initSet(updated.hashes)
+		merged := append(make([]gdp.Hash, 0, len(held)+len(hashes)), updated.hashes...)
+		for _, hash := range hashes {
+			if _, present := held[hash]; !present {
+				held[hash] = false
+				merged = append(merged, hash)
+			}
+		}
+		numAdded := len(merged) - len(updated.hashes)
+		if numAdded == 0 {
+			return subtree, 0
+		}
+		sortHashes(merged)
+		updated.hashes = merged
+		updated.digest = digestHashes(merged)
+		return updated, numAdded
+	}
+
+	var partitions [merkleFanout][]gdp.Hash
+	for _, hash := range hashes {
+		child := merkleIndex(hash, level+1) % merkleFanout
+		partitions[child] = append(partitions[child], hash)
+	}
+
+	numAdded := 0
+	for i, partition := range partitions {
+		if len(partition) == 0 {
+			continue
+		}
+		child, numChildAdded := updated.children[i].with(level+1, partition)
+		updated.children[i] = child
+		numAdded += numChildAdded
+	}
+	if numAdded == 0 {
+		return subtree, 0
+	}
+
+	childDigests := make([]gdp.Hash, 0, merkleFanout)
+	for _, child := range updated.children {
+		childDigests = append(childDigests, child.digestOrNull())
+	}
+	updated.digest = digestHashes(childDigests)
+	return updated, numAdded
+}
+
+// digestOrNull returns the digest of subtree, gdp.NullHash if it is
+// empty.
+func (subtree *merkleSubtree) digestOrNull() gdp.Hash {
+	if subtree == nil {
+		return gdp.NullHash
+	}
+	return subtree.digest
+}
+
+// find returns the subtree at node, nil if it is empty or out of the
+// tree.
+func (tree *merkleTree) find(node MerkleNode) *merkleSubtree {
+	if node.Level < 0 || node.Level > merkleDepth || node.Index < 0 {
+		return nil
+	}
+
+	width := 1
+	for level := 0; level < node.Level; level++ {
+		width *= merkleFanout
+	}
+	if node.Index >= width {
+		return nil
+	}
+
+	subtree := tree.top
+	for level := 0; level < node.Level && subtree != nil; level++ {
+		width /= merkleFanout
+		subtree = subtree.children[node.Index/width%merkleFanout]
+	}
+	return subtree
+}
+
+// root returns the digest of the whole tree.
+func (tree *merkleTree) root() MerkleDigest {
+	return MerkleDigest{
+		MerkleNode: MerkleNode{Level: 0, Index: 0},
+		Digest:     tree.digest(MerkleNode{Level: 0, Index: 0}),
+	}
+}
+
+// digest returns the digest of a node, gdp.NullHash if it is empty.
+func (tree *merkleTree) digest(node MerkleNode) gdp.Hash {
+	return tree.find(node).digestOrNull()
+}
+
+// children returns the digests of all children of an interior node,
+// including empty ones.
+func (tree *merkleTree) children(node MerkleNode) []MerkleDigest {
+	digests := make([]MerkleDigest, 0, merkleFanout)
+	for i := 0; i < merkleFanout; i++ {
+		child := MerkleNode{
+			Level: node.Level + 1,
+			Index: node.Index*merkleFanout + i,
+		}
+		digests = append(digests, MerkleDigest{
+			MerkleNode: child,
+			Digest:     tree.digest(child),
+		})
+	}
+	return digests
+}
+
+// bucket returns the hashes stored in a leaf.
+func (tree *merkleTree) bucket(node MerkleNode) []gdp.Hash {
+	if node.Level != merkleDepth {
+		return nil
+	}
+	if leaf := tree.find(node); leaf != nil {
+		return leaf.hashes
+	}
+	return nil
+}
+
+// hashesUnder returns every hash stored in the subtree rooted at node.
+func (tree *merkleTree) hashesUnder(node MerkleNode) []gdp.Hash {
+	hashes := make([]gdp.Hash, 0)
+	var walk func(subtree *merkleSubtree)
+	walk = func(subtree *merkleSubtree) {
+		if subtree == nil {
+			return
+		}
+		hashes = append(hashes, subtree.hashes...)
+		for _, child := range subtree.children {
+			walk(child)
+		}
+	}
+	walk(tree.find(node))
+	return hashes
+}
+
+// merkleIndex returns the index of the node at level containing hash.
+func merkleIndex(hash gdp.Hash, level int) int {
+	index := 0
+	for i := 0; i < level; i++ {
+		nibble := hash[i/2]
+		if i%2 == 0 {
+			nibble >>= 4
+		}
+		index = index*merkleFanout + int(nibble&0x0f)
+	}
+	return index
+}
+
+// digestHashes hashes the concatenation of hashes. A list of only
+// empty digests is itself empty.
+func digestHashes(hashes []gdp.Hash) gdp.Hash {
+	empty := true
+	hasher := sha256.New()
+	for _, hash := range hashes {
+		if hash != gdp.NullHash {
+			empty = false
+		}
+		hasher.Write(hash[:])
+	}
+	if empty {
+		return gdp.NullHash
+	}
+
+	var digest gdp.Hash
+	copy(digest[:], hasher.Sum(nil))
+	return digest
+}
+
+// sortHashes sorts hashes in place in byte order.
+func sortHashes(hashes []gdp.Hash) {
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+}
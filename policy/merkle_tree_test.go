@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestMerkleTreeDigests(t *testing.T) {
+	nodeMap := make(map[gdp.Hash]bool)
+	for _, record := range chain("tree", 50, gdp.NullHash) {
+		nodeMap[record.Hash] = true
+	}
+
+	tree := newMerkleTree(nodeMap)
+	same := newMerkleTree(nodeMap)
+	assert.Equal(t, tree.root(), same.root())
+	assert.NotEqual(t, gdp.NullHash, tree.root().Digest)
+	assert.Equal(t, 50, len(tree.hashesUnder(MerkleNode{})))
+
+	extra := gdp.GenerateHash("extra")
+	nodeMap[extra] = true
+	other := newMerkleTree(nodeMap)
+	assert.NotEqual(t, tree.root().Digest, other.root().Digest)
+
+	// Only the path to the new hash differs
+	for level := 1; level <= merkleDepth; level++ {
+		node := MerkleNode{Level: level, Index: merkleIndex(extra, level)}
+		assert.NotEqual(t, tree.digest(node), other.digest(node))
+
+		sibling := MerkleNode{Level: level, Index: node.Index ^ 1}
+		assert.Equal(t, tree.digest(sibling), other.digest(sibling))
+	}
+
+	leaf := MerkleNode{Level: merkleDepth, Index: merkleIndex(extra, merkleDepth)}
+	assert.Contains(t, other.bucket(leaf), extra)
+	assert.Equal(t, gdp.NullHash, newMerkleTree(nil).root().Digest)
+}
+
+func TestMerkleTreeWith(t *testing.T) {
+	records := chain("tree", 300, gdp.NullHash)
+	hashes := make([]gdp.Hash, 0, len(records))
+	nodeMap := make(map[gdp.Hash]bool)
+	for _, record := range records {
+		hashes = append(hashes, record.Hash)
+		nodeMap[record.Hash] = true
+	}
+
+	// Adding hashes in steps gives the tree built at once
+	tree := newMerkleTree(nil).with(hashes[:100])
+	grown := tree.with(hashes[50:])
+	built := newMerkleTree(nodeMap)
+	assert.Equal(t, 300, grown.size)
+	assert.Equal(t, built.root(), grown.root())
+	assert.ElementsMatch(t, hashes, grown.hashesUnder(MerkleNode{}))
+	for _, hash := range hashes[:20] {
+		leaf := MerkleNode{Level: merkleDepth, Index: merkleIndex(hash, merkleDepth)}
+		assert.Equal(t, built.bucket(leaf), grown.bucket(leaf))
+	}
+
+	// The old tree is unchanged
+	assert.Equal(t, 100, tree.size)
+	assert.Equal(t, 100, len(tree.hashesUnder(MerkleNode{})))
+	assert.Equal(t, newMerkleTree(nil).with(hashes[:100]).root(), tree.root())
+
+	// Adding held hashes changes nothing
+	assert.True(t, grown == grown.with(hashes[:10]))
+
+	// Nodes outside the tree are empty
+	assert.Equal(t, gdp.NullHash, grown.digest(MerkleNode{Level: 1, Index: merkleFanout}))
+	assert.Nil(t, grown.bucket(MerkleNode{Level: 1, Index: 0}))
+}
@@ -0,0 +1,123 @@
+package policy
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Mode restricts the direction in which records flow between a
+// replica and a peer.
+type Mode int
+
+const (
+	// Bidirectional sends the records a peer lacks and fetches the
+	// records we lack
+	Bidirectional Mode = iota
+
+	// PushOnly sends the records a peer lacks and never stores the
+	// records of the peer, e.g. for edge gateways
+	PushOnly
+
+	// PullOnly fetches the records we lack and never sends any, e.g.
+	// for archival replicas
+	PullOnly
+)
+
+// ParseMode parses the name of a Mode.
+func ParseMode(name string) (Mode, error) {
+	switch name {
+	case "", "bidirectional":
+		return Bidirectional, nil
+	case "push":
+		return PushOnly, nil
+	case "pull":
+		return PullOnly, nil
+	}
+	return Bidirectional, fmt.Errorf("unknown replication mode %q", name)
+}
+
+func (mode Mode) String() string {
+	switch mode {
+	case PushOnly:
+		return "push"
+	case PullOnly:
+		return "pull"
+	}
+	return "bidirectional"
+}
+
+// pushes reports whether records may be sent under mode.
+func (mode Mode) pushes() bool {
+	return mode != PullOnly
+}
+
+// pulls reports whether records may be stored under mode.
+func (mode Mode) pulls() bool {
+	return mode != PushOnly
+}
+
+// canSend reports whether records should be sent to a peer that
+// announced peerMode.
+func (mode Mode) canSend(peerMode Mode) bool {
+	return mode.pushes() && peerMode.pulls()
+}
+
+// canReceive reports whether records should be requested from a peer
+// that announced peerMode.
+func (mode Mode) canReceive(peerMode Mode) bool {
+	return mode.pulls() && peerMode.pushes()
+}
+
+// ModalPolicy is a Policy whose direction of replication can be
+// restricted for all peers or for specific peers. Peers announce
+// their modes to each other so that no records are sent in vain.
+type ModalPolicy interface {
+	Policy
+
+	// SetMode sets the mode used with peers without a mode of their own
+	SetMode(mode Mode)
+
+	// SetPeerMode sets the mode used with a specific peer
+	SetPeerMode(peer gdp.Hash, mode Mode)
+}
+
+// peerModes keeps the mode used with each peer. Policies embed it to
+// implement ModalPolicy.
+type peerModes struct {
+	defaultMode Mode
+	modes       map[gdp.Hash]Mode
+	mutex       sync.RWMutex
+}
+
+// SetMode sets the mode used with peers without a mode of their own.
+func (modes *peerModes) SetMode(mode Mode) {
+	modes.mutex.Lock()
+	defer modes.mutex.Unlock()
+
+	modes.defaultMode = mode
+}
+
+// SetPeerMode sets the mode used with a specific peer.
+func (modes *peerModes) SetPeerMode(peer gdp.Hash, mode Mode) {
+	modes.mutex.Lock()
+	defer modes.mutex.Unlock()
+
+	if modes.modes == nil {
+		modes.modes = make(map[gdp.Hash]Mode)
+	}
+	modes.modes[peer] = mode
+}
+
+// modeFor returns the mode used with peer.
+func (modes *peerModes) modeFor(peer gdp.Hash) Mode {
+	modes.mutex.RLock()
+	defer modes.mutex.RUnlock()
+
+	mode, present := modes.modes[peer]
+	if !present {
+		return modes.defaultMode
+	}
+	return mode
+}
@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+)
+
+// modalPolicies constructs the policies supporting modes.
+var modalPolicies = map[string]func(loggraph.LogGraph) ModalPolicy{
+	"naive": func(graph loggraph.LogGraph) ModalPolicy {
+		return NewNaivePolicy(graph)
+	},
+	"graph": func(graph loggraph.LogGraph) ModalPolicy {
+		return NewGraphDiffPolicy(graph)
+	},
+}
+
+func TestModes(t *testing.T) {
+	base := chain("base", 20, gdp.NullHash)
+	last := base[len(base)-1].Hash
+	onlyA := chain("a", 3, last)
+	onlyB := chain("b", 4, gdp.GenerateHash("hole"))
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+	testCases := []struct {
+		modeA, modeB Mode
+		numA, numB   int
+	}{
+		{Bidirectional, Bidirectional, 27, 27},
+		{PushOnly, Bidirectional, 23, 27},
+		{PullOnly, Bidirectional, 27, 24},
+		{Bidirectional, PullOnly, 23, 27},
+		{PushOnly, PushOnly, 23, 24},
+		{PullOnly, PullOnly, 23, 24},
+	}
+
+	for name, newPolicy := range modalPolicies {
+		for _, testCase := range testCases {
+			graphA := graphFromRecords(t, append(append([]gdp.Record{}, base...), onlyA...))
+			graphB := graphFromRecords(t, append(append([]gdp.Record{}, base...), onlyB...))
+
+			policyA := newPolicy(graphA)
+			policyB := newPolicy(graphB)
+			policyA.SetPeerMode(addrB, testCase.modeA)
+			policyB.SetMode(testCase.modeB)
+
+			converse(t, policyA, addrA, policyB, addrB)
+			converse(t, policyB, addrB, policyA, addrA)
+
+			msg := "%s policy with modes %s and %s"
+			assert.Equal(t, testCase.numA, len(graphA.GetNodeMap()),
+				msg, name, testCase.modeA, testCase.modeB)
+			assert.Equal(t, testCase.numB, len(graphB.GetNodeMap()),
+				msg, name, testCase.modeA, testCase.modeB)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []Mode{Bidirectional, PushOnly, PullOnly} {
+		parsed, err := ParseMode(mode.String())
+		assert.Nil(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	_, err := ParseMode("sideways")
+	assert.NotNil(t, err)
+}
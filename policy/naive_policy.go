@@ -2,6 +2,7 @@ package policy
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/loggraph"
@@ -11,8 +12,16 @@ import (
 // NaivePolicy provides a naive approach to replication through the
 // brute force comparison of the hash sets on two peers.
 type NaivePolicy struct {
+	peerModes
+	conversationDeadlines
+	tieBreaker
+
 	logGraph loggraph.LogGraph
-	myState  map[gdp.Hash]PeerState
+
+	// state of each conversation in progress; finished conversations
+	// are removed, so a missing session is resting
+	myState map[session]PeerState
+	mutex   sync.Mutex
 }
 
 func NewNaivePolicy(
@@ -20,7 +29,7 @@ func NewNaivePolicy(
 ) *NaivePolicy {
 	return &NaivePolicy{
 		logGraph: logGraph,
-		myState:  make(map[gdp.Hash]PeerState),
+		myState:  make(map[session]PeerState),
 	}
 }
 
@@ -28,7 +37,12 @@ func NewNaivePolicy(
 // peers. All fields are labelled from the perspective of a
 // receiver.
 type NaiveMsgContent struct {
-	MsgNum          int
+	MsgNum  int
+	Session SessionID
+
+	// Mode of the sender with the receiver
+	Mode Mode
+
 	HashesAll       []gdp.Hash
 	HashesTheyWant  []gdp.Hash
 	HashesWeWant    []gdp.Hash
@@ -54,14 +68,22 @@ var (
 func (policy *NaivePolicy) GenerateMessage(
 	dest gdp.Hash,
 ) (interface{}, error) {
-	policy.initPeerIfNeeded(dest)
+	return policy.openSession(session{dest, newSessionID()}), nil
+}
+
+// openSession generates the first message of conversation s.
+func (policy *NaivePolicy) openSession(s session) *NaiveMsgContent {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
 
 	msg := &NaiveMsgContent{}
 	msg.HashesAll = policy.getAllLogHashes()
 	msg.MsgNum = first
+	msg.Session = s.id
+	msg.Mode = policy.modeFor(s.peer)
 
-	policy.myState[dest] = initHeartBeat
-	return msg, nil
+	policy.setState(s, initHeartBeat)
+	return msg
 }
 
 func (policy *NaivePolicy) ProcessMessage(
@@ -72,34 +94,49 @@ func (policy *NaivePolicy) ProcessMessage(
 		"processing message",
 		"src", src.Readable(),
 	)
-	policy.initPeerIfNeeded(src)
-
-	myState := policy.myState[src]
-
 	msg, ok := packedMsg.(*NaiveMsgContent)
 	if !ok {
 		return nil, errNaiveMsgContentConversion
 	}
 
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	s := session{src, msg.Session}
+	if policy.expire(s) {
+		delete(policy.myState, s)
+	}
+
+	// Both peers opened this conversation at the same time
+	if msg.MsgNum == first {
+		err := policy.breakTie(s, policy.myState[s] == initHeartBeat, policy.endConversation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	myState := policy.myState[s]
+
 	if myState == resting && msg.MsgNum == first {
-		return policy.processFirstMsg(src, msg)
+		return policy.processFirstMsg(s, msg)
 	} else if myState == initHeartBeat && msg.MsgNum == second {
-		return policy.processSecondMsg(src, msg)
+		return policy.processSecondMsg(s, msg)
 	} else if myState == receiveHeartBeat && msg.MsgNum == third {
-		return policy.processThirdMsg(src, msg)
+		return policy.processThirdMsg(s, msg)
 	} else {
 		zap.S().Errorw(
 			"expected different msg based on state",
 			"state", myState,
 			"msgNum", msg.MsgNum,
+			"session", msg.Session,
 		)
-		policy.myState[src] = resting
+		policy.setState(s, resting)
 		return nil, errInconsistentStateAndMsgNum
 	}
 }
 
 func (policy *NaivePolicy) processFirstMsg(
-	src gdp.Hash,
+	s session,
 	msg *NaiveMsgContent,
 ) (*NaiveMsgContent, error) {
 	zap.S().Infow("processing first msg")
@@ -110,8 +147,17 @@ func (policy *NaivePolicy) processFirstMsg(
 	// find the differences
 	onlyMine, onlyTheirs := findDifferences(myHashes, msg.HashesAll)
 
+	// only exchange records in the directions both peers allow
+	myMode := policy.modeFor(s.peer)
+	if !myMode.canSend(msg.Mode) {
+		onlyMine = nil
+	}
+	if !myMode.canReceive(msg.Mode) {
+		onlyTheirs = nil
+	}
+
 	// load the logs with hashes that only I have
-	onlyMyLogs, err := policy.logGraph.ReadRecords(onlyMine)
+	onlyMyLogs, err := readRecordPage(policy.logGraph, s.peer, onlyMine)
 	if err != nil {
 		return nil, err
 	}
@@ -119,30 +165,37 @@ func (policy *NaivePolicy) processFirstMsg(
 	// send data, requests
 	responseContent := &NaiveMsgContent{
 		MsgNum:         second,
+		Session:        s.id,
+		Mode:           myMode,
 		HashesTheyWant: onlyTheirs,
 		RecordsWeWant:  onlyMyLogs,
 	}
-	policy.myState[src] = receiveHeartBeat
+	policy.setState(s, receiveHeartBeat)
 	return responseContent, nil
 }
 
 func (policy *NaivePolicy) processSecondMsg(
-	src gdp.Hash,
+	s session,
 	msg *NaiveMsgContent,
 ) (*NaiveMsgContent, error) {
 	zap.S().Infow("processing second msg")
 
 	var err error
-	resp := &NaiveMsgContent{MsgNum: third}
-	resp.RecordsWeWant, err = policy.logGraph.ReadRecords(
-		msg.HashesTheyWant,
-	)
-	if err != nil {
-		return nil, err
+	myMode := policy.modeFor(s.peer)
+	resp := &NaiveMsgContent{MsgNum: third, Session: s.id, Mode: myMode}
+	if myMode.pushes() {
+		resp.RecordsWeWant, err = readRecordPage(
+			policy.logGraph,
+			s.peer,
+			msg.HashesTheyWant,
+		)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// save received data
-	err = policy.logGraph.WriteRecords(msg.RecordsWeWant)
+	err = policy.writeRecords(s.peer, msg.RecordsWeWant)
 	if err != nil {
 		zap.S().Errorw(
 			"Failed to save given logs",
@@ -156,17 +209,17 @@ func (policy *NaivePolicy) processSecondMsg(
 	)
 
 	// send data for requests
-	policy.myState[src] = resting
+	policy.setState(s, resting)
 	return resp, nil
 }
 
 func (policy *NaivePolicy) processThirdMsg(
-	src gdp.Hash,
+	s session,
 	msg *NaiveMsgContent,
 ) (*NaiveMsgContent, error) {
 	zap.S().Infow("processing third msg")
 
-	err := policy.logGraph.WriteRecords(msg.RecordsWeWant)
+	err := policy.writeRecords(s.peer, msg.RecordsWeWant)
 	if err != nil {
 		return nil, err
 	}
@@ -175,13 +228,58 @@ func (policy *NaivePolicy) processThirdMsg(
 		"num", len(msg.RecordsWeWant),
 	)
 
-	policy.myState[src] = resting
+	policy.setState(s, resting)
 	return nil, ErrConversationFinished
 }
 
-func (policy *NaivePolicy) initPeerIfNeeded(peer gdp.Hash) {
-	_, present := policy.myState[peer]
-	if !present {
-		policy.myState[peer] = resting
+// writeRecords stores records received from peer unless the mode
+// used with peer forbids it.
+func (policy *NaivePolicy) writeRecords(peer gdp.Hash, records []gdp.Record) error {
+	if !policy.modeFor(peer).pulls() {
+		if len(records) > 0 {
+			zap.S().Warnw(
+				"Dropping records received in push-only mode",
+				"peer", peer.Readable(),
+				"num", len(records),
+			)
+		}
+		return nil
+	}
+	return policy.logGraph.WriteRecordsFrom(peer, records)
+}
+
+// ExpireConversations resets the conversations with peers that have
+// not replied in time and returns those peers.
+func (policy *NaivePolicy) ExpireConversations() []gdp.Hash {
+	return peersOf(policy.expireSessions())
+}
+
+// expireSessions resets the conversations past their deadline and
+// returns them.
+func (policy *NaivePolicy) expireSessions() []session {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := policy.expireAll()
+	for _, s := range expired {
+		delete(policy.myState, s)
 	}
+	return expired
+}
+
+// setState moves conversation s to state, waiting for a reply unless
+// the conversation is over.
+func (policy *NaivePolicy) setState(s session, state PeerState) {
+	if state == resting {
+		delete(policy.myState, s)
+		policy.disarm(s)
+	} else {
+		policy.myState[s] = state
+		policy.arm(s)
+	}
+}
+
+// endConversation forgets conversation s.
+func (policy *NaivePolicy) endConversation(s session) {
+	policy.setState(s, resting)
 }
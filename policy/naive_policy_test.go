@@ -16,7 +16,7 @@ const DB_LOC = "/home/scott/go/src/github.com/tonyyanga/gdp-replicate/benchmark/
 
 func policyFromFile(t *testing.T, dbName string) *NaivePolicy {
 	sqlFile := fmt.Sprintf(DB_LOC, dbName)
-	fmt.Printf(sqlFile)
+	fmt.Println(sqlFile)
 	db, err := sql.Open("sqlite3", sqlFile)
 	assert.Nil(t, err)
 
@@ -32,16 +32,18 @@ func TestGenerateMessage(t *testing.T) {
 	policyShort := policyFromFile(t, "simple_short")
 
 	dest := gdp.NullHash
-	assert.Equal(t, resting, policyLong.myState[dest])
-	assert.Equal(t, resting, policyShort.myState[dest])
+	var s session
+	assert.Equal(t, resting, policyLong.myState[s])
+	assert.Equal(t, resting, policyShort.myState[s])
 
 	packedMsg, err := policyLong.GenerateMessage(dest)
 	msg := packedMsg.(*NaiveMsgContent)
 	assert.Nil(t, err)
+	s = session{dest, msg.Session}
 	assert.Equal(t, first, msg.MsgNum)
 	assert.Equal(t, 5, len(msg.HashesAll))
 	printHashes(msg.HashesAll)
-	assert.Equal(t, initHeartBeat, policyLong.myState[dest])
+	assert.Equal(t, initHeartBeat, policyLong.myState[s])
 
 	packedMsg, err = policyShort.ProcessMessage(gdp.NullHash, msg)
 	msg = packedMsg.(*NaiveMsgContent)
@@ -51,27 +53,28 @@ func TestGenerateMessage(t *testing.T) {
 	printHashes(msg.HashesTheyWant)
 	assert.Equal(t, 3, len(msg.HashesTheyWant))
 	assert.Equal(t, 0, len(msg.RecordsWeWant))
-	assert.Equal(t, receiveHeartBeat, policyShort.myState[dest])
+	assert.Equal(t, receiveHeartBeat, policyShort.myState[s])
 
 	packedMsg, err = policyLong.ProcessMessage(gdp.NullHash, msg)
 	msg = packedMsg.(*NaiveMsgContent)
 	assert.Nil(t, err)
 	assert.Equal(t, third, msg.MsgNum)
 	assert.Equal(t, 3, len(msg.RecordsWeWant))
-	assert.Equal(t, resting, policyLong.myState[dest])
+	assert.Equal(t, resting, policyLong.myState[s])
 
 	packedMsg, err = policyShort.ProcessMessage(gdp.NullHash, msg)
 	msg = packedMsg.(*NaiveMsgContent)
 	assert.Nil(t, err)
 	assert.Nil(t, msg)
-	assert.Equal(t, resting, policyShort.myState[dest])
+	assert.Equal(t, resting, policyShort.myState[s])
 
 	packedMsg, err = policyShort.GenerateMessage(gdp.NullHash)
 	msg = packedMsg.(*NaiveMsgContent)
 	assert.Nil(t, err)
+	s = session{gdp.NullHash, msg.Session}
 	assert.Equal(t, first, msg.MsgNum)
 	assert.Equal(t, 5, len(msg.HashesAll))
-	assert.Equal(t, initHeartBeat, policyShort.myState[gdp.NullHash])
+	assert.Equal(t, initHeartBeat, policyShort.myState[s])
 
 	packedMsg, err = policyLong.ProcessMessage(gdp.NullHash, msg)
 	msg = packedMsg.(*NaiveMsgContent)
@@ -79,7 +82,7 @@ func TestGenerateMessage(t *testing.T) {
 	assert.Equal(t, second, msg.MsgNum)
 	assert.Equal(t, 0, len(msg.HashesTheyWant))
 	assert.Equal(t, 0, len(msg.RecordsWeWant))
-	assert.Equal(t, receiveHeartBeat, policyLong.myState[dest])
+	assert.Equal(t, receiveHeartBeat, policyLong.myState[s])
 }
 
 func printHashes(hashes []gdp.Hash) {
@@ -88,3 +91,21 @@ func printHashes(hashes []gdp.Hash) {
 		fmt.Println(hash.Readable())
 	}
 }
+
+func TestNaivePolicyPages(t *testing.T) {
+	records := chain("log", maxRecordsPerMsg+100, gdp.NullHash)
+	graphA := graphFromRecords(t, records)
+	graphB := graphFromRecords(t, nil)
+
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	policyA := NewNaivePolicy(graphA)
+	policyB := NewNaivePolicy(graphB)
+
+	// The first page holds the oldest records, leaving no hole
+	converse(t, policyB, addrB, policyA, addrA)
+	assert.Equal(t, maxRecordsPerMsg, len(graphB.GetNodeMap()))
+	assert.Equal(t, []gdp.Hash{records[0].Hash}, graphB.GetLogicalBegins())
+
+	converse(t, policyB, addrB, policyA, addrA)
+	assertSameNodes(t, graphA, graphB)
+}
@@ -49,4 +49,31 @@ type Policy interface {
 	ProcessMessage(src gdp.Hash, packedMsg interface{}) (interface{}, error)
 }
 
+// BoundedPolicy is a Policy that can split the records it sends to a
+// peer across several messages.
+type BoundedPolicy interface {
+	Policy
+
+	// SetMaxPayload bounds the size in bytes of the records carried
+	// by one message, 0 meaning unbounded
+	SetMaxPayload(bytes int)
+}
+
+// TieBreakPolicy is a Policy that resolves two peers opening
+// conversations with each other at the same time with the same session
+// ID. The conversation opened by the peer with the greater address
+// continues, and the other peer answers it instead of its own.
+// Conversations with distinct session IDs all continue.
+type TieBreakPolicy interface {
+	Policy
+
+	// SetAddress sets the address of the local daemon
+	SetAddress(addr gdp.Hash)
+}
+
 var ErrConversationFinished = errors.New("conversation finished")
+
+// ErrMessageIgnored is returned when a message is dropped without a
+// reply, such as the first message of a conversation that lost a
+// tie-break.
+var ErrMessageIgnored = errors.New("message ignored")
@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"math/rand"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// SessionID identifies one conversation between a pair of peers, so
+// that several conversations can be in progress between them at once.
+// It is chosen by the peer opening the conversation and carried by
+// every message of the conversation.
+type SessionID uint64
+
+// SessionMessage is implemented by the message contents of every
+// policy.
+type SessionMessage interface {
+	// GetSession returns the conversation the message belongs to
+	GetSession() SessionID
+}
+
+// session identifies the state a policy keeps for one conversation.
+type session struct {
+	peer gdp.Hash
+	id   SessionID
+}
+
+// randomSessionID draws session IDs. Tests replace it to have peers
+// draw the same one.
+var randomSessionID = rand.Uint64
+
+// newSessionID returns a random, non-zero session ID.
+func newSessionID() SessionID {
+	for {
+		id := SessionID(randomSessionID())
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+func (msg *NaiveMsgContent) GetSession() SessionID       { return msg.Session }
+func (msg *GraphMsgContent) GetSession() SessionID       { return msg.Session }
+func (msg *MerkleMsgContent) GetSession() SessionID      { return msg.Session }
+func (msg *BloomMsgContent) GetSession() SessionID       { return msg.Session }
+func (msg *IBLTMsgContent) GetSession() SessionID        { return msg.Session }
+func (msg *AdaptiveMsgContent) GetSession() SessionID    { return msg.Session }
+func (msg *TombstoneMsgContent) GetSession() SessionID   { return innerSession(msg.Inner) }
+func (msg *LogMetadataMsgContent) GetSession() SessionID { return innerSession(msg.Inner) }
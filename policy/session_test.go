@@ -0,0 +1,124 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// numSessions returns the number of conversations a policy keeps state
+// for.
+func numSessions(policy Policy) int {
+	switch policy := policy.(type) {
+	case *NaivePolicy:
+		return len(policy.myState)
+	case *GraphDiffPolicy:
+		return len(policy.peerLastMsgType) + len(policy.graphInUse) + len(policy.pending)
+	case *MerklePolicy:
+		return len(policy.trees) + len(policy.opened)
+	case *BloomPolicy:
+		return len(policy.peerStates)
+	case *IBLTPolicy:
+		return len(policy.peerStates) + numSessions(policy.naive)
+	}
+	return 0
+}
+
+// TestConcurrentSessions interleaves two conversations opened by the
+// same peer and checks that both finish and leave no state behind.
+func TestConcurrentSessions(t *testing.T) {
+	for name, newPolicy := range tieBreakPolicies {
+		t.Run(name, func(t *testing.T) {
+			graphA := graphFromRecords(t, chain("a", 5, gdp.NullHash))
+			graphB := graphFromRecords(t, chain("b", 5, gdp.NullHash))
+			policyA, policyB := newPolicy(graphA), newPolicy(graphB)
+			addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+			peers := map[gdp.Hash]Policy{addrA: policyA, addrB: policyB}
+
+			type inFlight struct {
+				src, dest gdp.Hash
+				msg       interface{}
+			}
+			msgs := make([]inFlight, 0)
+			for i := 0; i < 2; i++ {
+				msg, err := policyA.GenerateMessage(addrB)
+				assert.Nil(t, err)
+				msgs = append(msgs, inFlight{addrA, addrB, msg})
+			}
+			assert.NotEqual(t,
+				msgs[0].msg.(SessionMessage).GetSession(),
+				msgs[1].msg.(SessionMessage).GetSession(),
+			)
+
+			// Deliver one message of each conversation in turn
+			for i := 0; len(msgs) > 0 && i < 100; i++ {
+				next := msgs[0]
+				msgs = msgs[1:]
+				resp, err := peers[next.dest].ProcessMessage(next.src, next.msg)
+				if err == ErrConversationFinished {
+					continue
+				}
+				assert.Nil(t, err)
+				if resp != nil {
+					msgs = append(msgs, inFlight{next.dest, next.src, resp})
+				}
+			}
+			assert.Empty(t, msgs)
+			assertSameNodes(t, graphA, graphB)
+			assert.Equal(t, 0, numSessions(policyA))
+			assert.Equal(t, 0, numSessions(policyB))
+		})
+	}
+}
+
+// TestConcurrentSessionsBothPeers has both peers open conversations
+// with each other before any message arrives. Their session IDs differ,
+// so none of them is a collision to break: all of them finish.
+func TestConcurrentSessionsBothPeers(t *testing.T) {
+	for name, newPolicy := range tieBreakPolicies {
+		t.Run(name, func(t *testing.T) {
+			graphA := graphFromRecords(t, chain("a", 5, gdp.NullHash))
+			graphB := graphFromRecords(t, chain("b", 5, gdp.NullHash))
+			policyA, policyB := newPolicy(graphA), newPolicy(graphB)
+			addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+			policyA.SetAddress(addrA)
+			policyB.SetAddress(addrB)
+			peers := map[gdp.Hash]Policy{addrA: policyA, addrB: policyB}
+
+			type inFlight struct {
+				src, dest gdp.Hash
+				msg       interface{}
+			}
+			msgs := make([]inFlight, 0)
+			for _, opener := range []gdp.Hash{addrA, addrB, addrA} {
+				dest := addrA
+				if opener == addrA {
+					dest = addrB
+				}
+				msg, err := peers[opener].GenerateMessage(dest)
+				assert.Nil(t, err)
+				msgs = append(msgs, inFlight{opener, dest, msg})
+			}
+
+			// Deliver one message of each conversation in turn
+			for i := 0; len(msgs) > 0 && i < 100; i++ {
+				next := msgs[0]
+				msgs = msgs[1:]
+				resp, err := peers[next.dest].ProcessMessage(next.src, next.msg)
+				if err == ErrConversationFinished {
+					continue
+				}
+				assert.Nil(t, err)
+				if resp != nil {
+					msgs = append(msgs, inFlight{next.dest, next.src, resp})
+				}
+			}
+			assert.Empty(t, msgs)
+			assertSameNodes(t, graphA, graphB)
+			assert.Equal(t, 10, len(graphA.GetNodeMap()))
+			assert.Equal(t, 0, numSessions(policyA))
+			assert.Equal(t, 0, numSessions(policyB))
+		})
+	}
+}
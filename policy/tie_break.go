@@ -0,0 +1,65 @@
+package policy
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+// tieBreaker decides which of two conversations opened simultaneously
+// by a pair of peers with the same session ID continues: the one
+// opened by the peer with the greater address. Policies embed it to
+// implement TieBreakPolicy.
+type tieBreaker struct {
+	self  gdp.Hash
+	mutex sync.RWMutex
+}
+
+// SetAddress sets the address of the local daemon.
+func (breaker *tieBreaker) SetAddress(addr gdp.Hash) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	breaker.self = addr
+}
+
+// breakTie resolves a first message from the peer of s when we opened
+// s as well, which only happens when both peers drew the same session
+// ID. If we yield, end drops our side of s and the message opens the
+// conversation of the peer; otherwise the message is ignored.
+// Conversations with distinct session IDs do not collide and go on
+// side by side.
+func (breaker *tieBreaker) breakTie(s session, opened bool, end func(s session)) error {
+	if !opened {
+		return nil
+	}
+	if !breaker.yields(s.peer) {
+		return ErrMessageIgnored
+	}
+	end(s)
+	return nil
+}
+
+// yields reports whether the conversation we opened with peer gives way
+// to the one peer opened at the same time. Without an address set, we
+// always yield.
+func (breaker *tieBreaker) yields(peer gdp.Hash) bool {
+	breaker.mutex.RLock()
+	defer breaker.mutex.RUnlock()
+
+	yields := bytes.Compare(breaker.self[:], peer[:]) < 0
+	if yields {
+		zap.S().Infow(
+			"Yielding to conversation opened by peer",
+			"peer", peer.Readable(),
+		)
+	} else {
+		zap.S().Infow(
+			"Ignoring conversation opened by peer",
+			"peer", peer.Readable(),
+		)
+	}
+	return yields
+}
@@ -0,0 +1,109 @@
+package policy
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+)
+
+// tieBreakPolicies constructs each TieBreakPolicy over a graph.
+var tieBreakPolicies = map[string]func(loggraph.LogGraph) TieBreakPolicy{
+	"naive": func(graph loggraph.LogGraph) TieBreakPolicy {
+		return NewNaivePolicy(graph)
+	},
+	"graphDiff": func(graph loggraph.LogGraph) TieBreakPolicy {
+		return NewGraphDiffPolicy(graph)
+	},
+	"merkle": func(graph loggraph.LogGraph) TieBreakPolicy {
+		return NewMerklePolicy(graph)
+	},
+	"bloom": func(graph loggraph.LogGraph) TieBreakPolicy {
+		return NewBloomPolicy(graph, DefaultBloomFalsePositiveRate)
+	},
+	"iblt": func(graph loggraph.LogGraph) TieBreakPolicy {
+		return NewIBLTPolicy(graph)
+	},
+}
+
+// finishConversation delivers msg from src to dest and the replies
+// back and forth until the conversation ends.
+func finishConversation(
+	t *testing.T,
+	peers map[gdp.Hash]Policy,
+	src gdp.Hash,
+	dest gdp.Hash,
+	msg interface{},
+) {
+	var err error
+	for i := 0; msg != nil && i < 100; i++ {
+		msg, err = peers[dest].ProcessMessage(src, msg)
+		if err == ErrConversationFinished {
+			break
+		}
+		assert.Nil(t, err)
+		src, dest = dest, src
+	}
+}
+
+// TestSimultaneousFirstMsgs has both peers open a conversation with the
+// same session ID before either first message arrives, with both
+// orders of addresses.
+func TestSimultaneousFirstMsgs(t *testing.T) {
+	defer func() { randomSessionID = rand.Uint64 }()
+	randomSessionID = func() uint64 { return 42 }
+
+	for name, newPolicy := range tieBreakPolicies {
+		for _, addrs := range [][2]string{{"A", "B"}, {"B", "A"}} {
+			t.Run(name+addrs[0], func(t *testing.T) {
+				graphA := graphFromRecords(t, chain("a", 5, gdp.NullHash))
+				graphB := graphFromRecords(t, chain("b", 5, gdp.NullHash))
+				policyA, policyB := newPolicy(graphA), newPolicy(graphB)
+				addrA := gdp.GenerateHash(addrs[0])
+				addrB := gdp.GenerateHash(addrs[1])
+				policyA.SetAddress(addrA)
+				policyB.SetAddress(addrB)
+
+				msgA, err := policyA.GenerateMessage(addrB)
+				assert.Nil(t, err)
+				msgB, err := policyB.GenerateMessage(addrA)
+				assert.Nil(t, err)
+
+				respB, errB := policyB.ProcessMessage(addrA, msgA)
+				respA, errA := policyA.ProcessMessage(addrB, msgB)
+
+				// The conversation opened by the greater address continues
+				winner, loser := policyA, policyB
+				winnerAddr, loserAddr := addrA, addrB
+				resp := respB
+				if bytes.Compare(addrA[:], addrB[:]) < 0 {
+					winner, loser = policyB, policyA
+					winnerAddr, loserAddr = addrB, addrA
+					resp = respA
+					assert.Equal(t, ErrMessageIgnored, errB)
+					assert.Nil(t, errA)
+				} else {
+					assert.Equal(t, ErrMessageIgnored, errA)
+					assert.Nil(t, errB)
+				}
+
+				// Finish the winning conversation, starting with the
+				// reply of the loser
+				peers := map[gdp.Hash]Policy{
+					winnerAddr: winner,
+					loserAddr:  loser,
+				}
+				finishConversation(t, peers, loserAddr, winnerAddr, resp)
+				assertSameNodes(t, graphA, graphB)
+
+				// Neither side is left waiting for the abandoned one
+				converse(t, policyA, addrA, policyB, addrB)
+				converse(t, policyB, addrB, policyA, addrA)
+				assertSameNodes(t, graphA, graphB)
+			})
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+// DefaultConversationTimeout is how long a policy waits for the reply
+// of a peer before abandoning the conversation.
+const DefaultConversationTimeout = 2 * time.Second
+
+// TimeoutPolicy is a Policy that abandons conversations in which a peer
+// has not replied in time. Expired conversations are reset when the
+// peer sends its next message, or earlier through ExpireConversations.
+type TimeoutPolicy interface {
+	Policy
+
+	// SetConversationTimeout sets how long to wait for a reply, 0
+	// meaning DefaultConversationTimeout
+	SetConversationTimeout(timeout time.Duration)
+
+	// ExpireConversations resets all conversations past their
+	// deadline and returns the peers involved, each once
+	ExpireConversations() []gdp.Hash
+}
+
+// conversationDeadlines keeps the deadline of each conversation in
+// progress. Policies embed it to implement TimeoutPolicy.
+type conversationDeadlines struct {
+	timeout   time.Duration
+	deadlines map[session]time.Time
+	mutex     sync.Mutex
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// SetConversationTimeout sets how long to wait for a reply, 0 meaning
+// DefaultConversationTimeout.
+func (deadlines *conversationDeadlines) SetConversationTimeout(timeout time.Duration) {
+	deadlines.mutex.Lock()
+	defer deadlines.mutex.Unlock()
+
+	deadlines.timeout = timeout
+}
+
+// arm starts waiting for a reply in conversation s.
+func (deadlines *conversationDeadlines) arm(s session) {
+	deadlines.mutex.Lock()
+	defer deadlines.mutex.Unlock()
+
+	timeout := deadlines.timeout
+	if timeout <= 0 {
+		timeout = DefaultConversationTimeout
+	}
+	if deadlines.deadlines == nil {
+		deadlines.deadlines = make(map[session]time.Time)
+	}
+	deadlines.deadlines[s] = deadlines.currentTime().Add(timeout)
+}
+
+// disarm stops waiting for a reply in conversation s.
+func (deadlines *conversationDeadlines) disarm(s session) {
+	deadlines.mutex.Lock()
+	defer deadlines.mutex.Unlock()
+
+	delete(deadlines.deadlines, s)
+}
+
+// expire reports whether conversation s is past its deadline, in which
+// case it stops waiting for a reply.
+func (deadlines *conversationDeadlines) expire(s session) bool {
+	deadlines.mutex.Lock()
+	defer deadlines.mutex.Unlock()
+
+	deadline, present := deadlines.deadlines[s]
+	if !present || deadlines.currentTime().Before(deadline) {
+		return false
+	}
+
+	delete(deadlines.deadlines, s)
+	zap.S().Warnw(
+		"Conversation expired",
+		"peer", s.peer.Readable(),
+		"session", s.id,
+		"deadline", deadline,
+	)
+	return true
+}
+
+// expireAll stops waiting in every conversation past its deadline and
+// returns those conversations.
+func (deadlines *conversationDeadlines) expireAll() []session {
+	deadlines.mutex.Lock()
+	sessions := make([]session, 0)
+	for s, deadline := range deadlines.deadlines {
+		if !deadlines.currentTime().Before(deadline) {
+			sessions = append(sessions, s)
+		}
+	}
+	deadlines.mutex.Unlock()
+
+	expired := make([]session, 0, len(sessions))
+	for _, s := range sessions {
+		if deadlines.expire(s) {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+// peersOf returns the peers involved in sessions, each once.
+func peersOf(sessions []session) []gdp.Hash {
+	seen := make(map[gdp.Hash]bool)
+	peers := make([]gdp.Hash, 0, len(sessions))
+	for _, s := range sessions {
+		if !seen[s.peer] {
+			seen[s.peer] = true
+			peers = append(peers, s.peer)
+		}
+	}
+	return peers
+}
+
+func (deadlines *conversationDeadlines) currentTime() time.Time {
+	if deadlines.now != nil {
+		return deadlines.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,106 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	current time.Time
+}
+
+func (clock *fakeClock) now() time.Time {
+	return clock.current
+}
+
+func (clock *fakeClock) advance(duration time.Duration) {
+	clock.current = clock.current.Add(duration)
+}
+
+// timeoutPolicies constructs each TimeoutPolicy over a graph, reading
+// time from clock.
+var timeoutPolicies = map[string]func(loggraph.LogGraph, *fakeClock) TimeoutPolicy{
+	"naive": func(graph loggraph.LogGraph, clock *fakeClock) TimeoutPolicy {
+		policy := NewNaivePolicy(graph)
+		policy.now = clock.now
+		return policy
+	},
+	"graphDiff": func(graph loggraph.LogGraph, clock *fakeClock) TimeoutPolicy {
+		policy := NewGraphDiffPolicy(graph)
+		policy.now = clock.now
+		return policy
+	},
+	"merkle": func(graph loggraph.LogGraph, clock *fakeClock) TimeoutPolicy {
+		policy := NewMerklePolicy(graph)
+		policy.now = clock.now
+		return policy
+	},
+	"bloom": func(graph loggraph.LogGraph, clock *fakeClock) TimeoutPolicy {
+		policy := NewBloomPolicy(graph, DefaultBloomFalsePositiveRate)
+		policy.now = clock.now
+		return policy
+	},
+	"iblt": func(graph loggraph.LogGraph, clock *fakeClock) TimeoutPolicy {
+		policy := NewIBLTPolicy(graph)
+		policy.now = clock.now
+		policy.naive.now = clock.now
+		return policy
+	},
+}
+
+// TestExpireConversations loses the first message of a conversation
+// and checks that it expires after the timeout only.
+func TestExpireConversations(t *testing.T) {
+	for name, newPolicy := range timeoutPolicies {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{current: time.Unix(0, 0)}
+			graphA := graphFromRecords(t, chain("a", 5, gdp.NullHash))
+			graphB := graphFromRecords(t, chain("b", 5, gdp.NullHash))
+			policyA := newPolicy(graphA, clock)
+			policyB := newPolicy(graphB, clock)
+			policyA.SetConversationTimeout(time.Second)
+			addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+			_, err := policyA.GenerateMessage(addrB)
+			assert.Nil(t, err)
+
+			clock.advance(500 * time.Millisecond)
+			assert.Empty(t, policyA.ExpireConversations())
+
+			clock.advance(time.Second)
+			assert.Equal(t, []gdp.Hash{addrB}, policyA.ExpireConversations())
+			assert.Empty(t, policyA.ExpireConversations())
+
+			// A accepts a conversation opened by B
+			converse(t, policyB, addrB, policyA, addrA)
+			assertSameNodes(t, graphA, graphB)
+		})
+	}
+}
+
+// TestExpireOnMessage checks that a message arriving after the
+// deadline finds the conversation reset without ExpireConversations.
+func TestExpireOnMessage(t *testing.T) {
+	for name, newPolicy := range timeoutPolicies {
+		t.Run(name, func(t *testing.T) {
+			clock := &fakeClock{current: time.Unix(0, 0)}
+			graphA := graphFromRecords(t, chain("a", 5, gdp.NullHash))
+			graphB := graphFromRecords(t, chain("b", 5, gdp.NullHash))
+			policyA := newPolicy(graphA, clock)
+			policyB := newPolicy(graphB, clock)
+			addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+
+			_, err := policyA.GenerateMessage(addrB)
+			assert.Nil(t, err)
+
+			clock.advance(DefaultConversationTimeout)
+			converse(t, policyB, addrB, policyA, addrA)
+			assertSameNodes(t, graphA, graphB)
+		})
+	}
+}
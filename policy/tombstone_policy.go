@@ -0,0 +1,243 @@
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"go.uber.org/zap"
+)
+
+var errTombstoneMsgContentConversion = errors.New(
+	"Unable to cast packedMsg to *TombstoneMsgContent",
+)
+
+// Tombstones are attached to messages in pages of at most
+// maxTombstonesPerMsg, each tombstoneSize bytes once encoded.
+const (
+	maxTombstonesPerMsg = 1024
+	tombstoneSize       = 2 * len(gdp.NullHash)
+)
+
+// TombstonePolicy wraps a Policy to replicate the tombstones of
+// deleted records along with its conversations, so that peers delete
+// the same records instead of sending them back.
+//
+// Every message carries a digest of the tombstones of its sender. A
+// receiver whose digest differs attaches all of its tombstones to its
+// reply, asking for those of the peer if the message had none. Large
+// sets of tombstones are sent a page per message, each peer getting
+// the page after the last one it got.
+//
+// Tombstones are not signed, so a peer could delete any record with
+// them. The tombstones of a message only delete records held that the
+// local retention does not keep either, and are ignored from peers the
+// replica does not pull from. They are applied before the wrapped
+// policy handles the message, so those records are not written back.
+// Tombstones not applied are kept, and the wrapped policy does not send
+// their records to the peer that deleted them.
+type TombstonePolicy struct {
+	wrappedPolicy
+	peerModes
+
+	graph     loggraph.LogGraph
+	retention logserver.Retention
+
+	// maxTombstones bounds the tombstones attached to a message, and
+	// cursors is the hash of the last tombstone sent to each peer
+	maxTombstones int
+	cursors       map[gdp.Hash]gdp.Hash
+	mutex         sync.Mutex
+}
+
+// TombstoneMsgContent wraps the message of the wrapped policy.
+type TombstoneMsgContent struct {
+	// Digest and NumTombstones summarize the tombstones of the sender
+	Digest        gdp.Hash
+	NumTombstones int
+
+	// Tombstones holds a page of the tombstones of the sender, if the
+	// digests of the peers differed
+	Tombstones []gdp.Tombstone
+
+	// WantTombstones asks the receiver to attach its tombstones to its
+	// reply
+	WantTombstones bool
+
+	Inner interface{}
+}
+
+// NewTombstonePolicy wraps policy, which replicates graph.
+func NewTombstonePolicy(graph loggraph.LogGraph, policy Policy) *TombstonePolicy {
+	return &TombstonePolicy{
+		wrappedPolicy: wrappedPolicy{policy},
+		graph:         graph,
+		maxTombstones: maxTombstonesPerMsg,
+		cursors:       make(map[gdp.Hash]gdp.Hash),
+	}
+}
+
+// SetRetention sets the retention of the log, outside of which the
+// tombstones of peers delete records.
+func (policy *TombstonePolicy) SetRetention(retention logserver.Retention) {
+	policy.retention = retention
+}
+
+// SetMaxPayload bounds the size of the tombstones attached to a single
+// message. It does not bound the records of the wrapped policy.
+func (policy *TombstonePolicy) SetMaxPayload(maxBytes int) {
+	policy.maxTombstones = maxTombstonesPerMsg
+	if maxBytes > 0 && maxBytes/tombstoneSize < policy.maxTombstones {
+		policy.maxTombstones = maxBytes / tombstoneSize
+	}
+	if policy.maxTombstones < 1 {
+		policy.maxTombstones = 1
+	}
+}
+
+// GenerateMessage wraps the message opening a conversation with dest.
+func (policy *TombstonePolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	inner, err := policy.Policy.GenerateMessage(dest)
+	if err != nil || inner == nil {
+		return nil, err
+	}
+	return policy.wrap(inner), nil
+}
+
+// ProcessMessage applies the tombstones of a message from src, hands
+// the wrapped message to the wrapped policy and wraps its reply.
+func (policy *TombstonePolicy) ProcessMessage(
+	src gdp.Hash,
+	packedMsg interface{},
+) (interface{}, error) {
+	msg, ok := packedMsg.(*TombstoneMsgContent)
+	if !ok {
+		return nil, errTombstoneMsgContentConversion
+	}
+
+	err := policy.applyTombstones(src, msg.Tombstones)
+	if err != nil {
+		return nil, err
+	}
+
+	inner, err := policy.Policy.ProcessMessage(src, msg.Inner)
+	if err != nil || inner == nil {
+		return nil, err
+	}
+
+	resp := policy.wrap(inner)
+	differ := resp.Digest != msg.Digest || resp.NumTombstones != msg.NumTombstones
+	if msg.WantTombstones || differ {
+		resp.Tombstones = policy.tombstones(src)
+		resp.WantTombstones = differ && len(msg.Tombstones) == 0
+	}
+	return resp, nil
+}
+
+// applyTombstones deletes the records of the tombstones from src that
+// are held and that the local retention does not keep. All of them are
+// kept by the graph, so the records src deleted are not sent back.
+func (policy *TombstonePolicy) applyTombstones(
+	src gdp.Hash,
+	tombstones []gdp.Tombstone,
+) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	// Whether src deleted a record only matters to what is sent to
+	// src, so its tombstones are kept even if untrusted
+	policy.graph.AddPeerTombstones(src, tombstones)
+	if !policy.modeFor(src).pulls() {
+		zap.S().Debugw(
+			"Ignoring tombstones from peer not pulled from",
+			"src", src.Readable(),
+			"numTombstones", len(tombstones),
+		)
+		return nil
+	}
+
+	// The tombstones written are local ones, so the peer cannot pick
+	// their PrevHash either
+	expired, err := policy.graph.GetExpired(policy.retention)
+	if err != nil {
+		return err
+	}
+	expiredMap := make(map[gdp.Hash]gdp.Tombstone, len(expired))
+	for _, tombstone := range expired {
+		expiredMap[tombstone.Hash] = tombstone
+	}
+
+	nodeMap := policy.graph.GetNodeMap()
+	fresh := make([]gdp.Tombstone, 0)
+	for _, tombstone := range tombstones {
+		local, present := expiredMap[tombstone.Hash]
+		if present && nodeMap[tombstone.Hash] {
+			fresh = append(fresh, local)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	zap.S().Infow(
+		"Applying tombstones from peer",
+		"src", src.Readable(),
+		"numTombstones", len(fresh),
+		"numIgnored", len(tombstones)-len(fresh),
+	)
+	return policy.graph.WriteTombstones(fresh)
+}
+
+// wrap wraps inner with the digest of the local tombstones.
+func (policy *TombstonePolicy) wrap(inner interface{}) *TombstoneMsgContent {
+	msg := &TombstoneMsgContent{Inner: inner}
+	for hash := range policy.graph.GetPrunedMap() {
+		for i := range msg.Digest {
+			msg.Digest[i] ^= hash[i]
+		}
+		msg.NumTombstones++
+	}
+	return msg
+}
+
+// tombstones returns the next page of local tombstones for peer, by
+// increasing hash.
+func (policy *TombstonePolicy) tombstones(peer gdp.Hash) []gdp.Tombstone {
+	pruned := policy.graph.GetPrunedMap()
+	tombstones := make([]gdp.Tombstone, 0, len(pruned))
+	for hash, prevHash := range pruned {
+		tombstones = append(tombstones, gdp.Tombstone{
+			Hash:     hash,
+			PrevHash: prevHash,
+		})
+	}
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	if len(tombstones) <= policy.maxTombstones {
+		delete(policy.cursors, peer)
+		return tombstones
+	}
+
+	sort.Slice(tombstones, func(i, j int) bool {
+		return bytes.Compare(tombstones[i].Hash[:], tombstones[j].Hash[:]) < 0
+	})
+	cursor := policy.cursors[peer]
+	start := sort.Search(len(tombstones), func(i int) bool {
+		return bytes.Compare(tombstones[i].Hash[:], cursor[:]) > 0
+	})
+
+	// The page wraps around to the lowest hashes
+	page := make([]gdp.Tombstone, 0, policy.maxTombstones)
+	for i := 0; i < policy.maxTombstones; i++ {
+		page = append(page, tombstones[(start+i)%len(tombstones)])
+	}
+	policy.cursors[peer] = page[len(page)-1].Hash
+	return page
+}
@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+func TestTombstonePolicy(t *testing.T) {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	for name, newPolicy := range conformancePolicies {
+		records := chain("shared", 20, gdp.NullHash)
+		extra := chain("extra", 3, records[19].Hash)
+
+		graphA := graphFromRecords(t, records)
+		graphB := graphFromRecords(t, append(records, extra...))
+
+		// Records share a timestamp, so the lowest RecNos are pruned
+		pruned, err := graphA.Prune(logserver.Retention{MaxRecords: 15})
+		assert.Nil(t, err, name)
+		assert.Equal(t, 5, len(pruned), name)
+
+		policyA := NewTombstonePolicy(graphA, newPolicy(graphA))
+		policyB := NewTombstonePolicy(graphB, newPolicy(graphB))
+		policyA.SetRetention(logserver.Retention{MaxRecords: 15})
+		policyB.SetRetention(logserver.Retention{MaxRecords: 15})
+		for round := 0; round < 3; round++ {
+			converse(t, policyA, addrA, policyB, addrB)
+			converse(t, policyB, addrB, policyA, addrA)
+		}
+
+		assertSameNodes(t, graphA, graphB)
+		assert.Equal(t, 18, len(graphA.GetNodeMap()), name)
+		for _, graph := range []loggraph.LogGraph{graphA, graphB} {
+			assert.Equal(t, 5, len(graph.GetPrunedMap()), name)
+			for _, record := range records[:5] {
+				assert.False(t, graph.GetNodeMap()[record.Hash], name)
+			}
+
+			// The pruned prefix is not a hole
+			begins := graph.GetLogicalBegins()
+			assert.Equal(t, []gdp.Hash{records[5].Hash}, begins, name)
+			_, present := graph.GetPrunedMap()[records[5].PrevHash]
+			assert.True(t, present, name)
+		}
+	}
+}
+
+// receivingGraph counts the records written to a graph from peers,
+// including those it drops.
+type receivingGraph struct {
+	loggraph.LogGraph
+	numReceived int
+}
+
+func (graph *receivingGraph) WriteRecordsFrom(src gdp.Hash, records []gdp.Record) error {
+	graph.numReceived += len(records)
+	return graph.LogGraph.WriteRecordsFrom(src, records)
+}
+
+func TestTombstonePolicyRetentionsDiffer(t *testing.T) {
+	addrA, addrB := gdp.GenerateHash("A"), gdp.GenerateHash("B")
+	for name, newPolicy := range conformancePolicies {
+		records := chain("shared", 20, gdp.NullHash)
+		graphA := &receivingGraph{LogGraph: graphFromRecords(t, records)}
+		graphB := graphFromRecords(t, records)
+
+		// Only A prunes; B keeps every record
+		retention := logserver.Retention{MaxRecords: 15}
+		pruned, err := graphA.Prune(retention)
+		assert.Nil(t, err, name)
+		assert.Equal(t, 5, len(pruned), name)
+
+		policyA := NewTombstonePolicy(graphA, newPolicy(graphA))
+		policyB := NewTombstonePolicy(graphB, newPolicy(graphB))
+		policyA.SetRetention(retention)
+
+		// B may send the records before it learns of the tombstones
+		converse(t, policyA, addrA, policyB, addrB)
+		converse(t, policyB, addrB, policyA, addrA)
+		graphA.numReceived = 0
+		for round := 0; round < 3; round++ {
+			converse(t, policyA, addrA, policyB, addrB)
+			converse(t, policyB, addrB, policyA, addrA)
+		}
+
+		// B keeps the tombstones of A and sends the records back to it
+		// no more
+		assert.Equal(t, 20, len(graphB.GetNodeMap()), name)
+		assert.Equal(t, 5, len(graphB.GetPeerPruned(addrA)), name)
+		assert.Equal(t, 0, len(graphB.GetPeerPruned(addrB)), name)
+		assert.Equal(t, 15, len(graphA.GetNodeMap()), name)
+		assert.Equal(t, 0, graphA.numReceived, name)
+	}
+}
+
+func TestTombstoneDigest(t *testing.T) {
+	records := chain("shared", 4, gdp.NullHash)
+	graphA := graphFromRecords(t, records)
+	graphB := graphFromRecords(t, records)
+	policyA := NewTombstonePolicy(graphA, NewNaivePolicy(graphA))
+	policyB := NewTombstonePolicy(graphB, NewNaivePolicy(graphB))
+
+	tombstones := []gdp.Tombstone{
+		{Hash: records[0].Hash},
+		{Hash: records[1].Hash, PrevHash: records[0].Hash},
+	}
+	assert.Nil(t, graphA.WriteTombstones(tombstones))
+	assert.Nil(t, graphB.WriteTombstones([]gdp.Tombstone{tombstones[1], tombstones[0]}))
+
+	// Equal sets of tombstones are not sent
+	msg, err := policyA.GenerateMessage(gdp.GenerateHash("B"))
+	assert.Nil(t, err)
+	resp, err := policyB.ProcessMessage(gdp.GenerateHash("A"), msg)
+	assert.Nil(t, err)
+	assert.Equal(t, msg.(*TombstoneMsgContent).Digest, resp.(*TombstoneMsgContent).Digest)
+	assert.Nil(t, resp.(*TombstoneMsgContent).Tombstones)
+	assert.False(t, resp.(*TombstoneMsgContent).WantTombstones)
+}
+
+func TestTombstonePolicyUntrusted(t *testing.T) {
+	addrA := gdp.GenerateHash("A")
+	records := chain("shared", 20, gdp.NullHash)
+	tombstones := []gdp.Tombstone{
+		{Hash: records[0].Hash, PrevHash: gdp.NullHash},
+		{Hash: records[1].Hash, PrevHash: gdp.GenerateHash("forged")},
+		{Hash: records[19].Hash, PrevHash: records[18].Hash},
+	}
+	applied := func(policy *TombstonePolicy) map[gdp.Hash]gdp.Hash {
+		msg := &TombstoneMsgContent{Tombstones: tombstones}
+		_, err := policy.ProcessMessage(addrA, msg)
+		assert.Equal(t, errNaiveMsgContentConversion, err)
+		return policy.graph.GetPrunedMap()
+	}
+
+	// Without a retention, no record is deleted
+	graph := graphFromRecords(t, records)
+	assert.Equal(t, 0, len(applied(NewTombstonePolicy(graph, NewNaivePolicy(graph)))))
+
+	// Nor from a peer records are only pushed to
+	graph = graphFromRecords(t, records)
+	policy := NewTombstonePolicy(graph, NewNaivePolicy(graph))
+	policy.SetRetention(logserver.Retention{MaxRecords: 15})
+	policy.SetPeerMode(addrA, PushOnly)
+	assert.Equal(t, 0, len(applied(policy)))
+
+	// The newest record is kept, and tombstones take the local PrevHash
+	graph = graphFromRecords(t, records)
+	policy = NewTombstonePolicy(graph, NewNaivePolicy(graph))
+	policy.SetRetention(logserver.Retention{MaxRecords: 15})
+	assert.Equal(t, map[gdp.Hash]gdp.Hash{
+		records[0].Hash: gdp.NullHash,
+		records[1].Hash: records[0].Hash,
+	}, applied(policy))
+}
+
+func TestTombstonePages(t *testing.T) {
+	addrB, addrC := gdp.GenerateHash("B"), gdp.GenerateHash("C")
+	graph := graphFromRecords(t, chain("shared", 10, gdp.NullHash))
+	pruned, err := graph.Prune(logserver.Retention{MaxRecords: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(pruned))
+
+	policy := NewTombstonePolicy(graph, NewNaivePolicy(graph))
+	policy.SetMaxPayload(3 * tombstoneSize)
+
+	// Each peer gets the page after the last one it got
+	sent := make(map[gdp.Hash]bool)
+	for page := 0; page < 3; page++ {
+		tombstones := policy.tombstones(addrB)
+		assert.Equal(t, 3, len(tombstones))
+		for _, tombstone := range tombstones {
+			sent[tombstone.Hash] = true
+		}
+	}
+	assert.Equal(t, 8, len(sent))
+	assert.Equal(t, 3, len(policy.tombstones(addrC)))
+
+	policy.SetMaxPayload(0)
+	assert.Equal(t, 8, len(policy.tombstones(addrB)))
+}
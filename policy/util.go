@@ -1,6 +1,10 @@
 package policy
 
-import "github.com/tonyyanga/gdp-replicate/gdp"
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"go.uber.org/zap"
+)
 
 type PeerState int
 
@@ -10,6 +14,7 @@ const (
 	second
 	third
 	fourth
+	fifth
 )
 
 // findDifferences determines which hashes are exclusive to only one list.
@@ -45,3 +50,54 @@ func initSet(hashes []gdp.Hash) map[gdp.Hash]bool {
 	}
 	return set
 }
+
+// maxRecordsPerMsg bounds the records of a message of the policies
+// sending a whole difference at once, so that transfers run in bounded
+// memory. Records left out are sent by later conversations, which find
+// them missing again.
+const maxRecordsPerMsg = 1024
+
+// withoutPeerPruned returns the hashes of records peer has not deleted.
+// The tombstones of peer only delete records outside its retention, so
+// records it deleted would otherwise be sent to it again and again.
+func withoutPeerPruned(
+	graph loggraph.LogGraph,
+	peer gdp.Hash,
+	hashes []gdp.Hash,
+) []gdp.Hash {
+	pruned := graph.GetPeerPruned(peer)
+	if len(pruned) == 0 {
+		return hashes
+	}
+
+	kept := make([]gdp.Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		if !pruned[hash] {
+			kept = append(kept, hash)
+		}
+	}
+	return kept
+}
+
+// readRecordPage reads the records of hashes to send to peer, up to
+// maxRecordsPerMsg of them, ancestors first. Records peer deleted are
+// left out.
+func readRecordPage(
+	graph loggraph.LogGraph,
+	peer gdp.Hash,
+	hashes []gdp.Hash,
+) ([]gdp.Record, error) {
+	hashes = withoutPeerPruned(graph, peer, hashes)
+	if len(hashes) > maxRecordsPerMsg {
+		hashes = orderAncestorsFirst(hashes, graph)
+	}
+	if len(hashes) > maxRecordsPerMsg {
+		zap.S().Infow(
+			"Deferring records to later conversations",
+			"numRecords", len(hashes),
+			"numDeferred", len(hashes)-maxRecordsPerMsg,
+		)
+		hashes = hashes[:maxRecordsPerMsg]
+	}
+	return graph.ReadRecords(hashes)
+}
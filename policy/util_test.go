@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+// graphFromRecords builds a SimpleGraph over an in-memory database
+// holding records.
+func graphFromRecords(t *testing.T, records []gdp.Record) *loggraph.SimpleGraph {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.Nil(t, err)
+
+	// Every connection to :memory: opens a distinct database
+	db.SetMaxOpenConns(1)
+
+	logServer := logserver.NewSqliteServer(db)
+	assert.Nil(t, logServer.Migrate())
+	assert.Nil(t, logServer.WriteRecords(records))
+
+	graph, err := loggraph.NewSimpleGraph(logServer)
+	assert.Nil(t, err)
+	return graph
+}
+
+// chain returns n records holding name in which the first record
+// points at prev.
+func chain(name string, n int, prev gdp.Hash) []gdp.Record {
+	return chainOf(name, n, prev, []byte(name))
+}
+
+// chainOf returns n records holding value, following prev, with
+// canonical hashes.
+func chainOf(name string, n int, prev gdp.Hash, value []byte) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	for i := 1; i <= n; i++ {
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{
+				RecNo:    i,
+				PrevHash: prev,
+				Sig:      []byte{},
+			},
+			Value: value,
+		}
+		record.Hash = gdp.RecordHash(record)
+		records = append(records, record)
+		prev = record.Hash
+	}
+	return records
+}
+
+// converse runs a conversation opened by initiator with receiver
+// until it finishes. It returns the number of messages exchanged.
+func converse(
+	t *testing.T,
+	initiator Policy,
+	initiatorAddr gdp.Hash,
+	receiver Policy,
+	receiverAddr gdp.Hash,
+) int {
+	msg, err := initiator.GenerateMessage(receiverAddr)
+	assert.Nil(t, err)
+
+	numMsgs := 0
+	src, dest := initiatorAddr, receiverAddr
+	peers := map[gdp.Hash]Policy{
+		initiatorAddr: initiator,
+		receiverAddr:  receiver,
+	}
+	for msg != nil && numMsgs < 100 {
+		numMsgs++
+		msg, err = peers[dest].ProcessMessage(src, msg)
+		if err == ErrConversationFinished {
+			break
+		}
+		assert.Nil(t, err)
+		src, dest = dest, src
+	}
+	return numMsgs
+}
+
+// assertSameNodes checks that both graphs hold the same nodes.
+func assertSameNodes(t *testing.T, a, b loggraph.LogGraph) {
+	assert.Equal(t, len(a.GetNodeMap()), len(b.GetNodeMap()))
+	for hash := range a.GetNodeMap() {
+		_, present := b.GetNodeMap()[hash]
+		assert.True(t, present, "missing %s", hash.Readable())
+	}
+}
@@ -0,0 +1,40 @@
+package policy
+
+import (
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// wrappedPolicy is embedded by the policies wrapping another Policy,
+// such as TombstonePolicy, whose conversations they carry. It forwards
+// timeouts to the wrapped policy if it supports them.
+type wrappedPolicy struct {
+	Policy
+}
+
+// SetConversationTimeout sets how long the wrapped policy waits for a
+// reply, if it supports timeouts.
+func (wrapped wrappedPolicy) SetConversationTimeout(timeout time.Duration) {
+	if timeoutPolicy, ok := wrapped.Policy.(TimeoutPolicy); ok {
+		timeoutPolicy.SetConversationTimeout(timeout)
+	}
+}
+
+// ExpireConversations expires the conversations of the wrapped policy,
+// if it supports timeouts.
+func (wrapped wrappedPolicy) ExpireConversations() []gdp.Hash {
+	if timeoutPolicy, ok := wrapped.Policy.(TimeoutPolicy); ok {
+		return timeoutPolicy.ExpireConversations()
+	}
+	return nil
+}
+
+// innerSession returns the conversation of inner, the message of a
+// wrapped policy, or 0 if it has none.
+func innerSession(inner interface{}) SessionID {
+	if msg, ok := inner.(SessionMessage); ok {
+		return msg.GetSession()
+	}
+	return 0
+}